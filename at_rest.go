@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	storageKeyFile  = "storage.key"
+	encryptedSuffix = ".chute"
+	atRestSaltSize  = 16
+	atRestInfo      = "chute at-rest v1"
+)
+
+var atRestMagic = []byte("CHUTEAR1")
+
+// Encryption at rest
+//
+// With encrypt-downloads on, received files are stored as
+// "<name>.chute": the magic, a random salt, then a sealed stream under a
+// key derived from the salt and the storage key in the config dir. The
+// storage key never leaves this machine, so copying the download
+// directory elsewhere yields nothing readable; ExportFile decrypts.
+// Chat messages in inbox.jsonl are not covered and stay plaintext.
+func loadOrCreateStorageKey(dir string) ([]byte, error) {
+	path := filepath.Join(dir, storageKeyFile)
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("%s: want 32 bytes, got %d", path, len(key))
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newAtRestWriter writes the header to w and returns a writer that seals
+// everything after it. Close must be called to finish the file.
+func newAtRestWriter(w io.Writer, storageKey []byte) (io.WriteCloser, error) {
+	salt := make([]byte, atRestSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, storageKey, salt, atRestInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(append([]byte(nil), atRestMagic...), salt...)); err != nil {
+		return nil, err
+	}
+	return newSealWriter(w, key)
+}
+
+func newAtRestReader(r io.Reader, storageKey []byte) (io.Reader, error) {
+	header := make([]byte, len(atRestMagic)+atRestSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("not an encrypted chute file")
+	}
+	if !bytes.Equal(header[:len(atRestMagic)], atRestMagic) {
+		return nil, errors.New("not an encrypted chute file")
+	}
+	key, err := hkdf.Key(sha256.New, storageKey, header[len(atRestMagic):], atRestInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newOpenReader(r, key)
+}
+
+// exportPath is where an encrypted download is decrypted to when no
+// destination is given: next to it, without the suffix.
+func exportPath(src string) string {
+	return strings.TrimSuffix(src, encryptedSuffix)
+}
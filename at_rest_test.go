@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// sealBytes seals data under key, written in pieces of step bytes.
+func sealBytes(t *testing.T, key, data []byte, step int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := newSealWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(data) > 0 {
+		n := min(step, len(data))
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func openBytes(key, sealed []byte) ([]byte, error) {
+	r, err := newOpenReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestSealedRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, size := range []int{0, 1, sealChunk - 1, sealChunk, sealChunk + 1, 3*sealChunk + 7} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 31)
+		}
+		for _, step := range []int{1000, sealChunk, 5 * sealChunk} {
+			got, err := openBytes(key, sealBytes(t, key, data, step))
+			if err != nil {
+				t.Fatalf("size %d step %d: %v", size, step, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("size %d step %d: opened %d bytes that differ", size, step, len(got))
+			}
+		}
+	}
+}
+
+func TestSealedRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	data := bytes.Repeat([]byte("c"), sealChunk+100) // two chunks
+	sealed := sealBytes(t, key, data, sealChunk)
+	frame := 5 + sealChunk + 16 // a full first chunk
+
+	tests := []struct {
+		name      string
+		key       []byte
+		sealed    func() []byte
+		truncated bool
+	}{
+		{name: "flipped byte", sealed: func() []byte {
+			b := bytes.Clone(sealed)
+			b[len(b)/2] ^= 1
+			return b
+		}},
+		{name: "final flag cleared", sealed: func() []byte {
+			b := bytes.Clone(sealed)
+			b[frame] = 0
+			return b
+		}},
+		{name: "chunks swapped", sealed: func() []byte {
+			return append(bytes.Clone(sealed[frame:]), sealed[:frame]...)
+		}},
+		{name: "last chunk dropped", truncated: true, sealed: func() []byte {
+			return sealed[:frame]
+		}},
+		{name: "cut mid chunk", truncated: true, sealed: func() []byte {
+			return sealed[:frame+10]
+		}},
+		{name: "empty", truncated: true, sealed: func() []byte { return nil }},
+		{name: "wrong key", key: bytes.Repeat([]byte{8}, 32), sealed: func() []byte { return sealed }},
+	}
+	for _, tt := range tests {
+		k := key
+		if tt.key != nil {
+			k = tt.key
+		}
+		_, err := openBytes(k, tt.sealed())
+		if err == nil {
+			t.Errorf("%s: opened", tt.name)
+			continue
+		}
+		if tt.truncated != errors.Is(err, errSealedTruncated) {
+			t.Errorf("%s: err = %v, truncated should be %t", tt.name, err, tt.truncated)
+		}
+	}
+}
+
+func TestAtRestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	storageKey, err := loadOrCreateStorageKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := loadOrCreateStorageKey(dir)
+	if err != nil || !bytes.Equal(again, storageKey) {
+		t.Fatalf("storage key changed on reload: err=%v", err)
+	}
+
+	data := []byte("received file contents")
+	var file bytes.Buffer
+	w, err := newAtRestWriter(&file, storageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(file.Bytes(), data) {
+		t.Fatal("file holds the plaintext")
+	}
+
+	tests := []struct {
+		name string
+		key  []byte
+		file []byte
+		ok   bool
+	}{
+		{"same key", storageKey, file.Bytes(), true},
+		{"other key", bytes.Repeat([]byte{1}, 32), file.Bytes(), false},
+		{"plain file", storageKey, []byte("just some text, not encrypted at all"), false},
+		{"short file", storageKey, atRestMagic[:4], false},
+	}
+	for _, tt := range tests {
+		var got []byte
+		r, err := newAtRestReader(bytes.NewReader(tt.file), tt.key)
+		if err == nil {
+			got, err = io.ReadAll(r)
+		}
+		if tt.ok && (err != nil || !bytes.Equal(got, data)) {
+			t.Errorf("%s: got %q, err=%v", tt.name, got, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: opened as %q", tt.name, got)
+		}
+	}
+}
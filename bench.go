@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+const (
+	controlBench     = "bench"
+	controlBenchDone = "bench-done"
+	controlPing      = "ping"
+	controlPong      = "pong"
+
+	defaultBenchBytes = 64 << 20
+	benchChunk        = 64 << 10
+)
+
+// BenchResult is the outcome of one Bench run.
+type BenchResult struct {
+	Bytes    int64
+	Duration time.Duration
+	RTT      time.Duration
+}
+
+// Throughput is in bytes per second.
+func (r BenchResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// Benchmark
+//
+// Bench streams size random bytes on a control stream. The peer discards
+// them and answers with a bench-done frame once it has read everything,
+// so the duration covers delivery rather than just local buffering. RTT
+// comes from a ping/pong pair sent beforehand.
+func (s *ChuteSession) Bench(ctx context.Context, size int64) (BenchResult, error) {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return BenchResult{}, ErrNoSession
+	}
+
+	rtt, err := s.ping(ctx, conn)
+	if err != nil {
+		return BenchResult{}, fmt.Errorf("ping: %w", err)
+	}
+
+	token, done := s.addWaiter()
+	defer s.removeWaiter(token)
+
+	start := time.Now()
+	stream, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return BenchResult{}, err
+	}
+	if err := writeLine(stream, controlBench+" "+token); err != nil {
+		stream.CancelWrite(0)
+		return BenchResult{}, err
+	}
+	if _, err := io.CopyBuffer(stream, io.LimitReader(rand.Reader, size), make([]byte, benchChunk)); err != nil {
+		stream.CancelWrite(0)
+		return BenchResult{}, err
+	}
+	if err := stream.Close(); err != nil {
+		return BenchResult{}, err
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return BenchResult{}, ctx.Err()
+	case <-conn.Context().Done():
+		return BenchResult{}, ErrPeerGone
+	}
+	result := BenchResult{Bytes: size, Duration: time.Since(start), RTT: rtt}
+	log.Printf("bench done peer_id=%s bytes=%d duration=%s rtt=%s", s.CurrentPeerID(), size, result.Duration, rtt)
+	return result, nil
+}
+
+func (s *ChuteSession) ping(ctx context.Context, conn quic.Connection) (time.Duration, error) {
+	token, done := s.addWaiter()
+	defer s.removeWaiter(token)
+
+	start := time.Now()
+	if err := writeControl(ctx, conn, controlPing+" "+token); err != nil {
+		return 0, err
+	}
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-conn.Context().Done():
+		return 0, ErrPeerGone
+	}
+}
+
+// drainBench reads a bench payload to the end and reports back.
+func (s *ChuteSession) drainBench(conn quic.Connection, stream quic.ReceiveStream, token string) {
+	_ = stream.SetReadDeadline(time.Time{})
+	n, err := io.Copy(io.Discard, stream)
+	if err != nil {
+		log.Printf("bench receive failed bytes=%d err=%v", n, err)
+		return
+	}
+	log.Printf("bench received bytes=%d", n)
+	ctx, cancel := context.WithTimeout(conn.Context(), goodbyeTimeout)
+	defer cancel()
+	_ = writeControl(ctx, conn, controlBenchDone+" "+token)
+}
+
+func (s *ChuteSession) replyPong(conn quic.Connection, token string) {
+	ctx, cancel := context.WithTimeout(conn.Context(), goodbyeTimeout)
+	defer cancel()
+	_ = writeControl(ctx, conn, controlPong+" "+token)
+}
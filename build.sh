@@ -5,6 +5,11 @@ set -e
 OS=("linux" "darwin" "windows")
 ARCH=("amd64" "arm64")
 
+# version info embedded via ldflags
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+LDFLAGS="-X main.version=$VERSION -X main.commit=$COMMIT"
+
 # create output folder
 mkdir -p bin
 
@@ -13,11 +18,12 @@ for os in "${OS[@]}"; do
     outdir="bin/$os/$arch"
     mkdir -p "$outdir"
 
-    outfile="$outdir/chute"
-    [ "$os" = "windows" ] && outfile="$outfile.exe"
+    ext=""
+    [ "$os" = "windows" ] && ext=".exe"
 
-    echo "Building $os/$arch -> $outfile"
-    CGO_ENABLED=0 GOOS="$os" GOARCH="$arch" go build -o "$outfile" ./
+    echo "Building $os/$arch -> $outdir"
+    CGO_ENABLED=0 GOOS="$os" GOARCH="$arch" go build -ldflags "$LDFLAGS" -o "$outdir/chute$ext" ./
+    CGO_ENABLED=0 GOOS="$os" GOARCH="$arch" go build -o "$outdir/chutectl$ext" ./cmd/chutectl
   done
 done
 
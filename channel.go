@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+const (
+	// channelProto is offered ahead of e2eProto by peers that name the
+	// channel of every stream. It includes the end-to-end layer.
+	channelProto = "chute-quic-channels"
+
+	// Streams that existed before channels keep their behavior under
+	// these reserved names.
+	channelChat   = "chat"
+	channelStream = "stream"
+)
+
+// ErrChannelsUnsupported is returned by OpenChannel when the peer
+// predates channels.
+var ErrChannelsUnsupported = errors.New("peer does not support channels")
+
+// Channel is one named stream to the peer.
+type Channel struct {
+	io.ReadWriteCloser
+	Name string
+}
+
+// Channels
+//
+// A channel is a named QUIC stream, so each one has its own flow control
+// and a slow reader on one never holds up another: a tunnel or a bulk
+// copy does not delay chat. On sessions that negotiated channelProto
+// every bidirectional stream starts with a line naming its channel.
+// Messages travel on "chat" and OpenStream uses "stream", both handled
+// as before; any other name goes to the handler registered for it, or
+// for the part before a colon, so "tunnel" handles "tunnel:8080".
+// Control frames and file payloads already have streams of their own.
+
+// OpenChannel opens a new stream on the named channel.
+func (s *ChuteSession) OpenChannel(ctx context.Context, name string) (*Channel, error) {
+	if err := validateChannelName(name); err != nil {
+		return nil, err
+	}
+	if name == channelChat || name == channelStream {
+		return nil, fmt.Errorf("channel name %q is reserved", name)
+	}
+	s.mu.Lock()
+	if !s.connected || s.conn == nil {
+		s.mu.Unlock()
+		return nil, ErrNoSession
+	}
+	conn := s.conn
+	s.mu.Unlock()
+	if !connUsesChannels(conn) {
+		return nil, ErrChannelsUnsupported
+	}
+	s.touch()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, sendError(conn, err)
+	}
+	if err := writeLine(stream, name); err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return nil, sendError(conn, err)
+	}
+	s.holdIdleOpen(stream)
+	return &Channel{ReadWriteCloser: stream, Name: name}, nil
+}
+
+// SetChannelHandler registers fn to receive the peer's streams on the
+// named channel, or on every channel "name:..." when name has no colon.
+// fn runs on its own goroutine and the stream is closed when it returns.
+func (s *ChuteSession) SetChannelHandler(name string, fn func(peerID string, ch *Channel)) {
+	s.mu.Lock()
+	if s.channelHandlers == nil {
+		s.channelHandlers = make(map[string]func(string, *Channel))
+	}
+	s.channelHandlers[name] = fn
+	s.mu.Unlock()
+}
+
+// readChannelName reads the line naming an incoming stream's channel.
+func readChannelName(stream quic.Stream) (string, error) {
+	_ = stream.SetReadDeadline(time.Now().Add(handshakeIdle))
+	name, err := readLine(stream)
+	_ = stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		return "", err
+	}
+	return name, validateChannelName(name)
+}
+
+// routeChannel reads the name of an incoming stream and hands it to its
+// channel's handler, or to named for chat and plain streams.
+func (s *ChuteSession) routeChannel(conn quic.Connection, stream quic.Stream, named chan<- quic.Stream) {
+	name, err := readChannelName(stream)
+	if err != nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		log.Printf("channel name read failed: %v", err)
+		return
+	}
+	if name != channelChat && name != channelStream {
+		s.acceptChannel(name, stream)
+		return
+	}
+	select {
+	case named <- stream:
+	case <-conn.Context().Done():
+		stream.CancelRead(0)
+		_ = stream.Close()
+	}
+}
+
+// acceptChannel hands an incoming stream to its channel's handler.
+func (s *ChuteSession) acceptChannel(name string, stream quic.Stream) {
+	s.mu.Lock()
+	fn := s.channelHandlers[name]
+	if fn == nil {
+		prefix, _, _ := strings.Cut(name, ":")
+		fn = s.channelHandlers[prefix]
+	}
+	peerID := s.peerID
+	s.mu.Unlock()
+
+	if fn == nil {
+		log.Printf("channel refused peer_id=%s channel=%s", peerID, name)
+		stream.CancelRead(0)
+		_ = stream.Close()
+		return
+	}
+	defer s.beginTransfer()()
+	fn(peerID, &Channel{ReadWriteCloser: stream, Name: name})
+	_ = stream.Close()
+}
+
+// Helpers
+func connUsesChannels(conn quic.Connection) bool {
+	return conn.ConnectionState().TLS.NegotiatedProtocol == channelProto
+}
+
+func validateChannelName(name string) error {
+	if name == "" || len(name) > identityLimit || strings.ContainsAny(name, " \t") || !validLine(name) {
+		return fmt.Errorf("invalid channel name %q", name)
+	}
+	return nil
+}
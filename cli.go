@@ -5,16 +5,35 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	deepLinkScheme = "chute"
+	sendTimeout    = 30 * time.Second
 )
 
 // CLI loop
-func runCLI(ctx context.Context, cancel context.CancelFunc, client *Client, manager *ConnectionManager, clientID, serverAddr string) {
+func runCLI(ctx context.Context, client *Client, manager *ConnectionManager, clientID, serverAddr, startupTarget string) {
 	scanner := bufio.NewScanner(os.Stdin)
 	printHelp()
 	go printReceived(ctx, client)
+	go printEvents(ctx, client)
+	client.OnTransferProgress(printProgress)
+
+	if startupTarget != "" {
+		connectAndGreet(ctx, manager, clientID, startupTarget, "")
+	}
 
 	for {
 		fmt.Print("> ")
@@ -28,29 +47,285 @@ func runCLI(ctx context.Context, cancel context.CancelFunc, client *Client, mana
 
 		switch {
 		case line == "exit":
-			_ = client.Disconnect()
-			if err := client.Unregister(); err != nil {
-				log.Printf("unregister failed: %v", err)
-			}
-			cancel()
 			return
+		case strings.HasPrefix(line, "connect addr "):
+			addr, purpose, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "connect addr ")), " ")
+			if addr == "" {
+				fmt.Println("usage: connect addr <ip:port> [purpose]")
+				continue
+			}
+			session, err := manager.ConnectDirect(ctx, addr, strings.TrimSpace(purpose))
+			if err != nil {
+				log.Printf("connect failed client_id=%s addr=%s err=%v", clientID, addr, err)
+				continue
+			}
+			greet(ctx, session, clientID, session.CurrentPeerID())
+		case line == "connect report":
+			report, ok := manager.LastConnectReport()
+			if !ok {
+				fmt.Println("no connect has finished yet")
+				continue
+			}
+			printConnectReport(report)
 		case strings.HasPrefix(line, "connect "):
-			id, ok := parseConnectID(line)
+			id, purpose, ok := parseConnectCommand(line)
+			if !ok {
+				fmt.Println("usage: connect <id> [purpose]")
+				continue
+			}
+			connectAndGreet(ctx, manager, clientID, id, purpose)
+		case strings.HasPrefix(line, "forget "):
+			id := strings.TrimSpace(strings.TrimPrefix(line, "forget "))
+			forgotten, err := manager.ForgetPeer(id)
+			if err != nil {
+				log.Printf("forget failed target=%s err=%v", id, err)
+				continue
+			}
+			if !forgotten {
+				fmt.Println("no pinned fingerprint for", id)
+				continue
+			}
+			fmt.Println("forgot fingerprint for", id)
+		case line == "bench" || strings.HasPrefix(line, "bench "):
+			id, size, ok := parseBenchCommand(line)
 			if !ok {
-				fmt.Println("usage: connect <id>")
+				fmt.Println("usage: bench <id> [megabytes]")
 				continue
 			}
-			session, err := manager.Connect(id)
+			runBench(ctx, client, manager, clientID, id, size)
+		case strings.HasPrefix(line, "ls "):
+			id, dir, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "ls ")), " ")
+			list, err := client.RemoteFiles(ctx, id, strings.TrimSpace(dir))
 			if err != nil {
-				log.Printf("connect failed client_id=%s target=%s err=%v", clientID, id, err)
+				fmt.Println("ls failed:", err)
+				continue
+			}
+			printSharedEntries(list)
+		case strings.HasPrefix(line, "pull "):
+			id, name, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "pull ")), " ")
+			if strings.TrimSpace(name) == "" {
+				fmt.Println("usage: pull <id> <path>")
 				continue
 			}
-			message := fmt.Sprintf("hello from %s\n", clientID)
-			if err := session.Send([]byte(message)); err != nil {
-				log.Printf("connect hello failed client_id=%s target=%s err=%v", clientID, id, err)
+			entry, err := client.Pull(ctx, id, strings.TrimSpace(name))
+			if err != nil {
+				fmt.Println("pull failed:", err)
 				continue
 			}
-			log.Printf("connect ok client_id=%s target=%s", clientID, id)
+			fmt.Printf("pulling %s (%d bytes)...\n", entry.Name, entry.Size)
+		case strings.HasPrefix(line, "caps "):
+			id := strings.TrimSpace(strings.TrimPrefix(line, "caps "))
+			if id == "" {
+				fmt.Println("usage: caps <id>")
+				continue
+			}
+			runCaps(ctx, client, manager, clientID, id)
+		case strings.HasPrefix(line, "sendfile "):
+			protect := strings.HasPrefix(line, "sendfile -p ")
+			id, path, ok := parseSendFileCommand(strings.Replace(line, "sendfile -p ", "sendfile ", 1))
+			if !ok {
+				fmt.Println("usage: sendfile [-p] <id> <path>")
+				continue
+			}
+			passphrase := ""
+			if protect {
+				if passphrase, ok = promptPassphrase(scanner, "passphrase: "); !ok || passphrase == "" {
+					fmt.Println("no passphrase given")
+					continue
+				}
+			}
+			sendFile(ctx, client, manager, clientID, id, path, passphrase)
+		case line == "recv" || strings.HasPrefix(line, "recv "):
+			id := strings.TrimSpace(strings.TrimPrefix(line, "recv"))
+			offer, ok, err := client.AcceptFile(id, "")
+			if errors.Is(err, ErrPassphraseRequired) {
+				passphrase, _ := promptPassphrase(scanner, fmt.Sprintf("passphrase for %s: ", offer.Name))
+				offer, ok, err = client.AcceptFile(offer.PeerID, passphrase)
+			}
+			if !ok {
+				fmt.Println("no pending file")
+				continue
+			}
+			if err != nil {
+				fmt.Println("recv failed:", err)
+				continue
+			}
+			fmt.Printf("receiving %s from %s\n", offer.Name, offer.PeerID)
+		case line == "usage reset" || strings.HasPrefix(line, "usage reset "):
+			id := strings.TrimSpace(strings.TrimPrefix(line, "usage reset"))
+			if err := client.ResetUsage(id); err != nil {
+				fmt.Println("reset failed:", err)
+				continue
+			}
+			fmt.Println("usage counters reset")
+		case line == "peers":
+			printPeers(client.Peers())
+		case strings.HasPrefix(line, "find "):
+			results, err := client.SearchDirectory(ctx, strings.TrimPrefix(line, "find "))
+			if err != nil {
+				fmt.Println("find failed:", err)
+				continue
+			}
+			printDirectoryResults(results)
+		case line == "shares":
+			printShares(client.Shares())
+		case strings.HasPrefix(line, "share "):
+			runShareCommand(client, strings.Fields(strings.TrimPrefix(line, "share ")))
+		case strings.HasPrefix(line, "peer "):
+			id, rest, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "peer ")), " ")
+			if rest = strings.TrimSpace(rest); rest == "" {
+				settings, err := client.PeerSettings(id)
+				if err != nil {
+					fmt.Println("peer settings failed:", err)
+					continue
+				}
+				printPeerSettings(settings)
+				continue
+			}
+			if !strings.HasPrefix(rest, "set ") {
+				fmt.Println("usage: peer <id> [set <key> [value]]")
+				continue
+			}
+			key, value, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(rest, "set ")), " ")
+			if _, err := client.UpdatePeerSetting(id, key, strings.TrimSpace(value)); err != nil {
+				fmt.Println("set failed:", err)
+				continue
+			}
+			fmt.Println("saved")
+		case line == "inbox" || strings.HasPrefix(line, "inbox "):
+			count := 20
+			if arg := strings.TrimSpace(strings.TrimPrefix(line, "inbox")); arg != "" {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n <= 0 {
+					fmt.Println("usage: inbox [count]")
+					continue
+				}
+				count = n
+			}
+			printInbox(client, count)
+		case line == "logs" || strings.HasPrefix(line, "logs "):
+			count := 50
+			if arg := strings.TrimSpace(strings.TrimPrefix(line, "logs")); arg != "" {
+				n, err := strconv.Atoi(arg)
+				if err != nil || n <= 0 {
+					fmt.Println("usage: logs [count]")
+					continue
+				}
+				count = n
+			}
+			for _, l := range recentLogs.last(count) {
+				fmt.Println(l)
+			}
+		case strings.HasPrefix(line, "export "):
+			fields := strings.Fields(strings.TrimPrefix(line, "export "))
+			if len(fields) < 1 || len(fields) > 2 {
+				fmt.Println("usage: export <file> [dest]")
+				continue
+			}
+			dest := ""
+			if len(fields) == 2 {
+				dest = fields[1]
+			}
+			path, err := client.ExportFile(fields[0], dest)
+			if err != nil {
+				fmt.Println("export failed:", err)
+				continue
+			}
+			fmt.Println("decrypted to", path)
+		case line == "drop" || strings.HasPrefix(line, "drop "):
+			var ttl time.Duration
+			if arg := strings.TrimSpace(strings.TrimPrefix(line, "drop")); arg != "" {
+				d, err := time.ParseDuration(arg)
+				if err != nil {
+					fmt.Println("usage: drop [lifetime, e.g. 30m]")
+					continue
+				}
+				ttl = d
+			}
+			drop, err := client.CreateDrop(ctx, ttl)
+			if err != nil {
+				fmt.Println("drop failed:", err)
+				continue
+			}
+			fmt.Printf("drop code: %s\n  link: %s\n  valid until %s, for one file\n", drop.Code, drop.Link, drop.Expires.Local().Format("15:04"))
+		case line == "drops":
+			printDrops(client.Drops())
+		case line == "lan":
+			printLANPeers(manager)
+		case line == "offer":
+			offer, err := manager.CreateOffer(ctx)
+			if err != nil {
+				fmt.Println("offer failed:", err)
+				continue
+			}
+			fmt.Printf("send this offer to your peer, then paste their answer with: paste <answer>\n%s\n", offer)
+		case strings.HasPrefix(line, "paste "):
+			answer, session, err := manager.Paste(ctx, strings.TrimPrefix(line, "paste "))
+			switch {
+			case err != nil:
+				fmt.Println("paste failed:", err)
+			case session != nil:
+				fmt.Printf("connected to %s\n", session.CurrentPeerID())
+			default:
+				fmt.Printf("send this answer back; connecting once it is pasted (up to %s)\n%s\n", offerTimeout, answer)
+			}
+		case line == "history":
+			printHistory(client)
+		case line == "settings":
+			printSettings(client)
+		case line == "reload":
+			if err := client.ReloadSettings(); err != nil {
+				fmt.Println("reload failed:", err)
+				continue
+			}
+			fmt.Println("settings reloaded")
+		case strings.HasPrefix(line, "set "):
+			key, value, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, "set ")), " ")
+			restart, err := client.UpdateSetting(key, strings.TrimSpace(value))
+			if err != nil {
+				fmt.Println("set failed:", err)
+				continue
+			}
+			if restart {
+				fmt.Println("saved; takes effect after restart")
+				continue
+			}
+			fmt.Println("saved")
+		case line == "version":
+			fmt.Println(versionString())
+		case line == "status":
+			printStatus(client.Status())
+		case line == "loglevel" || strings.HasPrefix(line, "loglevel "):
+			fields := strings.Fields(line)
+			if len(fields) > 1 {
+				if err := setLogLevel(fields[1], fields[2:]); err != nil {
+					fmt.Println("loglevel failed:", err)
+					continue
+				}
+			}
+			printLogLevels()
+		case line == "stun":
+			printSTUNResults(probeSTUNServers(ctx, stunServerAddrs()))
+		case line == "pending":
+			printPending(client.Pending())
+		case line == "accept" || strings.HasPrefix(line, "accept "):
+			id := strings.TrimSpace(strings.TrimPrefix(line, "accept"))
+			if _, err := client.Accept(ctx, manager, id); err != nil {
+				log.Printf("accept failed client_id=%s target=%s err=%v", clientID, id, err)
+				continue
+			}
+			log.Printf("accept ok client_id=%s", clientID)
+		case line == "decline" || strings.HasPrefix(line, "decline "):
+			id, reason := parseDeclineCommand(line, client.HasPending)
+			declined, err := client.Decline(ctx, manager, id, reason)
+			if declined == "" {
+				fmt.Println("no pending request")
+				continue
+			}
+			if err != nil {
+				log.Printf("decline notify failed client_id=%s target=%s err=%v", clientID, declined, err)
+			}
+			log.Printf("declined request from %s", declined)
 		case strings.HasPrefix(line, "send "):
 			message, ok := parseSendCommand(line)
 			if !ok {
@@ -58,36 +333,240 @@ func runCLI(ctx context.Context, cancel context.CancelFunc, client *Client, mana
 				continue
 			}
 			if !client.IsConnected() {
-				log.Printf("send denied client_id=%s err=%v", clientID, errors.New("no active session"))
+				log.Printf("send denied client_id=%s err=%v", clientID, ErrNoSession)
 				continue
 			}
-			if err := client.SendMessage("", []byte(message)); err != nil {
+			sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+			state, err := client.SendContext(sendCtx, []byte(message))
+			cancel()
+			if err != nil {
 				log.Printf("send failed client_id=%s err=%v", clientID, err)
 				continue
 			}
-			log.Printf("send ok client_id=%s", clientID)
+			log.Printf("send ok client_id=%s delivery=%s", clientID, state)
 		default:
 			printHelp()
 		}
 	}
 }
 
+// Commands
+func connectAndGreet(ctx context.Context, manager *ConnectionManager, clientID, id, purpose string) {
+	session, err := manager.Connect(ctx, id, purpose)
+	if err != nil {
+		log.Printf("connect failed client_id=%s target=%s err=%v", clientID, id, err)
+		return
+	}
+	greet(ctx, session, clientID, id)
+}
+
+func greet(ctx context.Context, session *ChuteSession, clientID, id string) {
+	message := fmt.Sprintf("hello from %s\n", clientID)
+	if err := session.SendContext(ctx, []byte(message)); err != nil {
+		log.Printf("connect hello failed client_id=%s target=%s err=%v", clientID, id, err)
+		return
+	}
+	log.Printf("connect ok client_id=%s target=%s", clientID, id)
+}
+
+func sendFile(ctx context.Context, client *Client, manager *ConnectionManager, clientID, id, path, passphrase string) {
+	session := client.getSession()
+	if session == nil || !session.IsConnectedTo(id) {
+		if _, err := manager.Connect(ctx, id, "wants to send you "+filepath.Base(path)); err != nil {
+			log.Printf("sendfile connect failed client_id=%s target=%s err=%v", clientID, id, err)
+			return
+		}
+	}
+	fmt.Printf("waiting for %s to accept %s...\n", id, filepath.Base(path))
+	if err := client.SendFile(ctx, id, path, passphrase); err != nil {
+		log.Printf("sendfile failed client_id=%s target=%s err=%v", clientID, id, err)
+		return
+	}
+	log.Printf("sendfile ok client_id=%s target=%s", clientID, id)
+}
+
+func runBench(ctx context.Context, client *Client, manager *ConnectionManager, clientID, id string, size int64) {
+	session := client.getSession()
+	if session == nil || !session.IsConnectedTo(id) {
+		var err error
+		session, err = manager.Connect(ctx, id, "bench")
+		if err != nil {
+			log.Printf("bench connect failed client_id=%s target=%s err=%v", clientID, id, err)
+			return
+		}
+	}
+	fmt.Printf("sending %d MB to %s...\n", size>>20, id)
+	result, err := session.Bench(ctx, size)
+	if err != nil {
+		log.Printf("bench failed client_id=%s target=%s err=%v", clientID, id, err)
+		return
+	}
+	fmt.Printf("  %d MB in %s\n", result.Bytes>>20, result.Duration.Round(time.Millisecond))
+	fmt.Printf("  throughput: %.1f Mbit/s\n", result.Throughput()*8/1e6)
+	fmt.Printf("  rtt: %s\n", result.RTT.Round(100*time.Microsecond))
+}
+
+func runCaps(ctx context.Context, client *Client, manager *ConnectionManager, clientID, id string) {
+	session := client.getSession()
+	if session == nil || !session.IsConnectedTo(id) {
+		var err error
+		session, err = manager.Connect(ctx, id, "capabilities")
+		if err != nil {
+			log.Printf("caps connect failed client_id=%s target=%s err=%v", clientID, id, err)
+			return
+		}
+	}
+	caps, err := session.PeerCapabilities(ctx)
+	if err != nil {
+		log.Printf("caps failed client_id=%s target=%s err=%v", clientID, id, err)
+		return
+	}
+	fmt.Printf("  version: %s\n", caps.Version)
+	fmt.Printf("  end-to-end: %t\n", caps.E2E)
+	fmt.Printf("  channels: %t\n", caps.Channels)
+	fmt.Printf("  methods: %s\n", strings.Join(caps.Methods, ", "))
+}
+
 // Help & parsing
 func printHelp() {
 	fmt.Println("commands:")
-	fmt.Println("  connect <id>")
+	fmt.Println("  connect <id|chute://connect/id> [purpose]")
+	fmt.Println("  connect addr <ip:port> [purpose]")
+	fmt.Println("  connect report")
+	fmt.Println("  pending")
+	fmt.Println("  accept [id]")
+	fmt.Println("  decline [id] [reason]")
 	fmt.Println("  send <message>")
+	fmt.Println("  sendfile [-p] <id> <path>  (-p asks for a passphrase)")
+	fmt.Println("  recv [id]")
+	fmt.Println("  forget <id>")
+	fmt.Println("  bench <id> [megabytes]")
+	fmt.Println("  caps <id>")
+	fmt.Println("  find <name>")
+	fmt.Println("  shares")
+	fmt.Println("  share add <name> <path> | remove <name> | grant <name> <id> | revoke <name> <id>")
+	fmt.Println("  ls <id> [share/path]")
+	fmt.Println("  pull <id> <path>")
+	fmt.Println("  status")
+	fmt.Println("  version")
+	fmt.Println("  peers")
+	fmt.Println("  peer <id> [set <key> [value]]")
+	fmt.Println("  usage reset [id]")
+	fmt.Println("  inbox [count]")
+	fmt.Println("  drop [lifetime]")
+	fmt.Println("  drops")
+	fmt.Println("  lan")
+	fmt.Println("  offer")
+	fmt.Println("  paste <offer|answer>")
+	fmt.Println("  export <file> [dest]")
+	fmt.Println("  history")
+	fmt.Println("  settings")
+	fmt.Println("  set <key> [value]")
+	fmt.Println("  reload")
+	fmt.Println("  stun")
+	fmt.Println("  loglevel [debug|info] [subsystem...]")
+	fmt.Println("  logs [count]")
 	fmt.Println("  exit")
 }
 
-func parseConnectID(line string) (string, bool) {
-	id := strings.TrimSpace(strings.TrimPrefix(line, "connect "))
+func parseConnectCommand(line string) (string, string, bool) {
+	fields := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(line, "connect ")), " ", 2)
+	id := fields[0]
 	if id == "" {
+		return "", "", false
+	}
+	var purpose string
+	if len(fields) == 2 {
+		purpose = strings.TrimSpace(fields[1])
+	}
+	if strings.HasPrefix(id, deepLinkScheme+"://") {
+		id, ok := parseDeepLink(id)
+		return id, purpose, ok
+	}
+	return id, purpose, true
+}
+
+// parseDeepLink extracts the target id from a chute://connect/<id> link.
+func parseDeepLink(link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != deepLinkScheme || u.Host != "connect" {
+		return "", false
+	}
+	id := strings.ReplaceAll(strings.Trim(u.Path, "/"), " ", "")
+	if id == "" || strings.Contains(id, "/") {
 		return "", false
 	}
 	return id, true
 }
 
+// parseDeclineCommand splits "decline [id] [reason]". The first word is
+// only taken as the id when it names a pending requester.
+func parseDeclineCommand(line string, isPending func(string) bool) (string, string) {
+	rest := strings.TrimSpace(strings.TrimPrefix(line, "decline"))
+	fields := strings.SplitN(rest, " ", 2)
+	if fields[0] != "" && isPending(fields[0]) {
+		if len(fields) == 2 {
+			return fields[0], strings.TrimSpace(fields[1])
+		}
+		return fields[0], ""
+	}
+	return "", rest
+}
+
+func parseBenchCommand(line string) (string, int64, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return "", 0, false
+	}
+	size := int64(defaultBenchBytes)
+	if len(fields) == 3 {
+		mb, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || mb <= 0 {
+			return "", 0, false
+		}
+		size = mb << 20
+	}
+	return fields[1], size, true
+}
+
+// promptLine asks for one more line of input, for values that do not
+// belong in the command itself.
+func promptLine(scanner *bufio.Scanner, prompt string) (string, bool) {
+	fmt.Print(prompt)
+	if !scanner.Scan() {
+		return "", false
+	}
+	return strings.TrimSpace(scanner.Text()), true
+}
+
+// promptPassphrase is promptLine without echo when stdin is a terminal,
+// so the passphrase stays off the screen and out of the scrollback.
+func promptPassphrase(scanner *bufio.Scanner, prompt string) (string, bool) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return promptLine(scanner, prompt)
+	}
+	fmt.Print(prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(passphrase)), true
+}
+
+// parseSendFileCommand splits "sendfile <id> <path>"; the path may contain
+// spaces.
+func parseSendFileCommand(line string) (string, string, bool) {
+	rest := strings.TrimSpace(strings.TrimPrefix(line, "sendfile "))
+	id, path, ok := strings.Cut(rest, " ")
+	path = strings.TrimSpace(path)
+	if !ok || id == "" || path == "" {
+		return "", "", false
+	}
+	return id, path, true
+}
+
 func parseSendCommand(line string) (string, bool) {
 	parts := strings.SplitN(line, " ", 2)
 	if len(parts) < 2 {
@@ -101,6 +580,428 @@ func parseSendCommand(line string) (string, bool) {
 }
 
 // Output
+func printPeers(peers []PeerInfo) {
+	if len(peers) == 0 {
+		fmt.Println("no known peers")
+		return
+	}
+	for _, p := range peers {
+		state := ""
+		switch {
+		case p.Connected:
+			state = " (connected)"
+		case p.Presence != "":
+			state = " (" + p.Presence + ")"
+		}
+		fmt.Printf("  %s%s\n", p.ID, state)
+		if p.Fingerprint != "" {
+			fmt.Printf("    %s\n", p.Fingerprint)
+		}
+		fmt.Printf("    sent %s, received %s\n", formatBytes(p.Usage.Sent), formatBytes(p.Usage.Received))
+		connected, registered := "never", "never"
+		if !p.LastSeen.Connected.IsZero() {
+			connected = formatAgo(p.LastSeen.Connected)
+		}
+		if !p.LastSeen.Registered.IsZero() {
+			registered = formatAgo(p.LastSeen.Registered)
+		}
+		fmt.Printf("    last connected %s, last seen registered %s\n", connected, registered)
+	}
+}
+
+func printDrops(drops []Drop) {
+	if len(drops) == 0 {
+		fmt.Println("no open drops")
+		return
+	}
+	for _, d := range drops {
+		fmt.Printf("  %s until %s\n", d.Code, d.Expires.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+func printLANPeers(manager *ConnectionManager) {
+	if !manager.LANOnly() {
+		fmt.Println("not in LAN-only mode")
+		return
+	}
+	peers := manager.LANPeers()
+	if len(peers) == 0 {
+		fmt.Println("no peers found on the local network yet")
+		return
+	}
+	for _, p := range peers {
+		name := ""
+		if p.DisplayName != "" {
+			name = " (" + p.DisplayName + ")"
+		}
+		fmt.Printf("  %s%s at %s\n", p.ID, name, p.Addr)
+	}
+}
+
+func printInbox(client *Client, count int) {
+	var after uint64
+	if last := client.LastReceivedSeq(); last > uint64(count) {
+		after = last - uint64(count)
+	}
+	messages := client.ReceivedMessages(context.Background(), after, count, false)
+	if len(messages) == 0 {
+		fmt.Println("no messages yet")
+		return
+	}
+	for _, msg := range messages {
+		fmt.Printf("  %s %s: %s\n", msg.Time.Local().Format("2006-01-02 15:04"), msg.PeerID, strings.TrimSpace(msg.Text))
+	}
+}
+
+func printHistory(client *Client) {
+	records, err := client.TransferHistory()
+	if err != nil {
+		fmt.Println("load history failed:", err)
+		return
+	}
+	if len(records) == 0 {
+		fmt.Println("no transfers yet")
+		return
+	}
+	for _, rec := range records {
+		arrow := "<-"
+		if rec.Direction == directionOutgoing {
+			arrow = "->"
+		}
+		line := fmt.Sprintf("  %s %s %s %s (%d bytes, %s) %s", rec.Finished.Format("2006-01-02 15:04"), arrow, rec.PeerID, rec.Name, rec.Bytes, rec.Duration.Round(time.Second), rec.Status)
+		if rec.Error != "" {
+			line += ": " + rec.Error
+		}
+		fmt.Println(line)
+	}
+}
+
+func printSettings(client *Client) {
+	settings, err := client.Settings()
+	if err != nil {
+		fmt.Println("load settings failed:", err)
+		return
+	}
+	for _, key := range settingKeys {
+		value := settings.get(key)
+		if value == "" {
+			value = "(default)"
+		}
+		fmt.Printf("  %s: %s\n", key, value)
+	}
+}
+
+func printPeerSettings(settings PeerSettings) {
+	for _, key := range peerSettingKeys {
+		value := settings.get(key)
+		if value == "" {
+			value = "(global)"
+		}
+		fmt.Printf("  %s: %s\n", key, value)
+	}
+}
+
+// runShareCommand handles "share add|remove|grant|revoke ...".
+func runShareCommand(client *Client, fields []string) {
+	usage := "usage: share add <name> <path> | remove <name> | grant <name> <id> | revoke <name> <id>"
+	if len(fields) < 2 {
+		fmt.Println(usage)
+		return
+	}
+	var err error
+	switch {
+	case fields[0] == "add" && len(fields) >= 3:
+		_, err = client.AddShare(fields[1], strings.Join(fields[2:], " "))
+	case fields[0] == "remove" && len(fields) == 2:
+		err = client.RemoveShare(fields[1])
+	case fields[0] == "grant" && len(fields) == 3:
+		_, err = client.GrantShare(fields[1], fields[2])
+	case fields[0] == "revoke" && len(fields) == 3:
+		_, err = client.RevokeShare(fields[1], fields[2])
+	default:
+		fmt.Println(usage)
+		return
+	}
+	if err != nil {
+		fmt.Println("share failed:", err)
+		return
+	}
+	fmt.Println("saved")
+}
+
+func printDirectoryResults(results []DirectoryEntry) {
+	if len(results) == 0 {
+		fmt.Println("  no one found")
+		return
+	}
+	for _, r := range results {
+		fmt.Printf("  %s  %s\n", formatClientID(r.ID), r.DisplayName)
+	}
+}
+
+func printShares(shares []Share) {
+	if len(shares) == 0 {
+		fmt.Println("  (nothing shared)")
+		return
+	}
+	for _, s := range shares {
+		peers := make([]string, 0, len(s.Grants))
+		for _, g := range s.Grants {
+			peers = append(peers, g.PeerID)
+		}
+		access := strings.Join(peers, ", ")
+		if access == "" {
+			access = "nobody"
+		}
+		fmt.Printf("  %s  %s  (read-only for %s)\n", s.Name, s.Path, access)
+	}
+}
+
+func printSharedEntries(list []SharedEntry) {
+	if len(list) == 0 {
+		fmt.Println("  (empty)")
+		return
+	}
+	for _, e := range list {
+		if e.Dir {
+			fmt.Printf("  %s/\n", e.Name)
+			continue
+		}
+		fmt.Printf("  %s  %d bytes  %s\n", e.Name, e.Size, e.Modified.Format("2006-01-02 15:04"))
+	}
+}
+
+func printPinWarning(w io.Writer, mismatch *pinMismatchError) {
+	fmt.Fprintln(w, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintln(w, "@  WARNING: PEER IDENTITY HAS CHANGED                     @")
+	fmt.Fprintln(w, "@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Fprintf(w, "Peer %s presented fingerprint\n  %s\n", mismatch.PeerID, mismatch.Presented)
+	fmt.Fprintf(w, "but was pinned to\n  %s\n", mismatch.Pinned)
+	fmt.Fprintln(w, "Someone may be impersonating this peer. The session was blocked.")
+	fmt.Fprintf(w, "If the peer reinstalled, run \"forget %s\" and reconnect.\n", mismatch.PeerID)
+}
+
+func printStatus(status ClientStatus) {
+	fmt.Printf("  version: %s (%s)\n", status.Version, status.Commit)
+	fmt.Printf("  client id: %s\n", formatClientID(status.ClientID))
+	if !status.GuestUntil.IsZero() {
+		fmt.Printf("  guest id until: %s\n", status.GuestUntil.Local().Format("15:04:05"))
+	}
+	fmt.Printf("  fingerprint: %s\n", status.Fingerprint)
+	if status.Connected {
+		fmt.Printf("  connected to: %s\n", status.PeerID)
+		fmt.Printf("  peer fingerprint: %s\n", status.PeerFingerprint)
+		if status.PeerVersion != "" {
+			fmt.Printf("  peer version: %s\n", status.PeerVersion)
+		}
+		if status.PeerE2E {
+			fmt.Println("  end-to-end encrypted: yes")
+		} else {
+			fmt.Println("  end-to-end encrypted: no, peer predates it")
+		}
+		if status.PeerUnresponsive {
+			fmt.Println("  peer not responding")
+		} else if status.PeerRTT > 0 {
+			fmt.Printf("  round trip: %s\n", status.PeerRTT.Round(time.Millisecond))
+		}
+		fmt.Printf("  idle timeout in: %s\n", status.IdleRemaining.Round(time.Second))
+	} else {
+		fmt.Println("  not connected")
+	}
+	for _, loop := range status.Loops {
+		if !loop.Running {
+			fmt.Printf("  %s restarting after: %s\n", loop.Name, loop.LastError)
+		} else if loop.Restarts > 0 {
+			fmt.Printf("  %s restarted %d times, last: %s\n", loop.Name, loop.Restarts, loop.LastError)
+		}
+	}
+	rendezvous := "reachable"
+	switch {
+	case status.LANOnly:
+		rendezvous = "not used, LAN only"
+	case !status.RendezvousHealthy:
+		rendezvous = "unreachable"
+	}
+	fmt.Printf("  rendezvous: %s\n", rendezvous)
+	if status.Offline {
+		fmt.Println("  offline: client id not registered yet, retrying")
+	}
+	if status.IDTaken {
+		fmt.Println("  client id claimed by another key, restart to get a new one")
+	}
+	if status.DirectoryListed {
+		fmt.Println("  listed in the public directory")
+	}
+	fmt.Printf("  traffic: sent %s, received %s\n", formatBytes(status.Usage.Sent), formatBytes(status.Usage.Received))
+	fmt.Printf("  pending requests: %d\n", status.Pending)
+}
+
+func printLogLevels() {
+	levels := verboseLevels()
+	for _, name := range logSubsystems {
+		level := "info"
+		if levels[name] {
+			level = "debug"
+		}
+		fmt.Printf("  %s: %s\n", name, level)
+	}
+}
+
+func printSTUNResults(results []STUNResult) {
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Printf("  %s failed: %v\n", r.Server, r.Err)
+			continue
+		}
+		fmt.Printf("  %s ok mapped=%s rtt=%s\n", r.Server, r.Mapped, r.RTT.Round(time.Millisecond))
+	}
+}
+
+func printConnectReport(r ConnectReport) {
+	outcome := "connected"
+	if r.Err != "" {
+		outcome = "failed: " + r.Err
+	}
+	fmt.Printf("connect to %s %s after %s\n", r.PeerID, outcome, r.Duration.Round(time.Millisecond))
+	fmt.Printf("  methods: %s\n", strings.Join(r.Methods, ", "))
+	for _, s := range r.Steps {
+		if s.Err != "" {
+			fmt.Printf("  %-20s %s (%s)\n", s.State, s.Duration.Round(time.Millisecond), s.Err)
+			continue
+		}
+		fmt.Printf("  %-20s %s\n", s.State, s.Duration.Round(time.Millisecond))
+	}
+	if r.LocalCandidates != nil || r.RemoteCandidates != nil {
+		fmt.Printf("  candidates: local %s, remote %s\n", formatCounts(r.LocalCandidates), formatCounts(r.RemoteCandidates))
+	}
+	if r.SelectedPair != "" {
+		fmt.Printf("  selected pair: %s\n", r.SelectedPair)
+	}
+	if r.Path != "" {
+		fmt.Printf("  path: %s\n", r.Path)
+	}
+}
+
+func formatCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", k, counts[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+func printPending(pending []IntentInfo) {
+	if len(pending) == 0 {
+		fmt.Println("no pending requests")
+		return
+	}
+	for _, intent := range pending {
+		fmt.Printf("  %s (expires in %s)\n", describeIntent(intent), time.Until(intent.Expires).Round(time.Second))
+	}
+}
+
+func printEvents(ctx context.Context, client *Client) {
+	events, unsubscribe := client.Events()
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			if e.PeerID != "" && !client.Notifies(e.PeerID) {
+				continue
+			}
+			if text := describeEvent(e); text != "" {
+				fmt.Printf("\n%s\n> ", text)
+			}
+		}
+	}
+}
+
+func describeEvent(e Event) string {
+	switch e.Kind {
+	case EventConnected:
+		return "connected to " + e.PeerID
+	case EventDisconnected:
+		return "disconnected from " + e.PeerID
+	case EventPeerUnresponsive:
+		return e.PeerID + " is not responding"
+	case EventPeerResponsive:
+		return e.PeerID + " is responding again"
+	case EventIdleWarning:
+		return fmt.Sprintf("session with %s closes in %s unless it is used", e.PeerID, e.Detail)
+	case EventConnectProgress:
+		switch ConnectState(e.Detail) {
+		case ConnectConnected:
+			// The connected event already said so.
+			return ""
+		case ConnectFailed:
+			return fmt.Sprintf("connect to %s failed: %v", e.PeerID, e.Err)
+		}
+		return fmt.Sprintf("connecting to %s: %s", e.PeerID, strings.ReplaceAll(e.Detail, "-", " "))
+	case EventFileOffered:
+		return e.PeerID + " wants to send " + e.Detail + ", type recv to accept"
+	case EventIntentReceived:
+		return "incoming request from " + e.Detail + ", type accept or decline"
+	case EventIntentExpired:
+		return "request from " + e.Detail + " expired"
+	case EventTransferFinished:
+		// Progress lines already report completion.
+		if e.Err != nil {
+			return fmt.Sprintf("transfer of %s failed: %v", e.Detail, e.Err)
+		}
+	case EventRendezvousHealth:
+		switch e.Detail {
+		case "down":
+			return "rendezvous server unreachable"
+		case "registered":
+			return "registered with rendezvous server, no longer offline"
+		}
+		return "rendezvous server reachable again"
+	case EventIDTaken:
+		return "client id " + e.Detail + " is now claimed by another key; restart to get a new id"
+	}
+	return ""
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// printProgress redraws one status line per transfer in place.
+func printProgress(p TransferProgress) {
+	if p.Done {
+		status := "done"
+		if p.Err != nil {
+			status = "failed"
+		}
+		fmt.Printf("\r  %s: %d bytes, %s\033[K\n", p.Name, p.Bytes, status)
+		return
+	}
+	if p.Total > 0 {
+		fmt.Printf("\r  %s: %d%% (%d/%d MB)\033[K", p.Name, p.Bytes*100/p.Total, p.Bytes>>20, p.Total>>20)
+		return
+	}
+	fmt.Printf("\r  %s: %d MB\033[K", p.Name, p.Bytes>>20)
+}
+
 func printReceived(ctx context.Context, client *Client) {
 	for {
 		select {
@@ -111,6 +1012,9 @@ func printReceived(ctx context.Context, client *Client) {
 				return
 			}
 			fmt.Printf("\nreceived: %s\n> ", strings.TrimSpace(string(msg)))
+			if err := client.MarkRead(ctx); err != nil {
+				log.Printf("read receipt failed err=%v", err)
+			}
 		}
 	}
 }
@@ -1,21 +1,147 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
 
 type Client struct {
-	clientID   string
-	serverAddr string
-	receive    chan []byte
+	clientID     string
+	serverAddr   string
+	receive      chan []byte
+	configDir    string
+	identity     ed25519.PrivateKey
+	pins         *pinStore
+	peerSettings *peerSettingsStore
+	usage        *usageStore
+	lastSeen     *lastSeenStore
+	spool        *messageSpool
+
+	// settingsMu guards the settings a reload can change while transfers
+	// read them.
+	settingsMu  sync.Mutex
+	downloadDir string
+	storageKey  []byte
+
+	filesMu sync.Mutex
+	files   []*pendingFile
+
+	shares  *shareStore
+	pullsMu sync.Mutex
+	pulls   map[string]time.Time
 
 	sessionMu sync.RWMutex
 	session   *ChuteSession
+
+	pendingMu  sync.Mutex
+	pending    []pendingIntent
+	expired    map[string]time.Time
+	autoAccept bool
+	acceptFrom map[string]bool
+
+	rendezvousMu   sync.Mutex
+	rendezvousDown bool
+	offline        bool
+	idTaken        bool
+
+	dropsMu   sync.Mutex
+	drops     []Drop
+	usedDrops map[string]bool
+
+	sentMu sync.Mutex
+	sent   []SentMessage
+	nextID uint64
+
+	attemptsMu sync.Mutex
+	attempts   map[string]*ConnectAttempt
+
+	directoryMu   sync.Mutex
+	displayName   string
+	listed        bool
+	published     bool
+	directoryKick chan struct{}
+
+	presenceMu        sync.Mutex
+	lastActive        time.Time
+	presence          map[string]string
+	presencePublished bool
+
+	readReceipts bool
+	guestUntil   time.Time
+	lanOnly      bool
+
+	events *eventBus
+
+	callbackMu         sync.Mutex
+	onMessage          func(peerID string, payload []byte)
+	onConnected        func(peerID string)
+	onDisconnected     func(peerID string)
+	onUnresponsive     func(peerID string)
+	onTransferProgress func(TransferProgress)
+}
+
+// PeerInfo describes a peer this client has talked to before.
+type PeerInfo struct {
+	ID          string
+	Fingerprint string
+	Connected   bool
+	Usage       PeerUsage
+	Settings    PeerSettings
+	Presence    string
+	LastSeen    LastSeen
+}
+
+// ClientStatus is a point-in-time snapshot for display.
+type ClientStatus struct {
+	Version           string
+	Commit            string
+	ClientID          string
+	GuestUntil        time.Time
+	Fingerprint       string
+	Connected         bool
+	PeerID            string
+	PeerFingerprint   string
+	PeerVersion       string
+	PeerE2E           bool
+	PeerRTT           time.Duration
+	PeerUnresponsive  bool
+	IdleRemaining     time.Duration
+	Loops             []LoopHealth
+	Usage             PeerUsage
+	RendezvousHealthy bool
+	LANOnly           bool
+	Offline           bool
+	IDTaken           bool
+	DirectoryListed   bool
+	Pending           int
+}
+
+// ErrIntentExpired is returned when accepting or declining a request
+// whose sender has stopped waiting.
+var ErrIntentExpired = errors.New("request expired")
+
+// expiredIntentMemory is how long an expired request is remembered, so
+// answering it says it expired rather than that there is none.
+const expiredIntentMemory = 5 * time.Minute
+
+// pendingLimit caps how many requests wait for the user at once.
+const pendingLimit = 32
+
+// pendingIntent is an incoming connection request waiting for the user.
+type pendingIntent struct {
+	info    IntentInfo
+	expires time.Time
 }
 
 // Construction
@@ -24,30 +150,134 @@ func NewClient(clientID, serverAddr string) *Client {
 		clientID:   clientID,
 		serverAddr: serverAddr,
 		receive:    make(chan []byte, 16),
+		events:     newEventBus(),
+		usedDrops:  make(map[string]bool),
+		expired:    make(map[string]time.Time),
+		attempts:   make(map[string]*ConnectAttempt),
+
+		directoryKick: make(chan struct{}, 1),
 	}
 }
 
 // Connection lifecycle
-func (c *Client) Unregister() error {
-	return unregisterWithServer(c.serverAddr, c.clientID)
+func (c *Client) Unregister(ctx context.Context) error {
+	if c.lanOnly {
+		return nil
+	}
+	if err := c.unlistDirectory(ctx); err != nil {
+		log.Printf("directory unlist failed client_id=%s err=%v", c.clientID, err)
+	}
+	if err := c.unpublishPresenceIfPublished(ctx); err != nil {
+		log.Printf("presence unpublish failed client_id=%s err=%v", c.clientID, err)
+	}
+	return unregisterWithServer(ctx, c.serverAddr, c.clientID)
 }
 
-func (c *Client) SendMessage(targetID string, data []byte) error {
+// SendMessage sends data to the connected peer and reports whether the
+// peer acknowledged it. Every attempt is recorded in SentMessages.
+func (c *Client) SendMessage(ctx context.Context, targetID string, data []byte) (DeliveryState, error) {
 	session := c.getSession()
 	if session == nil || !session.IsConnected() {
-		return errors.New("no active session")
+		return DeliveryFailed, ErrNoSession
 	}
 	activePeer := session.CurrentPeerID()
 	if targetID == "" {
 		targetID = activePeer
 	}
 	if targetID == "" {
-		return errors.New("no active peer")
+		return DeliveryFailed, ErrNoSession
 	}
 	if activePeer != "" && activePeer != targetID {
-		return fmt.Errorf("connected to %s", activePeer)
+		return DeliveryFailed, fmt.Errorf("%w: connected to %s", ErrBusy, activePeer)
+	}
+
+	id := c.recordSent(session, targetID, len(data))
+	state, seq, err := session.deliver(ctx, data)
+	c.updateSent(id, state, seq)
+	return state, err
+}
+
+// MarkRead records that one more message from ReceiveChan has been shown
+// and sends a read receipt up to it. Call it once per message shown; it
+// sends nothing when read receipts are turned off.
+func (c *Client) MarkRead(ctx context.Context) error {
+	session := c.getSession()
+	if session == nil {
+		return ErrNoSession
+	}
+	session.markShown()
+	if !c.readReceipts {
+		return nil
+	}
+	return session.SendReadReceipt(ctx)
+}
+
+// SendContext sends payload to whichever peer is connected.
+func (c *Client) SendContext(ctx context.Context, payload []byte) (DeliveryState, error) {
+	return c.SendMessage(ctx, "", payload)
+}
+
+// SendTyping forwards a typing indicator to the connected peer.
+func (c *Client) SendTyping(ctx context.Context) error {
+	session := c.getSession()
+	if session == nil {
+		return ErrNoSession
+	}
+	return session.SendTyping(ctx)
+}
+
+// PeerTyping reports whether the connected peer is currently typing.
+func (c *Client) PeerTyping() bool {
+	session := c.getSession()
+	return session != nil && session.PeerTyping()
+}
+
+// SentMessages returns recent outgoing messages, oldest first.
+func (c *Client) SentMessages() []SentMessage {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+	return append([]SentMessage(nil), c.sent...)
+}
+
+func (c *Client) recordSent(session *ChuteSession, peerID string, size int) uint64 {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+	c.nextID++
+	c.sent = append(c.sent, SentMessage{
+		ID:      c.nextID,
+		PeerID:  peerID,
+		Bytes:   size,
+		State:   DeliveryPending,
+		SentAt:  time.Now(),
+		session: session,
+	})
+	if len(c.sent) > sentHistoryLimit {
+		c.sent = c.sent[len(c.sent)-sentHistoryLimit:]
+	}
+	return c.nextID
+}
+
+func (c *Client) updateSent(id uint64, state DeliveryState, seq uint64) {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+	for i := range c.sent {
+		if c.sent[i].ID == id {
+			c.sent[i].State = state
+			c.sent[i].peerSeq = seq
+			return
+		}
+	}
+}
+
+func (c *Client) markRead(session *ChuteSession, seq uint64) {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+	for i := range c.sent {
+		m := &c.sent[i]
+		if m.session == session && m.State == DeliveryDelivered && m.peerSeq > 0 && m.peerSeq <= seq {
+			m.State = DeliveryRead
+		}
 	}
-	return session.Send(data)
 }
 
 // Polling
@@ -60,25 +290,360 @@ func (c *Client) StartPolling(ctx context.Context, manager *ConnectionManager) {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if c.IsConnected() {
+			if c.autoAccept && c.IsConnected() {
 				continue
 			}
-			intent, ok, err := pollConnectIntent(c.serverAddr, c.clientID)
+			if !c.IsConnected() {
+				c.pollDrops(ctx, manager)
+			}
+			intent, ok, err := pollConnectIntent(ctx, c.serverAddr, c.clientID)
+			if ctx.Err() != nil {
+				return
+			}
+			c.updateRendezvousHealth(ctx, err)
 			if err != nil {
-				log.Printf("poll failed: %v", err)
 				continue
 			}
 			if !ok {
 				continue
 			}
-			log.Printf("incoming connection request from %s", intent.ID)
-			if _, err := manager.ConnectWithPeerInfo(intent); err != nil {
-				log.Printf("connect back failed: %v", err)
+			c.HandleIntent(ctx, manager, intent)
+		}
+	}
+}
+
+// HandleIntent connects back right away when the requester is trusted,
+// and otherwise holds the intent for the user to accept or decline.
+func (c *Client) HandleIntent(ctx context.Context, manager *ConnectionManager, intent IntentInfo) {
+	if intent.Direct == nil {
+		c.lastSeen.markRegistered(intent.ID)
+	}
+	accept := c.autoAccept || (c.acceptsFrom(intent.ID) && !c.IsConnected())
+	if on := c.settingsFor(intent.ID).AutoAccept; on != nil {
+		accept = *on && !c.IsConnected()
+	}
+	// A direct intent's id is whatever the datagram claims, so it is never
+	// trusted on its own; the user decides.
+	if intent.Direct != nil {
+		accept = false
+	}
+	if accept {
+		log.Printf("incoming connection request from %s, accepting", intent.ID)
+		if _, err := manager.AnswerIntent(ctx, intent); err != nil {
+			log.Printf("connect back failed: %v", err)
+		}
+		return
+	}
+	if !c.addPending(intent) {
+		return
+	}
+	c.events.publish(Event{Kind: EventIntentReceived, PeerID: intent.ID, Detail: describeIntent(intent)})
+	log.Printf("incoming connection request from %s, type accept or decline", describeIntent(intent))
+}
+
+// Heartbeat
+
+// StartHeartbeat keeps the client id claim alive for long-running
+// clients by renewing it every half claim TTL. A client started offline
+// first keeps registering with backoff until the server answers.
+func (c *Client) StartHeartbeat(ctx context.Context) {
+	c.registerWhileOffline(ctx)
+
+	ticker := time.NewTicker(claimTTLSeconds * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.register(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("claim refresh failed client_id=%s err=%v", c.clientID, err)
 			}
 		}
 	}
 }
 
+func (c *Client) registerWhileOffline(ctx context.Context) {
+	for attempt := 1; c.Offline(); attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay(attempt, offlineRetryBackoff, offlineMaxBackoff)):
+		}
+		err := c.register(ctx)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		if errors.Is(err, ErrIDTaken) {
+			return
+		}
+		log.Printf("register retry failed client_id=%s attempt=%d err=%v", c.clientID, attempt, err)
+	}
+}
+
+// register claims the client id and leaves offline mode once it is held.
+func (c *Client) register(ctx context.Context) error {
+	if err := claimClientID(ctx, c.serverAddr, c.clientID, c.claimTTL()); err != nil {
+		c.checkIDTaken(err)
+		return err
+	}
+	c.rendezvousMu.Lock()
+	wasOffline := c.offline
+	c.offline = false
+	c.rendezvousMu.Unlock()
+	if wasOffline {
+		log.Printf("registered with rendezvous server client_id=%s", c.clientID)
+		c.events.publish(Event{Kind: EventRendezvousHealth, Detail: "registered"})
+	}
+	return nil
+}
+
+// checkIDTaken notes when the client id has been claimed by another key,
+// e.g. after our claim lapsed while offline. The id cannot be switched
+// under a running client, so the user is told once and a restart picks
+// a new id.
+func (c *Client) checkIDTaken(err error) {
+	if !errors.Is(err, ErrIDTaken) {
+		return
+	}
+	c.rendezvousMu.Lock()
+	already := c.idTaken
+	c.idTaken = true
+	c.rendezvousMu.Unlock()
+	if already {
+		return
+	}
+	log.Printf("client id taken by another key client_id=%s", c.clientID)
+	c.events.publish(Event{Kind: EventIDTaken, Detail: c.clientID, Err: err})
+}
+
+// IDTaken reports whether the client id is now claimed by another key.
+func (c *Client) IDTaken() bool {
+	c.rendezvousMu.Lock()
+	defer c.rendezvousMu.Unlock()
+	return c.idTaken
+}
+
+// claimTTL is how long to claim the client id for: the rest of a guest
+// lifetime, or the usual claim TTL.
+func (c *Client) claimTTL() int {
+	if c.guestUntil.IsZero() {
+		return claimTTLSeconds
+	}
+	return max(1, int(time.Until(c.guestUntil)/time.Second))
+}
+
+// Rendezvous health
+
+// SetOffline marks the client id as not yet claimed, because the server
+// could not be reached at startup. Sessions already possible without the
+// server keep working; StartHeartbeat claims the id once it is back.
+func (c *Client) SetOffline() {
+	c.rendezvousMu.Lock()
+	defer c.rendezvousMu.Unlock()
+	c.offline = true
+	c.rendezvousDown = true
+}
+
+// Offline reports whether the client id is still waiting to be claimed.
+func (c *Client) Offline() bool {
+	c.rendezvousMu.Lock()
+	defer c.rendezvousMu.Unlock()
+	return c.offline
+}
+
+// RendezvousHealthy reports whether the last poll reached a server. It is
+// tracked apart from session state: a QUIC session never depends on the
+// server once established, so an outage only pauses new incoming requests.
+func (c *Client) RendezvousHealthy() bool {
+	c.rendezvousMu.Lock()
+	defer c.rendezvousMu.Unlock()
+	return !c.rendezvousDown
+}
+
+func (c *Client) updateRendezvousHealth(ctx context.Context, err error) {
+	c.rendezvousMu.Lock()
+	wasDown := c.rendezvousDown
+	c.rendezvousDown = err != nil
+	c.rendezvousMu.Unlock()
+
+	switch {
+	case err != nil && !wasDown:
+		log.Printf("rendezvous unreachable, active session unaffected err=%v", err)
+		c.events.publish(Event{Kind: EventRendezvousHealth, Detail: "down", Err: err})
+	case err == nil && wasDown:
+		c.events.publish(Event{Kind: EventRendezvousHealth, Detail: "up"})
+		log.Printf("rendezvous reachable again, re-registering client_id=%s", c.clientID)
+		if err := c.register(ctx); err != nil {
+			log.Printf("re-register failed client_id=%s err=%v", c.clientID, err)
+		}
+	}
+}
+
+// Pending intents
+func (c *Client) SetAutoAccept(enabled bool) {
+	c.autoAccept = enabled
+}
+
+// SetAutoAcceptFrom accepts requests from the given peers without asking,
+// unless a session is already active.
+func (c *Client) SetAutoAcceptFrom(ids []string) {
+	accept := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		accept[id] = true
+	}
+	c.pendingMu.Lock()
+	c.acceptFrom = accept
+	c.pendingMu.Unlock()
+}
+
+func (c *Client) acceptsFrom(peerID string) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	return c.acceptFrom[peerID]
+}
+
+// Pending returns the unexpired incoming requests, oldest first.
+func (c *Client) Pending() []IntentInfo {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.prunePendingLocked()
+	infos := make([]IntentInfo, 0, len(c.pending))
+	for _, p := range c.pending {
+		info := p.info
+		info.Expires = p.expires
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Accept connects back to a pending requester. An empty peerID accepts
+// the oldest pending request.
+func (c *Client) Accept(ctx context.Context, manager *ConnectionManager, peerID string) (*ChuteSession, error) {
+	if c.IsConnected() {
+		return nil, errors.New("already connected")
+	}
+	intent, err := c.takePending(peerID)
+	if err != nil {
+		return nil, err
+	}
+	return manager.AnswerIntent(ctx, intent)
+}
+
+// Decline drops a pending request and tells the requester why, so its
+// connect fails with the reason instead of timing out.
+func (c *Client) Decline(ctx context.Context, manager *ConnectionManager, peerID, reason string) (string, error) {
+	intent, err := c.takePending(peerID)
+	if err != nil {
+		return "", err
+	}
+	if intent.Direct != nil {
+		return intent.ID, manager.declineDirect(intent, reason)
+	}
+	return intent.ID, sendDecline(ctx, c.serverAddr, c.clientID, intent.ID, reason)
+}
+
+// HasPending reports whether peerID has an unexpired pending request.
+func (c *Client) HasPending(peerID string) bool {
+	for _, intent := range c.Pending() {
+		if intent.ID == peerID {
+			return true
+		}
+	}
+	return false
+}
+
+// addPending holds info until the sender's intent TTL runs out, and
+// expires it then without waiting for the next lookup. It reports false
+// when the intent was dropped: a direct intent never replaces a pending
+// one with the same id, since anyone can claim that id in a datagram,
+// and no more than pendingLimit intents are held at once.
+func (c *Client) addPending(info IntentInfo) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.prunePendingLocked()
+	for i, p := range c.pending {
+		if p.info.ID == info.ID {
+			if info.Direct != nil {
+				log.Printf("direct intent dropped, %s already has a pending request addr=%s", info.ID, info.Direct)
+				return false
+			}
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			break
+		}
+	}
+	if len(c.pending) >= pendingLimit {
+		log.Printf("intent dropped, too many pending requests peer_id=%s", info.ID)
+		return false
+	}
+	delete(c.expired, info.ID)
+	ttl := intentTTLSeconds * time.Second
+	c.pending = append(c.pending, pendingIntent{
+		info:    info,
+		expires: time.Now().Add(ttl),
+	})
+	time.AfterFunc(ttl, func() {
+		c.pendingMu.Lock()
+		defer c.pendingMu.Unlock()
+		c.prunePendingLocked()
+	})
+	return true
+}
+
+// takePending removes and returns the request from peerID, or the
+// oldest one when peerID is empty. A request that expired is reported
+// as ErrIntentExpired.
+func (c *Client) takePending(peerID string) (IntentInfo, error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.prunePendingLocked()
+	for i, p := range c.pending {
+		if peerID == "" || p.info.ID == peerID {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return p.info, nil
+		}
+	}
+	if peerID == "" && len(c.expired) > 0 {
+		return IntentInfo{}, ErrIntentExpired
+	}
+	if _, ok := c.expired[peerID]; ok {
+		return IntentInfo{}, fmt.Errorf("%s: %w", peerID, ErrIntentExpired)
+	}
+	return IntentInfo{}, errors.New("no pending request")
+}
+
+func (c *Client) prunePendingLocked() {
+	now := time.Now()
+	kept := c.pending[:0]
+	for _, p := range c.pending {
+		if now.Before(p.expires) {
+			kept = append(kept, p)
+			continue
+		}
+		c.expired[p.info.ID] = p.expires
+		log.Printf("connection request expired peer_id=%s", p.info.ID)
+		c.events.publish(Event{Kind: EventIntentExpired, PeerID: p.info.ID, Detail: describeIntent(p.info)})
+	}
+	c.pending = kept
+	for id, at := range c.expired {
+		if now.Sub(at) > expiredIntentMemory {
+			delete(c.expired, id)
+		}
+	}
+}
+
+// describeIntent renders a requester as "id (name): purpose".
+func describeIntent(intent IntentInfo) string {
+	text := intent.ID
+	if intent.DisplayName != "" {
+		text += " (" + intent.DisplayName + ")"
+	}
+	if intent.Purpose != "" {
+		text += ": " + intent.Purpose
+	}
+	return text
+}
+
 // Session state
 func (c *Client) Disconnect() error {
 	session := c.getSession()
@@ -100,6 +665,296 @@ func (c *Client) ReceiveChan() <-chan []byte {
 	return c.receive
 }
 
+// ReceivedMessages returns up to limit spooled messages with Seq after
+// the given one, oldest first. With wait set and nothing new yet, it
+// waits until a message arrives or ctx is done.
+func (c *Client) ReceivedMessages(ctx context.Context, after uint64, limit int, wait bool) []ReceivedMessage {
+	if c.spool == nil {
+		return nil
+	}
+	messages, arrived := c.spool.after(after, limit)
+	if len(messages) > 0 || !wait {
+		return messages
+	}
+	select {
+	case <-arrived:
+		messages, _ = c.spool.after(after, limit)
+	case <-ctx.Done():
+	}
+	return messages
+}
+
+// LastReceivedSeq is the Seq of the newest spooled message, or 0.
+func (c *Client) LastReceivedSeq() uint64 {
+	if c.spool == nil {
+		return 0
+	}
+	return c.spool.lastSeq()
+}
+
+// Status
+func (c *Client) Status() ClientStatus {
+	status := ClientStatus{
+		Version:           version,
+		Commit:            commit,
+		ClientID:          c.clientID,
+		GuestUntil:        c.guestUntil,
+		RendezvousHealthy: c.RendezvousHealthy(),
+		LANOnly:           c.lanOnly,
+		Offline:           c.Offline(),
+		IDTaken:           c.IDTaken(),
+		DirectoryListed:   c.DirectoryListed(),
+		Pending:           len(c.Pending()),
+		Loops:             loops.health(),
+	}
+	for _, u := range c.peerUsage() {
+		status.Usage.Sent += u.Sent
+		status.Usage.Received += u.Received
+	}
+	if c.identity != nil {
+		status.Fingerprint = identityFingerprint(c.identity.Public().(ed25519.PublicKey))
+	}
+	if session := c.getSession(); session != nil && session.IsConnected() {
+		status.Connected = true
+		status.PeerID = session.CurrentPeerID()
+		status.PeerFingerprint = session.PeerFingerprint()
+		status.PeerVersion = session.PeerVersion()
+		status.PeerE2E = session.PeerE2E()
+		status.PeerRTT = session.PeerRTT()
+		status.PeerUnresponsive = session.PeerUnresponsive()
+		status.IdleRemaining = session.IdleRemaining()
+	}
+	return status
+}
+
+// Peers lists every peer with a pinned fingerprint or recorded traffic,
+// plus the connected peer, sorted by ID.
+func (c *Client) Peers() []PeerInfo {
+	known := make(map[string]string)
+	if c.pins != nil {
+		known = c.pins.list()
+	}
+	usage := c.peerUsage()
+	for id := range usage {
+		if _, ok := known[id]; !ok {
+			known[id] = ""
+		}
+	}
+	seen := c.lastSeen.list()
+	for id := range seen {
+		if _, ok := known[id]; !ok {
+			known[id] = ""
+		}
+	}
+	var current string
+	if session := c.getSession(); session != nil && session.IsConnected() {
+		current = session.CurrentPeerID()
+		if _, ok := known[current]; !ok {
+			known[current] = session.PeerFingerprint()
+		}
+	}
+
+	peers := make([]PeerInfo, 0, len(known))
+	for id, fingerprint := range known {
+		peers = append(peers, PeerInfo{ID: id, Fingerprint: fingerprint, Connected: id == current, Usage: usage[id], Settings: c.settingsFor(id), Presence: c.contactPresence(id), LastSeen: seen[id]})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// ResetUsage clears the traffic counters for peerID, or all of them when
+// peerID is empty.
+func (c *Client) ResetUsage(peerID string) error {
+	if c.usage == nil {
+		return nil
+	}
+	return c.usage.reset(peerID)
+}
+
+func (c *Client) peerUsage() map[string]PeerUsage {
+	if c.usage == nil {
+		return nil
+	}
+	return c.usage.usage()
+}
+
+// Settings
+
+// SetStorageKey turns on encryption at rest for received files, or off
+// when key is nil.
+func (c *Client) SetStorageKey(key []byte) {
+	c.settingsMu.Lock()
+	c.storageKey = key
+	c.settingsMu.Unlock()
+}
+
+func (c *Client) getStorageKey() []byte {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+	return c.storageKey
+}
+
+// SetGuestUntil marks the client id as a guest id that lapses at t.
+// SetLANOnly tells the client there is no rendezvous server to talk to.
+func (c *Client) SetLANOnly(enabled bool) {
+	c.lanOnly = enabled
+}
+
+func (c *Client) SetGuestUntil(t time.Time) {
+	c.guestUntil = t
+}
+
+func (c *Client) SetMessageSpool(spool *messageSpool) {
+	c.spool = spool
+}
+
+func (c *Client) SetUsageStore(store *usageStore) {
+	c.usage = store
+}
+
+// SetLastSeenStore records when peers were last connected and seen.
+func (c *Client) SetLastSeenStore(store *lastSeenStore) {
+	c.lastSeen = store
+}
+
+func (c *Client) SetPinStore(store *pinStore) {
+	c.pins = store
+}
+
+// SetPeerSettingsStore enables per-peer overrides.
+func (c *Client) SetPeerSettingsStore(store *peerSettingsStore) {
+	c.peerSettings = store
+}
+
+// SetConfigDir tells the client where Settings and UpdateSetting persist,
+// and where transfer history is kept. With no dir, as for guests, nothing
+// is written: settings changes apply to the running client only and no
+// history is kept.
+func (c *Client) SetConfigDir(dir string) {
+	c.configDir = dir
+}
+
+// Settings returns the persisted settings.
+func (c *Client) Settings() (Settings, error) {
+	if c.configDir == "" {
+		return Settings{}, nil
+	}
+	return loadSettings(c.configDir)
+}
+
+// UpdateSetting changes one setting, saves it, and applies it to the
+// running client where possible. It reports whether a restart is needed.
+func (c *Client) UpdateSetting(key, value string) (bool, error) {
+	settings, err := c.Settings()
+	if err != nil {
+		return false, err
+	}
+	if err := settings.set(key, value); err != nil {
+		return false, err
+	}
+	if c.configDir != "" {
+		if err := saveSettings(c.configDir, settings); err != nil {
+			return false, err
+		}
+	}
+	return c.applySetting(settings, key)
+}
+
+// ReloadSettings re-reads the settings file and applies every setting
+// that can change while running. The session and the registration are
+// left alone, so server and lan still need a restart. Settings given as
+// flags keep the flag's value, as at startup.
+func (c *Client) ReloadSettings() error {
+	if c.configDir == "" {
+		return nil
+	}
+	settings, err := loadSettings(c.configDir)
+	if err != nil {
+		return err
+	}
+	for _, key := range settingKeys {
+		if flagGiven(key) {
+			continue
+		}
+		if _, err := c.applySetting(settings, key); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	log.Printf("settings reloaded")
+	return nil
+}
+
+// applySetting applies one setting to the running client. It reports
+// whether the setting only takes effect after a restart.
+func (c *Client) applySetting(settings Settings, key string) (bool, error) {
+	switch key {
+	case "stun":
+		setConfiguredSTUNServers(settings.STUNServers)
+	case "download-dir":
+		if settings.DownloadDir != "" {
+			c.SetDownloadDir(settings.DownloadDir)
+		}
+	case "auto-accept":
+		c.SetAutoAcceptFrom(settings.AutoAcceptFrom)
+	case "directory":
+		c.SetDirectoryListed(settings.Directory && c.guestUntil.IsZero())
+	case "performance":
+		if err := setPerformanceProfile(settings.Performance); err != nil {
+			return false, err
+		}
+	case "proxy":
+		if err := configureRendezvousProxy(settings.Proxy); err != nil {
+			return false, err
+		}
+	case "idle-policy":
+		if err := setIdlePolicy(settings.IdlePolicy); err != nil {
+			return false, err
+		}
+	case "verbose":
+		if err := setVerbose(nil, false); err != nil {
+			return false, err
+		}
+		if len(settings.Verbose) > 0 {
+			if err := setVerbose(settings.Verbose, true); err != nil {
+				return false, err
+			}
+		}
+	case "encrypt-downloads":
+		if !settings.EncryptDownloads {
+			c.SetStorageKey(nil)
+			break
+		}
+		key, err := c.loadStorageKey()
+		if err != nil {
+			return false, err
+		}
+		c.SetStorageKey(key)
+	case "server", "lan":
+		return true, nil
+	}
+	return false, nil
+}
+
+func (c *Client) SetReadReceipts(enabled bool) {
+	c.readReceipts = enabled
+}
+
+func (c *Client) SetIdentity(identity ed25519.PrivateKey) {
+	c.identity = identity
+}
+
+func (c *Client) SetDownloadDir(dir string) {
+	c.settingsMu.Lock()
+	c.downloadDir = dir
+	c.settingsMu.Unlock()
+}
+
+func (c *Client) DownloadDir() string {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+	return c.downloadDir
+}
+
 // Session wiring
 func (c *Client) SetSession(session *ChuteSession) {
 	c.sessionMu.Lock()
@@ -109,13 +964,444 @@ func (c *Client) SetSession(session *ChuteSession) {
 	if session == nil {
 		return
 	}
+	c.markActive()
+	c.lastSeen.markConnected(session.CurrentPeerID())
+	session.SetReceiptHandler(func(seq uint64) {
+		c.markRead(session, seq)
+	})
+	session.SetLargeMessageHandler(c.saveLargeMessage)
+	if c.takeUsedDrop(session.LocalID()) {
+		session.SetFileHandler(c.receiveDropFile(session))
+	} else {
+		session.SetFileHandler(c.receiveFile)
+	}
+
+	peerID := session.CurrentPeerID()
+	session.SetLivenessHandler(func(unresponsive bool) {
+		if !unresponsive {
+			c.events.publish(Event{Kind: EventPeerResponsive, PeerID: peerID})
+			return
+		}
+		c.events.publish(Event{Kind: EventPeerUnresponsive, PeerID: peerID})
+		if fn := c.callbacks().onUnresponsive; fn != nil {
+			fn(peerID)
+		}
+	})
+	session.SetIdleHandler(func(remaining time.Duration) {
+		c.events.publish(Event{Kind: EventIdleWarning, PeerID: peerID, Detail: remaining.Round(time.Second).String()})
+	})
+	session.OnClose(func() {
+		c.markActive()
+		c.lastSeen.markConnected(peerID)
+		c.events.publish(Event{Kind: EventDisconnected, PeerID: peerID})
+		if fn := c.callbacks().onDisconnected; fn != nil {
+			fn(peerID)
+		}
+	})
+	c.events.publish(Event{Kind: EventConnected, PeerID: peerID})
+	if fn := c.callbacks().onConnected; fn != nil {
+		fn(peerID)
+	}
 	go func() {
-		for msg := range session.ReceiveChan {
-			c.receive <- msg
+		for msg := range session.Messages() {
+			if c.spool != nil {
+				if _, err := c.spool.add(peerID, msg); err != nil {
+					log.Printf("spool message failed peer_id=%s err=%v", peerID, err)
+				}
+			}
+			if fn := c.callbacks().onMessage; fn != nil {
+				fn(peerID, msg)
+				continue
+			}
+			if c.spool == nil {
+				c.receive <- msg
+				continue
+			}
+			// The spool already holds the message, so a reader that is
+			// not keeping up with ReceiveChan only misses the live copy.
+			select {
+			case c.receive <- msg:
+			default:
+			}
 		}
 	}()
 }
 
+// Events subscribes to client state changes. Call the returned function
+// to unsubscribe.
+func (c *Client) Events() (<-chan Event, func()) {
+	return c.events.Subscribe()
+}
+
+// Callbacks
+//
+// Callbacks run on internal goroutines and should return quickly. While
+// OnMessage is set, messages go to it instead of ReceiveChan.
+func (c *Client) OnMessage(fn func(peerID string, payload []byte)) {
+	c.callbackMu.Lock()
+	c.onMessage = fn
+	c.callbackMu.Unlock()
+}
+
+func (c *Client) OnConnected(fn func(peerID string)) {
+	c.callbackMu.Lock()
+	c.onConnected = fn
+	c.callbackMu.Unlock()
+}
+
+func (c *Client) OnDisconnected(fn func(peerID string)) {
+	c.callbackMu.Lock()
+	c.onDisconnected = fn
+	c.callbackMu.Unlock()
+}
+
+// OnPeerUnresponsive registers fn to be called when the connected peer
+// misses several heartbeats in a row, long before the idle timeout
+// would end the session.
+func (c *Client) OnPeerUnresponsive(fn func(peerID string)) {
+	c.callbackMu.Lock()
+	c.onUnresponsive = fn
+	c.callbackMu.Unlock()
+}
+
+func (c *Client) OnTransferProgress(fn func(TransferProgress)) {
+	c.callbackMu.Lock()
+	c.onTransferProgress = fn
+	c.callbackMu.Unlock()
+}
+
+// clientCallbacks is a snapshot of the registered callbacks.
+type clientCallbacks struct {
+	onMessage          func(peerID string, payload []byte)
+	onConnected        func(peerID string)
+	onDisconnected     func(peerID string)
+	onUnresponsive     func(peerID string)
+	onTransferProgress func(TransferProgress)
+}
+
+func (c *Client) callbacks() clientCallbacks {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	return clientCallbacks{
+		onMessage:          c.onMessage,
+		onConnected:        c.onConnected,
+		onDisconnected:     c.onDisconnected,
+		onUnresponsive:     c.onUnresponsive,
+		onTransferProgress: c.onTransferProgress,
+	}
+}
+
+// saveLargeMessage spools a message too big to buffer into the download
+// directory.
+func (c *Client) saveLargeMessage(peerID string, r io.Reader) error {
+	return c.saveIncoming(peerID, "message from "+peerID+".bin", -1, nil, r)
+}
+
+// saveIncoming writes r to a new file in the download directory, reporting
+// progress and recording the outcome. A known size is enforced as the
+// data arrives, and a partial or oversized file is removed, as is one
+// that does not match sum when sum is given.
+func (c *Client) saveIncoming(peerID, name string, size int64, sum []byte, r io.Reader) error {
+	storageKey := c.getStorageKey()
+	if storageKey != nil {
+		name += encryptedSuffix
+	}
+	file, path, err := createDownloadFile(c.downloadDirFor(peerID), name)
+	if err != nil {
+		return err
+	}
+	var dst io.Writer = file
+	var sealer io.WriteCloser
+	if storageKey != nil {
+		if sealer, err = newAtRestWriter(file, storageKey); err != nil {
+			file.Close()
+			_ = os.Remove(path)
+			return err
+		}
+		dst = sealer
+	}
+	name = filepath.Base(path)
+	started := time.Now()
+	c.events.publish(Event{Kind: EventTransferStarted, PeerID: peerID, Detail: name})
+	progress := &progressTracker{
+		report: c.callbacks().onTransferProgress,
+		state:  TransferProgress{PeerID: peerID, Name: name, Total: size},
+	}
+	src := c.limitFor(peerID, r)
+	if size >= 0 {
+		src = &sizeLimitReader{r: src, n: size}
+	}
+	digest := sha256.New()
+	n, err := copyChunked(progressWriter{w: dst, progressTracker: progress}, io.TeeReader(src, digest))
+	if err == nil && size >= 0 && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && sum != nil && !bytes.Equal(digest.Sum(nil), sum) {
+		err = errFileCorrupt
+	}
+	if sealer != nil {
+		if closeErr := sealer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	progress.finish(err)
+	c.events.publish(Event{Kind: EventTransferFinished, PeerID: peerID, Detail: name, Err: err})
+	c.recordTransfer(newTransferRecord(peerID, name, directionIncoming, n, started, err))
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	log.Printf("transfer saved peer_id=%s bytes=%d path=%s verified=%t", peerID, n, path, sum != nil)
+	return nil
+}
+
+// ExportFile decrypts a file received with encryption at rest to dest,
+// or next to it when dest is empty, and returns the path written. A
+// relative src is taken from the download directory. Existing files are
+// never overwritten.
+func (c *Client) ExportFile(src, dest string) (string, error) {
+	storageKey := c.getStorageKey()
+	if storageKey == nil {
+		var err error
+		if storageKey, err = c.loadStorageKey(); err != nil {
+			return "", err
+		}
+	}
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(c.DownloadDir(), src)
+	}
+	if dest == "" {
+		dest = exportPath(src)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	r, err := newAtRestReader(in, storageKey)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", src, err)
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	_, err = copyChunked(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dest)
+		return "", err
+	}
+	return dest, nil
+}
+
+// File transfer
+
+// SendFile offers the file at path to the connected peer and streams it
+// once they accept. With a passphrase the data is sealed under a key
+// derived from it, and the peer has to enter it to accept.
+func (c *Client) SendFile(ctx context.Context, targetID, path, passphrase string) error {
+	return c.sendFile(ctx, targetID, path, filepath.Base(path), passphrase)
+}
+
+// sendFile sends the file at path under name.
+func (c *Client) sendFile(ctx context.Context, targetID, path, name, passphrase string) error {
+	session := c.getSession()
+	if session == nil || !session.IsConnected() {
+		return ErrNoSession
+	}
+	if activePeer := session.CurrentPeerID(); targetID != "" && activePeer != targetID {
+		return fmt.Errorf("%w: connected to %s", ErrBusy, activePeer)
+	}
+	peerID := session.CurrentPeerID()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	// The digest goes in the offer, so the file is read once up front.
+	digest := sha256.New()
+	if _, err := copyChunked(digest, file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	offer := FileOffer{Name: name, Size: info.Size(), SHA256: digest.Sum(nil)}
+	progress := &progressTracker{
+		report: c.callbacks().onTransferProgress,
+		state:  TransferProgress{PeerID: peerID, Name: offer.Name, Total: offer.Size},
+	}
+	var r io.Reader = progressReader{r: c.limitFor(peerID, file), progressTracker: progress}
+	if passphrase != "" {
+		protection, key, err := newFileProtection(passphrase)
+		if err != nil {
+			return err
+		}
+		sealed, err := sealReader(r, key)
+		if err != nil {
+			return err
+		}
+		defer sealed.Close()
+		offer.Protection = protection
+		r = sealed
+	}
+	started := time.Now()
+	c.events.publish(Event{Kind: EventTransferStarted, PeerID: peerID, Detail: offer.Name})
+	err = session.SendFile(ctx, offer, r)
+	progress.finish(err)
+	c.events.publish(Event{Kind: EventTransferFinished, PeerID: peerID, Detail: offer.Name, Err: err})
+	c.recordTransfer(newTransferRecord(peerID, offer.Name, directionOutgoing, progress.state.Bytes, started, err))
+	return err
+}
+
+// PendingFiles lists files peers are waiting to send, oldest first.
+func (c *Client) PendingFiles() []FileOfferInfo {
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+	offers := make([]FileOfferInfo, 0, len(c.files))
+	for _, f := range c.files {
+		offers = append(offers, FileOfferInfo{PeerID: f.peerID, FileOffer: f.offer})
+	}
+	return offers
+}
+
+// AcceptFile starts receiving the oldest file offered by peerID, or by
+// anyone when peerID is empty. ok reports whether there was such an
+// offer. A protected file stays pending until the right passphrase is
+// given.
+func (c *Client) AcceptFile(peerID, passphrase string) (info FileOfferInfo, ok bool, err error) {
+	c.filesMu.Lock()
+	var pending *pendingFile
+	for _, f := range c.files {
+		if peerID == "" || f.peerID == peerID {
+			pending = f
+			break
+		}
+	}
+	c.filesMu.Unlock()
+	if pending == nil {
+		return FileOfferInfo{}, false, nil
+	}
+	info = FileOfferInfo{PeerID: pending.peerID, FileOffer: pending.offer}
+
+	// Key derivation is deliberately slow, so it runs unlocked.
+	var key []byte
+	if protection := pending.offer.Protection; protection != nil {
+		if key, err = protection.unlock(passphrase); err != nil {
+			return info, true, err
+		}
+	}
+
+	c.filesMu.Lock()
+	defer c.filesMu.Unlock()
+	for i, f := range c.files {
+		if f == pending {
+			c.files = append(c.files[:i], c.files[i+1:]...)
+			f.decision <- key
+			return info, true, nil
+		}
+	}
+	return info, true, errors.New("file offer expired")
+}
+
+// receiveFile holds an incoming file until the user accepts it or the
+// offer expires.
+func (c *Client) receiveFile(peerID string, offer FileOffer, r io.Reader) error {
+	if on := c.settingsFor(peerID).AutoAccept; on != nil && *on && offer.Protection == nil {
+		log.Printf("file auto-accepted peer_id=%s name=%q bytes=%d", peerID, offer.Name, offer.Size)
+		return c.storeFile(peerID, offer, r, nil)
+	}
+	if offer.Protection == nil && c.takePull(peerID, offer.Name) {
+		log.Printf("pulled file received peer_id=%s name=%q bytes=%d", peerID, offer.Name, offer.Size)
+		return c.storeFile(peerID, offer, r, nil)
+	}
+	pending := &pendingFile{peerID: peerID, offer: offer, decision: make(chan []byte, 1)}
+	c.filesMu.Lock()
+	c.files = append(c.files, pending)
+	c.filesMu.Unlock()
+
+	detail := fmt.Sprintf("%s (%d bytes)", offer.Name, offer.Size)
+	if offer.Protection != nil {
+		detail += ", passphrase protected"
+	}
+	c.events.publish(Event{Kind: EventFileOffered, PeerID: peerID, Detail: detail})
+	log.Printf("file offered peer_id=%s name=%q bytes=%d protected=%t", peerID, offer.Name, offer.Size, offer.Protection != nil)
+
+	timer := time.NewTimer(fileOfferTimeout)
+	defer timer.Stop()
+	select {
+	case key := <-pending.decision:
+		return c.storeFile(peerID, offer, r, key)
+	case <-timer.C:
+		c.filesMu.Lock()
+		for i, f := range c.files {
+			if f == pending {
+				c.files = append(c.files[:i], c.files[i+1:]...)
+				c.filesMu.Unlock()
+				return errFileRefused
+			}
+		}
+		c.filesMu.Unlock()
+	}
+	// Accepted just as the offer expired; AcceptFile has already sent
+	// the decision.
+	return c.storeFile(peerID, offer, r, <-pending.decision)
+}
+
+// storeFile saves an accepted file, opening the sealed stream of a
+// protected one with key.
+func (c *Client) storeFile(peerID string, offer FileOffer, r io.Reader, key []byte) error {
+	if key != nil {
+		opened, err := newOpenReader(r, key)
+		if err != nil {
+			return err
+		}
+		r = opened
+	}
+	return c.saveIncoming(peerID, offer.Name, offer.Size, offer.SHA256, r)
+}
+
+// loadStorageKey loads the storage key from the config dir, creating it
+// on first use.
+func (c *Client) loadStorageKey() ([]byte, error) {
+	if c.configDir == "" {
+		return nil, errors.New("encryption at rest needs a config dir")
+	}
+	return loadOrCreateStorageKey(c.configDir)
+}
+
+// TransferHistory returns recent finished transfers, oldest first.
+func (c *Client) TransferHistory() ([]TransferRecord, error) {
+	if c.configDir == "" {
+		return nil, nil
+	}
+	return loadTransferHistory(c.configDir)
+}
+
+func (c *Client) recordTransfer(rec TransferRecord) {
+	if c.configDir == "" {
+		return
+	}
+	if err := appendTransferRecord(c.configDir, rec); err != nil {
+		log.Printf("transfer history write failed err=%v", err)
+	}
+}
+
 // Internal helpers
 func (c *Client) getSession() *ChuteSession {
 	c.sessionMu.RLock()
@@ -1,8 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	clientIDFile    = "client_id"
+	claimTTLSeconds = 7 * 24 * 60 * 60
+	claimAttempts   = 5
+
+	offlineRetryBackoff = 2 * time.Second
+	offlineMaxBackoff   = time.Minute
 )
 
 func generateClientID() (string, error) {
@@ -28,3 +46,90 @@ func formatClientID(id string) string {
 	return id[0:3] + " " + id[3:6] + " " + id[6:9]
 }
 
+// Persistence & claiming
+
+// claimPersistentClientID returns the client id to use and whether it
+// was claimed. A server that cannot be reached is not fatal: the id is
+// kept and the caller starts offline and claims it later.
+func claimPersistentClientID(ctx context.Context, dir, serverAddr, requested string) (string, bool, error) {
+	id := requested
+	if id == "" {
+		loaded, err := loadOrCreateClientID(dir)
+		if err != nil {
+			return "", false, err
+		}
+		id = loaded
+	} else if err := validateClientID(id); err != nil {
+		return "", false, err
+	}
+
+	for attempt := 0; attempt < claimAttempts; attempt++ {
+		err := claimClientID(ctx, serverAddr, id, claimTTLSeconds)
+		if err == nil || !errors.Is(err, ErrIDTaken) {
+			if err != nil {
+				log.Printf("claim failed client_id=%s err=%v", id, err)
+			}
+			return id, err == nil, saveClientID(dir, id)
+		}
+		if requested != "" {
+			return "", false, fmt.Errorf("client id %s is taken", requested)
+		}
+
+		log.Printf("client id collision client_id=%s, generating a new one", id)
+		next, err := generateClientID()
+		if err != nil {
+			return "", false, err
+		}
+		id = next
+	}
+	return "", false, errors.New("could not claim a free client id")
+}
+
+// localClientID picks the client id without a server, for LAN-only
+// mode: the requested one, or the persisted one.
+func localClientID(dir, requested string) (string, error) {
+	id := requested
+	if id == "" {
+		loaded, err := loadOrCreateClientID(dir)
+		if err != nil {
+			return "", err
+		}
+		id = loaded
+	} else if err := validateClientID(id); err != nil {
+		return "", err
+	}
+	return id, saveClientID(dir, id)
+}
+
+func loadOrCreateClientID(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, clientIDFile))
+	if err == nil {
+		id := strings.TrimSpace(string(data))
+		if validateClientID(id) == nil {
+			return id, nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	return generateClientID()
+}
+
+func saveClientID(dir, id string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, clientIDFile), []byte(id+"\n"), 0o600)
+}
+
+func validateClientID(id string) error {
+	if id == "" {
+		return errors.New("empty client id")
+	}
+	if len(id) > identityLimit {
+		return errors.New("client id too long")
+	}
+	if strings.ContainsAny(id, " \t\r\n/") {
+		return errors.New("client id contains invalid characters")
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+// Command chutectl drives a running chute client through its control API.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const controlInfoFile = "control.json"
+
+type controlInfo struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+}
+
+func main() {
+	profile := flag.String("profile", os.Getenv("CHUTE_PROFILE"), "profile of the client to control")
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "usage: %s [-profile name] <command> [args]\n\n", os.Args[0])
+		fmt.Fprintln(out, "commands:")
+		fmt.Fprintln(out, "  status")
+		fmt.Fprintln(out, "  pending")
+		fmt.Fprintln(out, "  peers")
+		fmt.Fprintln(out, "  peer-settings <id> [key [value]]")
+		fmt.Fprintln(out, "  find <name>")
+		fmt.Fprintln(out, "  shares")
+		fmt.Fprintln(out, "  share-add <name> <dir>")
+		fmt.Fprintln(out, "  share-remove <name>")
+		fmt.Fprintln(out, "  share-grant <name> <id>")
+		fmt.Fprintln(out, "  share-revoke <name> <id>")
+		fmt.Fprintln(out, "  ls <id> [share/path]")
+		fmt.Fprintln(out, "  pull <id> <path>")
+		fmt.Fprintln(out, "  messages [after]")
+		fmt.Fprintln(out, "  export <file> [dest]")
+		fmt.Fprintln(out, "  drop [lifetime]")
+		fmt.Fprintln(out, "  drops")
+		fmt.Fprintln(out, "  lan")
+		fmt.Fprintln(out, "  offer")
+		fmt.Fprintln(out, "  paste <offer|answer>")
+		fmt.Fprintln(out, "  usage-reset [id]")
+		fmt.Fprintln(out, "  connect <id> [purpose]")
+		fmt.Fprintln(out, "  connect-direct <ip:port> [purpose]")
+		fmt.Fprintln(out, "  attempts [id]")
+		fmt.Fprintln(out, "  connect-report")
+		fmt.Fprintln(out, "  send <message>")
+		fmt.Fprintln(out, "  sendfile [-p] <id> <path>")
+		fmt.Fprintln(out, "  accept [-p] [id]")
+		fmt.Fprintln(out, "  decline [id] [reason]")
+		fmt.Fprintln(out, "  loglevel [debug|info] [subsystem...]")
+		fmt.Fprintln(out, "  logs [count]")
+		fmt.Fprintln(out, "  reload")
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	info, err := loadControlInfo(*profile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "no running chute client found: %v\n", err)
+		os.Exit(3)
+	}
+
+	path, body, err := buildRequest(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := call(info, path, body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// buildRequest maps a command line to an API path and JSON body. A nil
+// body means GET.
+func buildRequest(args []string) (string, map[string]string, error) {
+	cmd, rest := args[0], args[1:]
+	switch cmd {
+	case "status", "pending", "peers", "drops", "lan":
+		return "/" + cmd, nil, nil
+	case "messages":
+		if len(rest) > 0 {
+			return "/messages?after=" + url.QueryEscape(rest[0]), nil, nil
+		}
+		return "/messages", nil, nil
+	case "usage-reset":
+		body := map[string]string{}
+		if len(rest) > 0 {
+			body["id"] = rest[0]
+		}
+		return "/usage/reset", body, nil
+	case "connect":
+		if len(rest) < 1 {
+			return "", nil, errors.New("usage: connect <id> [purpose]")
+		}
+		return "/connect", map[string]string{"id": rest[0], "purpose": strings.Join(rest[1:], " ")}, nil
+	case "connect-report":
+		return "/connect/last-report", nil, nil
+	case "peer-settings":
+		if len(rest) == 0 {
+			return "", nil, errors.New("usage: peer-settings <id> [key [value]]")
+		}
+		path := "/peers/" + url.PathEscape(rest[0]) + "/settings"
+		if len(rest) == 1 {
+			return path, nil, nil
+		}
+		return path, map[string]string{"key": rest[1], "value": strings.Join(rest[2:], " ")}, nil
+	case "find":
+		if len(rest) == 0 {
+			return "", nil, errors.New("usage: find <name>")
+		}
+		return "/directory?q=" + url.QueryEscape(strings.Join(rest, " ")), nil, nil
+	case "shares":
+		return "/shares", nil, nil
+	case "share-add":
+		if len(rest) != 2 {
+			return "", nil, errors.New("usage: share-add <name> <dir>")
+		}
+		abs, err := filepath.Abs(rest[1])
+		if err != nil {
+			return "", nil, err
+		}
+		return "/shares", map[string]string{"name": rest[0], "path": abs}, nil
+	case "share-remove":
+		if len(rest) != 1 {
+			return "", nil, errors.New("usage: share-remove <name>")
+		}
+		return "/shares/" + url.PathEscape(rest[0]) + "/remove", map[string]string{}, nil
+	case "share-grant", "share-revoke":
+		if len(rest) != 2 {
+			return "", nil, fmt.Errorf("usage: %s <name> <id>", cmd)
+		}
+		action := strings.TrimPrefix(cmd, "share-")
+		return "/shares/" + url.PathEscape(rest[0]) + "/" + action, map[string]string{"id": rest[1]}, nil
+	case "ls":
+		if len(rest) < 1 || len(rest) > 2 {
+			return "", nil, errors.New("usage: ls <id> [share/path]")
+		}
+		path := "/peers/" + url.PathEscape(rest[0]) + "/files"
+		if len(rest) == 2 {
+			path += "?path=" + url.QueryEscape(rest[1])
+		}
+		return path, nil, nil
+	case "pull":
+		if len(rest) != 2 {
+			return "", nil, errors.New("usage: pull <id> <path>")
+		}
+		return "/peers/" + url.PathEscape(rest[0]) + "/pull", map[string]string{"path": rest[1]}, nil
+	case "attempts":
+		if len(rest) > 0 {
+			return "/attempts?id=" + url.QueryEscape(rest[0]), nil, nil
+		}
+		return "/attempts", nil, nil
+	case "offer":
+		return "/offer", map[string]string{}, nil
+	case "reload":
+		return "/reload", map[string]string{}, nil
+	case "paste":
+		if len(rest) < 1 {
+			return "", nil, errors.New("usage: paste <offer|answer>")
+		}
+		return "/paste", map[string]string{"blob": strings.Join(rest, "")}, nil
+	case "connect-direct":
+		if len(rest) < 1 {
+			return "", nil, errors.New("usage: connect-direct <ip:port> [purpose]")
+		}
+		return "/connect-direct", map[string]string{"addr": rest[0], "purpose": strings.Join(rest[1:], " ")}, nil
+	case "send":
+		if len(rest) < 1 {
+			return "", nil, errors.New("usage: send <message>")
+		}
+		return "/send", map[string]string{"message": strings.Join(rest, " ")}, nil
+	case "sendfile":
+		protect := len(rest) > 0 && rest[0] == "-p"
+		if protect {
+			rest = rest[1:]
+		}
+		if len(rest) != 2 {
+			return "", nil, errors.New("usage: sendfile [-p] <id> <path>")
+		}
+		abs, err := filepath.Abs(rest[1])
+		if err != nil {
+			return "", nil, err
+		}
+		body := map[string]string{"id": rest[0], "path": abs}
+		if protect {
+			if body["passphrase"], err = readPassphrase(); err != nil {
+				return "", nil, err
+			}
+		}
+		return "/sendfile", body, nil
+	case "drop":
+		body := map[string]string{}
+		if len(rest) > 0 {
+			body["ttl"] = rest[0]
+		}
+		return "/drop", body, nil
+	case "export":
+		if len(rest) < 1 || len(rest) > 2 {
+			return "", nil, errors.New("usage: export <file> [dest]")
+		}
+		body := map[string]string{"path": rest[0]}
+		if len(rest) == 2 {
+			abs, err := filepath.Abs(rest[1])
+			if err != nil {
+				return "", nil, err
+			}
+			body["dest"] = abs
+		}
+		return "/export", body, nil
+	case "accept":
+		body := map[string]string{}
+		if len(rest) > 0 && rest[0] == "-p" {
+			passphrase, err := readPassphrase()
+			if err != nil {
+				return "", nil, err
+			}
+			body["passphrase"] = passphrase
+			rest = rest[1:]
+		}
+		if len(rest) > 0 {
+			body["id"] = rest[0]
+		}
+		return "/accept", body, nil
+	case "decline":
+		body := map[string]string{}
+		if len(rest) > 0 {
+			body["id"] = rest[0]
+			body["reason"] = strings.Join(rest[1:], " ")
+		}
+		return "/decline", body, nil
+	case "logs":
+		if len(rest) > 0 {
+			return "/logs?limit=" + url.QueryEscape(rest[0]), nil, nil
+		}
+		return "/logs", nil, nil
+	case "loglevel":
+		if len(rest) == 0 {
+			return "/debug/loglevel", nil, nil
+		}
+		query := url.Values{"level": {rest[0]}, "subsystem": {strings.Join(rest[1:], ",")}}
+		return "/debug/loglevel?" + query.Encode(), map[string]string{}, nil
+	}
+	return "", nil, fmt.Errorf("unknown command %q", cmd)
+}
+
+// readPassphrase reads one line from stdin, so passphrases can be piped
+// in and never appear in the process list.
+func readPassphrase() (string, error) {
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("no passphrase given")
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", errors.New("no passphrase given")
+	}
+	return line, nil
+}
+
+func call(info controlInfo, path string, body map[string]string) error {
+	method := http.MethodGet
+	var reader io.Reader
+	if body != nil {
+		method = http.MethodPost
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+info.Addr+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+info.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 3 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, data, "", "  ") == nil {
+		data = pretty.Bytes()
+	}
+	fmt.Println(strings.TrimSpace(string(data)))
+	return nil
+}
+
+// loadControlInfo reads the discovery file from the same config dir the
+// client uses for profile.
+func loadControlInfo(profile string) (controlInfo, error) {
+	var info controlInfo
+	dir := os.Getenv("CHUTE_CONFIG_DIR")
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return info, err
+		}
+		dir = filepath.Join(base, "chute")
+	}
+	if profile != "" && profile != "default" {
+		if strings.ContainsAny(profile, `/\.`) {
+			return info, fmt.Errorf("invalid profile name %q", profile)
+		}
+		dir = filepath.Join(dir, "profiles", profile)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, controlInfoFile))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+// attemptRetention is how long a finished connect attempt can still be
+// looked up.
+const attemptRetention = 10 * time.Minute
+
+// ConnectState is one step of a connect attempt.
+type ConnectState string
+
+const (
+	ConnectLookingUp ConnectState = "looking-up-peer"
+	ConnectGathering ConnectState = "gathering-candidates"
+	ConnectWaiting   ConnectState = "waiting-for-peer"
+	ConnectPunching  ConnectState = "punching"
+	ConnectRelayed   ConnectState = "relayed"
+	ConnectConnected ConnectState = "connected"
+	ConnectFailed    ConnectState = "failed"
+)
+
+// ConnectAttempt is the latest state of one asynchronous connect.
+type ConnectAttempt struct {
+	ID      string       `json:"id"`
+	PeerID  string       `json:"peer_id"`
+	State   ConnectState `json:"state"`
+	Err     string       `json:"error,omitempty"`
+	Started time.Time    `json:"started"`
+	Updated time.Time    `json:"updated"`
+}
+
+func (a *ConnectAttempt) done() bool {
+	return a.State == ConnectConnected || a.State == ConnectFailed
+}
+
+// Connect attempts
+//
+// A connect can take up to iceConnectTimeout while the peer is asked,
+// candidates are gathered and holes are punched. ConnectAsync returns an
+// attempt id right away and runs the connect in the background; every
+// step is published as EventConnectProgress carrying the attempt id, and
+// ends in connected or failed. Progress of connects started elsewhere,
+// such as answering an intent, is published without an attempt id.
+
+// ConnectAsync starts connecting to targetID and returns the attempt id.
+// While an attempt to targetID is running, its id is returned instead of
+// starting another.
+func (c *Client) ConnectAsync(ctx context.Context, manager *ConnectionManager, targetID, purpose string) (string, error) {
+	if targetID == "" {
+		return "", errors.New("missing target id")
+	}
+	c.attemptsMu.Lock()
+	c.pruneAttemptsLocked()
+	for _, a := range c.attempts {
+		if a.PeerID == targetID && !a.done() {
+			c.attemptsMu.Unlock()
+			return a.ID, nil
+		}
+	}
+	id, err := newAttemptID()
+	if err != nil {
+		c.attemptsMu.Unlock()
+		return "", err
+	}
+	now := time.Now()
+	c.attempts[id] = &ConnectAttempt{ID: id, PeerID: targetID, Started: now, Updated: now}
+	c.attemptsMu.Unlock()
+
+	log.Printf("connect attempt started attempt=%s target=%s", id, targetID)
+	go func() {
+		if _, err := manager.Connect(ctx, targetID, purpose); err != nil {
+			log.Printf("connect attempt failed attempt=%s target=%s err=%v", id, targetID, err)
+			c.updateAttempt(id, ConnectFailed, err)
+			return
+		}
+		c.updateAttempt(id, ConnectConnected, nil)
+	}()
+	return id, nil
+}
+
+// ConnectAttempt returns the attempt with id, while it is kept.
+func (c *Client) ConnectAttempt(id string) (ConnectAttempt, bool) {
+	c.attemptsMu.Lock()
+	defer c.attemptsMu.Unlock()
+	c.pruneAttemptsLocked()
+	a, ok := c.attempts[id]
+	if !ok {
+		return ConnectAttempt{}, false
+	}
+	return *a, true
+}
+
+// ConnectAttempts lists running and recently finished attempts, oldest
+// first.
+func (c *Client) ConnectAttempts() []ConnectAttempt {
+	c.attemptsMu.Lock()
+	defer c.attemptsMu.Unlock()
+	c.pruneAttemptsLocked()
+	list := make([]ConnectAttempt, 0, len(c.attempts))
+	for _, a := range c.attempts {
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started.Before(list[j].Started) })
+	return list
+}
+
+// connectProgress receives the manager's progress reports and publishes
+// them against the running attempt to peerID, if any.
+func (c *Client) connectProgress(peerID string, state ConnectState) {
+	id := ""
+	c.attemptsMu.Lock()
+	for _, a := range c.attempts {
+		if a.PeerID == peerID && !a.done() {
+			id = a.ID
+			break
+		}
+	}
+	c.attemptsMu.Unlock()
+	if id != "" {
+		c.updateAttempt(id, state, nil)
+		return
+	}
+	c.events.publish(Event{Kind: EventConnectProgress, PeerID: peerID, Detail: string(state)})
+}
+
+func (c *Client) updateAttempt(id string, state ConnectState, err error) {
+	c.attemptsMu.Lock()
+	a, ok := c.attempts[id]
+	if !ok || a.done() {
+		c.attemptsMu.Unlock()
+		return
+	}
+	a.State = state
+	a.Updated = time.Now()
+	if err != nil {
+		a.Err = err.Error()
+	}
+	peerID := a.PeerID
+	c.attemptsMu.Unlock()
+	c.events.publish(Event{Kind: EventConnectProgress, PeerID: peerID, Attempt: id, Detail: string(state), Err: err})
+}
+
+func (c *Client) pruneAttemptsLocked() {
+	for id, a := range c.attempts {
+		if a.done() && time.Since(a.Updated) > attemptRetention {
+			delete(c.attempts, id)
+		}
+	}
+}
+
+// Helpers
+func newAttemptID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/ice/v2"
+)
+
+// Connect paths of a finished report.
+const (
+	pathDirect     = "direct"
+	pathICE        = "ice"
+	pathICERelayed = "ice-relayed"
+)
+
+// ConnectReport records how one connect went, for bug reports about
+// peers that won't connect.
+type ConnectReport struct {
+	PeerID           string         `json:"peer_id"`
+	Methods          []string       `json:"methods"`
+	Steps            []ConnectStep  `json:"steps"`
+	LocalCandidates  map[string]int `json:"local_candidates,omitempty"`
+	RemoteCandidates map[string]int `json:"remote_candidates,omitempty"`
+	SelectedPair     string         `json:"selected_pair,omitempty"`
+	Path             string         `json:"path,omitempty"`
+	Err              string         `json:"error,omitempty"`
+	Started          time.Time      `json:"started"`
+	Duration         time.Duration  `json:"duration"`
+}
+
+// ConnectStep is one progress state of a connect and how long it lasted.
+type ConnectStep struct {
+	State    ConnectState  `json:"state"`
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// Connect reports
+//
+// A report is opened when Connect or ConnectAs starts and filled in from
+// the same points that report progress: every progress state becomes a
+// step, timed until the next one. When the connect returns, the report
+// is closed with the error, if any, and kept as the last report.
+type connectReports struct {
+	mu     sync.Mutex
+	active map[string]*connectReport
+	last   *ConnectReport
+}
+
+type connectReport struct {
+	ConnectReport
+	stepOpen    bool
+	stepStarted time.Time
+}
+
+func (r *connectReports) begin(peerID string) *connectReport {
+	report := &connectReport{ConnectReport: ConnectReport{PeerID: peerID, Started: time.Now()}}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		r.active = make(map[string]*connectReport)
+	}
+	r.active[peerID] = report
+	return report
+}
+
+// update runs fn on the open report for peerID, if there is one.
+func (r *connectReports) update(peerID string, fn func(*connectReport)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if report := r.active[peerID]; report != nil {
+		fn(report)
+	}
+}
+
+func (r *connectReports) finish(report *connectReport, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		report.Err = err.Error()
+	}
+	report.endStep(err)
+	report.Duration = time.Since(report.Started)
+	if r.active[report.PeerID] == report {
+		delete(r.active, report.PeerID)
+	}
+	done := report.ConnectReport
+	r.last = &done
+}
+
+func (r *connectReports) lastReport() (ConnectReport, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		return ConnectReport{}, false
+	}
+	return *r.last, true
+}
+
+// step ends the current step and starts state.
+func (r *connectReport) step(state ConnectState) {
+	r.endStep(nil)
+	r.Steps = append(r.Steps, ConnectStep{State: state})
+	r.stepOpen = true
+	r.stepStarted = time.Now()
+}
+
+func (r *connectReport) endStep(err error) {
+	if !r.stepOpen {
+		return
+	}
+	last := &r.Steps[len(r.Steps)-1]
+	last.Duration = time.Since(r.stepStarted)
+	if err != nil {
+		last.Err = err.Error()
+	}
+	r.stepOpen = false
+}
+
+func (r *connectReport) tried(method string) {
+	r.Methods = append(r.Methods, method)
+}
+
+// LastConnectReport returns the report of the latest finished connect.
+func (m *ConnectionManager) LastConnectReport() (ConnectReport, bool) {
+	return m.reports.lastReport()
+}
+
+// recordICE fills in the candidates of an ICE connect once its checks
+// are over, and the selected pair and path if they succeeded.
+func (m *ConnectionManager) recordICE(peerID string, agent *ice.Agent) {
+	local, _ := agent.GetLocalCandidates()
+	remote, _ := agent.GetRemoteCandidates()
+	pair, err := agent.GetSelectedCandidatePair()
+	m.reports.update(peerID, func(r *connectReport) {
+		r.LocalCandidates = countCandidateTypes(local)
+		r.RemoteCandidates = countCandidateTypes(remote)
+		if err != nil || pair == nil {
+			return
+		}
+		r.SelectedPair = pair.Local.Type().String() + " -> " + pair.Remote.Type().String()
+		r.Path = pathICE
+		if relayed(agent) {
+			r.Path = pathICERelayed
+		}
+	})
+}
+
+// Helpers
+func countCandidateTypes(candidates []ice.Candidate) map[string]int {
+	counts := make(map[string]int)
+	for _, c := range candidates {
+		counts[c.Type().String()]++
+	}
+	return counts
+}
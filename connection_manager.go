@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -17,18 +19,57 @@ const (
 	iceTTLSeconds         = 60
 	intentTTLSeconds      = 20
 	iceGatherTimeout      = 10 * time.Second
-	iceConnectTimeout     = 20 * time.Second
 	iceLookupPollInterval = 1 * time.Second
+	unregisterTimeout     = 5 * time.Second
 )
 
+// Tunable via flags; see main.
+var iceConnectTimeout = 20 * time.Second
+
+// configuredSTUNServers comes from the settings file and is used when
+// CHUTE_STUN_SERVER is unset. A reload can replace it while agents are
+// being created, so it is read and set under stunMu.
+var (
+	stunMu                sync.Mutex
+	configuredSTUNServers []string
+)
+
+func setConfiguredSTUNServers(servers []string) {
+	stunMu.Lock()
+	configuredSTUNServers = servers
+	stunMu.Unlock()
+}
+
 type ConnectionManager struct {
-	localID    string
-	serverAddr string
+	localID     string
+	serverAddr  string
+	displayName string
+	identity    ed25519.PrivateKey
 
 	sessionSetter func(*ChuteSession)
+	streamHandler func(io.Reader)
+	channels      map[string]func(peerID string, ch *Channel)
+	rpcHandlers   map[string]RPCHandler
+
+	pins       *pinStore
+	pinWarning func(*pinMismatchError)
+	usage      *usageStore
+	lastSeen   *lastSeenStore
 
 	iceMu    sync.Mutex
 	iceAgent *ice.Agent
+
+	direct        *directEndpoint
+	lan           *lanDiscovery
+	intentHandler func(IntentInfo)
+	progress      func(peerID string, state ConnectState)
+	reports       connectReports
+
+	turnMu    sync.Mutex
+	turnCreds TurnCredentials
+
+	offerMu sync.Mutex
+	offer   *pendingOffer
 }
 
 // Construction & wiring
@@ -43,65 +84,225 @@ func (m *ConnectionManager) SetSessionSetter(setter func(*ChuteSession)) {
 	m.sessionSetter = setter
 }
 
+func (m *ConnectionManager) SetIdentity(identity ed25519.PrivateKey) {
+	m.identity = identity
+}
+
+// SetPinStore enables trust-on-first-use checks for peer fingerprints.
+func (m *ConnectionManager) SetPinStore(store *pinStore) {
+	m.pins = store
+}
+
+// SetLastSeenStore records when peers are seen registered.
+func (m *ConnectionManager) SetLastSeenStore(store *lastSeenStore) {
+	m.lastSeen = store
+}
+
+// SetPinWarning registers fn to be told when a peer's fingerprint no
+// longer matches its pin.
+func (m *ConnectionManager) SetPinWarning(fn func(*pinMismatchError)) {
+	m.pinWarning = fn
+}
+
+// SetUsageStore enables per-peer traffic accounting.
+func (m *ConnectionManager) SetUsageStore(store *usageStore) {
+	m.usage = store
+}
+
+// ForgetPeer drops the pinned fingerprint for peerID.
+func (m *ConnectionManager) ForgetPeer(peerID string) (bool, error) {
+	if m.pins == nil {
+		return false, nil
+	}
+	return m.pins.forget(peerID)
+}
+
+func (m *ConnectionManager) SetDisplayName(name string) {
+	m.displayName = name
+}
+
+func (m *ConnectionManager) SetStreamHandler(handler func(io.Reader)) {
+	m.streamHandler = handler
+}
+
+// SetChannelHandler registers fn for the named channel on every session
+// created from now on.
+func (m *ConnectionManager) SetChannelHandler(name string, fn func(peerID string, ch *Channel)) {
+	if m.channels == nil {
+		m.channels = make(map[string]func(string, *Channel))
+	}
+	m.channels[name] = fn
+}
+
+// SetRPCHandler registers fn to answer calls to method on every session
+// created from now on.
+func (m *ConnectionManager) SetRPCHandler(method string, fn RPCHandler) {
+	if m.rpcHandlers == nil {
+		m.rpcHandlers = make(map[string]RPCHandler)
+	}
+	m.rpcHandlers[method] = fn
+}
+
+// SetIntentHandler registers fn to receive intents that arrive without
+// the rendezvous server, on the direct endpoint.
+func (m *ConnectionManager) SetIntentHandler(fn func(IntentInfo)) {
+	m.intentHandler = fn
+}
+
+// SetConnectProgress registers fn to be told each step of connects, by
+// the peer being connected to.
+func (m *ConnectionManager) SetConnectProgress(fn func(peerID string, state ConnectState)) {
+	m.progress = fn
+}
+
 // Public entrypoints
-func (m *ConnectionManager) Connect(targetID string) (*ChuteSession, error) {
+// Connect asks targetID to connect back. purpose is an optional note shown
+// to the receiving user, e.g. "wants to send you report.pdf".
+func (m *ConnectionManager) Connect(ctx context.Context, targetID, purpose string) (*ChuteSession, error) {
 	if targetID == "" {
 		return nil, errors.New("missing target id")
 	}
+	report := m.reports.begin(targetID)
+	session, err := m.connect(ctx, targetID, purpose)
+	m.reports.finish(report, err)
+	return session, err
+}
+
+func (m *ConnectionManager) connect(ctx context.Context, targetID, purpose string) (*ChuteSession, error) {
+	m.reportProgress(targetID, ConnectLookingUp)
+	if m.lan != nil {
+		m.reports.update(targetID, func(r *connectReport) { r.tried("lan") })
+		return m.connectLAN(ctx, targetID, purpose)
+	}
 
-	agent, localInfo, err := m.createICEAgent()
+	m.reports.update(targetID, func(r *connectReport) { r.tried("rendezvous") })
+	m.reportProgress(targetID, ConnectGathering)
+	agent, localInfo, err := m.createICEAgent(ctx, false)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := registerICE(m.serverAddr, m.localID, localInfo, iceTTLSeconds); err != nil {
+	if err := registerICE(ctx, m.serverAddr, m.localID, localInfo, iceTTLSeconds); err != nil {
 		_ = agent.Close()
 		return nil, err
 	}
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+	go m.refreshRegistration(refreshCtx, m.localID, localInfo)
 
-	if err := sendConnectIntent(m.serverAddr, m.localID, targetID, intentTTLSeconds); err != nil {
+	if err := sendConnectIntent(ctx, m.serverAddr, m.localID, targetID, intentTTLSeconds, m.displayName, purpose); err != nil {
 		log.Printf("connect intent failed target=%s err=%v", targetID, err)
 	}
 
-	remoteInfo, err := waitForICEInfo(m.serverAddr, targetID, iceConnectTimeout)
+	m.reportProgress(targetID, ConnectWaiting)
+	remoteInfo, err := waitForICEInfo(ctx, m.serverAddr, targetID, iceConnectTimeout)
 	if err != nil {
 		_ = agent.Close()
+		if ctx.Err() == nil {
+			err = m.lastSeen.explainUnreachable(targetID, err)
+		}
 		return nil, err
 	}
+	m.lastSeen.markRegistered(targetID)
+
+	return m.startICE(ctx, agent, m.localID, targetID, remoteInfo, serverICE(m.localID, targetID))
+}
+
+// AnswerIntent connects back to the sender of an accepted intent, over
+// the path the intent came in on.
+func (m *ConnectionManager) AnswerIntent(ctx context.Context, intent IntentInfo) (*ChuteSession, error) {
+	if intent.Direct != nil {
+		return m.connectDirect(ctx, intent)
+	}
+	return m.ConnectWithPeerInfo(ctx, intent.IceInfo)
+}
 
-	return m.startICE(agent, targetID, remoteInfo)
+func (m *ConnectionManager) ConnectWithPeerInfo(ctx context.Context, info IceInfo) (*ChuteSession, error) {
+	return m.ConnectAs(ctx, m.localID, info)
 }
 
-func (m *ConnectionManager) ConnectWithPeerInfo(info IceInfo) (*ChuteSession, error) {
+// ConnectAs answers a connect intent under localID instead of the
+// client's own id, for intents addressed to a drop code.
+func (m *ConnectionManager) ConnectAs(ctx context.Context, localID string, info IceInfo) (*ChuteSession, error) {
 	if info.ID == "" {
 		return nil, errors.New("missing peer id")
 	}
+	report := m.reports.begin(info.ID)
+	session, err := m.connectAs(ctx, localID, info)
+	m.reports.finish(report, err)
+	return session, err
+}
 
-	agent, localInfo, err := m.createICEAgent()
+func (m *ConnectionManager) connectAs(ctx context.Context, localID string, info IceInfo) (*ChuteSession, error) {
+	m.reports.update(info.ID, func(r *connectReport) { r.tried("rendezvous") })
+	m.reportProgress(info.ID, ConnectGathering)
+	agent, localInfo, err := m.createICEAgent(ctx, false)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := registerICE(m.serverAddr, m.localID, localInfo, iceTTLSeconds); err != nil {
+	if err := registerICE(ctx, m.serverAddr, localID, localInfo, iceTTLSeconds); err != nil {
 		_ = agent.Close()
 		return nil, err
 	}
+	refreshCtx, stopRefresh := context.WithCancel(ctx)
+	defer stopRefresh()
+	go m.refreshRegistration(refreshCtx, localID, localInfo)
 
-	return m.startICE(agent, info.ID, info)
+	return m.startICE(ctx, agent, localID, info.ID, info, serverICE(localID, info.ID))
+}
+
+// refreshRegistration re-registers info every half TTL until ctx is done,
+// so a connect attempt that outlives one registration stays discoverable.
+func (m *ConnectionManager) refreshRegistration(ctx context.Context, localID string, info IceInfo) {
+	ticker := time.NewTicker(iceTTLSeconds * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := registerICE(ctx, m.serverAddr, localID, info, iceTTLSeconds); err != nil && ctx.Err() == nil {
+				log.Printf("registration refresh failed client_id=%s err=%v", localID, err)
+			}
+		}
+	}
 }
 
 // ICE setup & gather
-func (m *ConnectionManager) createICEAgent() (*ice.Agent, IceInfo, error) {
-	stunServer := stunServerAddr()
-	url, err := ice.ParseURL("stun:" + stunServer)
-	if err != nil {
-		return nil, IceInfo{}, err
+
+// createICEAgent gathers candidates for a new attempt. A serverless
+// agent, signaled by pasting offers by hand, gets no relay from the
+// server and keeps checking for as long as an offer is valid, since the
+// other side may take minutes to paste the answer.
+func (m *ConnectionManager) createICEAgent(ctx context.Context, serverless bool) (*ice.Agent, IceInfo, error) {
+	// The agent queries every STUN server in parallel, so one unreachable
+	// server only costs its own reflexive candidate.
+	var urls []*ice.URL
+	for _, server := range stunServerAddrs() {
+		url, err := ice.ParseURL("stun:" + server)
+		if err != nil {
+			log.Printf("skipping stun server=%s err=%v", server, err)
+			continue
+		}
+		urls = append(urls, url)
+	}
+	if len(urls) == 0 {
+		return nil, IceInfo{}, errors.New("no usable stun server")
 	}
-	agent, err := ice.NewAgent(&ice.AgentConfig{
+	config := &ice.AgentConfig{
 		NetworkTypes:    []ice.NetworkType{ice.NetworkTypeUDP4},
-		Urls:            []*ice.URL{url},
 		IncludeLoopback: true,
-	})
+		LoggerFactory:   iceLoggerFactory{},
+	}
+	if serverless {
+		failed := offerTimeout
+		config.FailedTimeout = &failed
+	} else {
+		urls = append(urls, m.turnURLs(ctx)...)
+	}
+	config.Urls = urls
+	agent, err := ice.NewAgent(config)
 	if err != nil {
 		return nil, IceInfo{}, err
 	}
@@ -130,6 +331,7 @@ func gatherCandidates(agent *ice.Agent) ([]string, error) {
 	var (
 		mu         sync.Mutex
 		candidates []string
+		reflexive  int
 		done       = make(chan struct{})
 	)
 
@@ -141,6 +343,9 @@ func gatherCandidates(agent *ice.Agent) ([]string, error) {
 		log.Printf("ICE candidate gathered: %s", c.Marshal())
 		mu.Lock()
 		candidates = append(candidates, c.Marshal())
+		if c.Type() == ice.CandidateTypeServerReflexive {
+			reflexive++
+		}
 		mu.Unlock()
 	})
 
@@ -154,11 +359,67 @@ func gatherCandidates(agent *ice.Agent) ([]string, error) {
 		return nil, errors.New("ice candidate gathering timed out")
 	}
 
+	mu.Lock()
+	defer mu.Unlock()
+	if reflexive == 0 {
+		log.Printf("no STUN server answered, only local candidates gathered (see the stun command)")
+	}
+
 	return candidates, nil
 }
 
+// turnURLs returns relay URLs from the rendezvous server, reusing cached
+// credentials until they expire. Failures only cost the relay candidates.
+func (m *ConnectionManager) turnURLs(ctx context.Context) []*ice.URL {
+	m.turnMu.Lock()
+	creds := m.turnCreds
+	m.turnMu.Unlock()
+
+	if time.Now().After(creds.Expires) {
+		fetched, ok, err := fetchTURNCredentials(ctx, m.serverAddr, m.localID)
+		if err != nil {
+			log.Printf("turn credentials failed: %v", err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		creds = fetched
+		m.turnMu.Lock()
+		m.turnCreds = creds
+		m.turnMu.Unlock()
+	}
+
+	var urls []*ice.URL
+	for _, raw := range creds.URLs {
+		url, err := ice.ParseURL(raw)
+		if err != nil {
+			log.Printf("skipping turn url=%s err=%v", raw, err)
+			continue
+		}
+		url.Username = creds.Username
+		url.Password = creds.Credential
+		urls = append(urls, url)
+	}
+	return urls
+}
+
 // ICE connect & QUIC bootstrap
-func (m *ConnectionManager) startICE(agent *ice.Agent, targetID string, remote IceInfo) (*ChuteSession, error) {
+
+// iceStart says how an attempt was signaled and which side leads it.
+type iceStart struct {
+	controlling bool          // dial ICE and open the QUIC session
+	timeout     time.Duration // for ICE checks and the QUIC handshake
+	viaServer   bool          // unregister from the server when done
+}
+
+// serverICE is the usual attempt signaled through the rendezvous server,
+// where the lower id leads.
+func serverICE(localID, targetID string) iceStart {
+	return iceStart{controlling: localID < targetID, timeout: iceConnectTimeout, viaServer: true}
+}
+
+func (m *ConnectionManager) startICE(ctx context.Context, agent *ice.Agent, localID, targetID string, remote IceInfo, start iceStart) (*ChuteSession, error) {
 	m.setICEAgent(agent)
 	agent.OnConnectionStateChange(func(state ice.ConnectionState) {
 		log.Printf("ICE state for %s: %s", targetID, state.String())
@@ -179,94 +440,186 @@ func (m *ConnectionManager) startICE(agent *ice.Agent, targetID string, remote I
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), iceConnectTimeout)
+	dialCtx, cancel := context.WithTimeout(ctx, start.timeout)
 	defer cancel()
 
+	m.reportProgress(targetID, ConnectPunching)
 	var conn *ice.Conn
 	var err error
-	if m.localID < targetID {
-		conn, err = agent.Dial(ctx, remote.Ufrag, remote.Password)
+	if start.controlling {
+		conn, err = agent.Dial(dialCtx, remote.Ufrag, remote.Password)
 	} else {
-		conn, err = agent.Accept(ctx, remote.Ufrag, remote.Password)
+		conn, err = agent.Accept(dialCtx, remote.Ufrag, remote.Password)
 	}
+	m.recordICE(targetID, agent)
 	if err != nil {
 		_ = agent.Close()
 		return nil, err
 	}
+	if relayed(agent) {
+		m.reportProgress(targetID, ConnectRelayed)
+	}
 
-	packetConn := newICEPacketConn(conn)
-	session := NewChuteSession(packetConn, m.localID)
-	session.SetOnClose(func() {
-		m.closeICE()
-		_ = unregisterWithServer(m.serverAddr, m.localID)
+	counted := newCountingConn(wrapPacketConn(newICEPacketConn(conn)))
+	session := NewChuteSession(counted, localID, m.identity)
+	if m.streamHandler != nil {
+		session.SetStreamHandler(m.streamHandler)
+	}
+	for name, fn := range m.channels {
+		session.SetChannelHandler(name, fn)
+	}
+	for method, fn := range m.rpcHandlers {
+		session.SetRPCHandler(method, fn)
+	}
+	session.SetPeerVerifier(m.verifyPeer)
+	session.OnClose(func() {
+		m.closeICE(agent)
+		if !start.viaServer {
+			return
+		}
+		unregisterCtx, cancel := context.WithTimeout(context.Background(), unregisterTimeout)
+		defer cancel()
+		_ = unregisterWithServer(unregisterCtx, m.serverAddr, localID)
 	})
 
-	isInitiator := m.localID < targetID
-	if isInitiator {
+	if start.controlling {
 		remoteEndpoint, err := endpointFromNetAddr(conn.RemoteAddr())
 		if err != nil {
 			_ = agent.Close()
+			_ = session.Close()
 			return nil, err
 		}
-		if err := session.ConnectWithContext(ctx, remoteEndpoint, targetID); err != nil {
+		if err := session.ConnectWithContext(dialCtx, remoteEndpoint, targetID); err != nil {
 			_ = agent.Close()
+			_ = session.Close()
 			return nil, err
 		}
+		m.trackUsage(targetID, counted, session)
 		if m.sessionSetter != nil {
 			m.sessionSetter(session)
 		}
 		return session, nil
 	}
 
-	session.Start()
-	if err := waitForSession(session, iceConnectTimeout); err != nil {
+	session.Start(ctx)
+	if err := waitForSession(dialCtx, session); err != nil {
 		_ = agent.Close()
+		_ = session.Close()
 		return nil, err
 	}
+	m.trackUsage(targetID, counted, session)
 	if m.sessionSetter != nil {
 		m.sessionSetter(session)
 	}
 	return session, nil
 }
 
+// trackUsage counts the session's traffic toward targetID until it closes.
+func (m *ConnectionManager) trackUsage(targetID string, counted *countingConn, session *ChuteSession) {
+	if m.usage == nil {
+		return
+	}
+	untrack := m.usage.track(targetID, counted)
+	session.OnClose(func() {
+		if err := untrack(); err != nil {
+			log.Printf("usage save failed peer_id=%s err=%v", targetID, err)
+		}
+	})
+}
+
 // ICE lifecycle
+func (m *ConnectionManager) verifyPeer(peerID, fingerprint string) error {
+	// Drop codes are single-use, so there is nothing to pin them to.
+	if m.pins == nil || isDropCode(peerID) {
+		return nil
+	}
+	err := m.pins.verify(peerID, fingerprint)
+	var mismatch *pinMismatchError
+	if errors.As(err, &mismatch) {
+		log.Printf("peer fingerprint mismatch peer_id=%s pinned=%s presented=%s", peerID, mismatch.Pinned, mismatch.Presented)
+		if m.pinWarning != nil {
+			m.pinWarning(mismatch)
+		}
+	}
+	return err
+}
+
 func (m *ConnectionManager) setICEAgent(agent *ice.Agent) {
 	m.iceMu.Lock()
 	m.iceAgent = agent
 	m.iceMu.Unlock()
 }
 
-func (m *ConnectionManager) closeICE() {
+// closeICE closes the agent of a finished session. It is the session's
+// own agent rather than the latest one, so a newer attempt is left alone
+// and the session's transport can finish closing.
+func (m *ConnectionManager) closeICE(agent *ice.Agent) {
 	m.iceMu.Lock()
-	agent := m.iceAgent
-	m.iceAgent = nil
+	if m.iceAgent == agent {
+		m.iceAgent = nil
+	}
 	m.iceMu.Unlock()
-	if agent != nil {
-		_ = agent.Close()
+	_ = agent.Close()
+}
+
+func (m *ConnectionManager) reportProgress(peerID string, state ConnectState) {
+	m.reports.update(peerID, func(r *connectReport) { r.step(state) })
+	if m.progress != nil {
+		m.progress(peerID, state)
 	}
 }
 
+// relayed reports whether the agent's selected pair goes through a TURN
+// relay.
+func relayed(agent *ice.Agent) bool {
+	pair, err := agent.GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return false
+	}
+	return pair.Local.Type() == ice.CandidateTypeRelay || pair.Remote.Type() == ice.CandidateTypeRelay
+}
+
 // Signaling helpers
-func waitForICEInfo(serverAddr, targetID string, timeout time.Duration) (IceInfo, error) {
+func waitForICEInfo(ctx context.Context, serverAddr, targetID string, timeout time.Duration) (IceInfo, error) {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
-		info, ok, err := lookupICE(serverAddr, targetID)
+		info, ok, err := lookupICE(ctx, serverAddr, targetID)
 		if err != nil {
 			return IceInfo{}, err
 		}
 		if ok {
 			return info, nil
 		}
-		time.Sleep(iceLookupPollInterval)
+		select {
+		case <-ctx.Done():
+			return IceInfo{}, ctx.Err()
+		case <-time.After(iceLookupPollInterval):
+		}
 	}
 	return IceInfo{}, fmt.Errorf("timed out waiting for ICE info for %s", targetID)
 }
 
-func stunServerAddr() string {
+// stunServerAddrs reads CHUTE_STUN_SERVER as a comma-separated list.
+func stunServerAddrs() []string {
 	if v := os.Getenv("CHUTE_STUN_SERVER"); v != "" {
-		return v
+		return splitServers(v)
 	}
-	return "stun.l.google.com:19302"
+	stunMu.Lock()
+	configured := configuredSTUNServers
+	stunMu.Unlock()
+	if len(configured) > 0 {
+		return configured
+	}
+	return []string{
+		"stun.l.google.com:19302",
+		"stun1.l.google.com:19302",
+		"stun.cloudflare.com:3478",
+	}
+}
+
+// wrapPacketConn lets the netsim build impair the session's packet conn.
+var wrapPacketConn = func(conn net.PacketConn) net.PacketConn {
+	return conn
 }
 
 // ICE -> net.PacketConn adapter
@@ -307,13 +660,19 @@ func (c *icePacketConn) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
 
-func waitForSession(session *ChuteSession, timeout time.Duration) error {
-	deadline := time.Now().Add(timeout)
-	for time.Now().Before(deadline) {
-		if session.IsConnected() {
+// waitForSession waits until the peer's connection has been identified
+// and verified.
+func waitForSession(ctx context.Context, session *ChuteSession) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if session.IsConnected() && session.CurrentPeerID() != "" {
 			return nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return errors.New("timeout waiting for QUIC connection")
+		case <-ticker.C:
+		}
 	}
-	return errors.New("timeout waiting for QUIC connection")
 }
@@ -0,0 +1,684 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultControlAddr = "127.0.0.1:7717"
+	controlInfoFile    = "control.json"
+	controlTimeout     = 2 * time.Minute
+	controlWaitTimeout = 30 * time.Second
+)
+
+// controlInfo is written to the config dir so chutectl, and later
+// invocations of chute, can find and authenticate to the running
+// instance.
+type controlInfo struct {
+	Addr  string `json:"addr"`
+	Token string `json:"token"`
+	PID   int    `json:"pid"`
+}
+
+// Control API
+//
+// A running client serves a small JSON API on a loopback address so other
+// processes can drive the same session instead of registering a second
+// client. Every request needs the bearer token from control.json, which
+// only the owning user can read.
+func startControlServer(ctx context.Context, addr, dir string, client *Client, manager *ConnectionManager) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	token, err := newControlToken()
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	info := controlInfo{Addr: listener.Addr().String(), Token: token, PID: os.Getpid()}
+	if err := writeControlInfo(dir, info); err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	api := &controlAPI{ctx: ctx, client: client, manager: manager}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", api.status)
+	mux.HandleFunc("/pending", api.pending)
+	mux.HandleFunc("/peers", api.peers)
+	mux.HandleFunc("/peers/{id}/settings", api.peerSettings)
+	mux.HandleFunc("/peers/{id}/files", api.remoteFiles)
+	mux.HandleFunc("/peers/{id}/pull", api.pull)
+	mux.HandleFunc("/shares", api.shares)
+	mux.HandleFunc("/directory", api.directory)
+	mux.HandleFunc("/shares/{name}/remove", api.removeShare)
+	mux.HandleFunc("/shares/{name}/grant", api.grantShare)
+	mux.HandleFunc("/shares/{name}/revoke", api.revokeShare)
+	mux.HandleFunc("/messages", api.messages)
+	mux.HandleFunc("/usage/reset", api.resetUsage)
+	mux.HandleFunc("/connect", api.connect)
+	mux.HandleFunc("/connect-direct", api.connectDirect)
+	mux.HandleFunc("/attempts", api.attempts)
+	mux.HandleFunc("/connect/last-report", api.lastConnectReport)
+	mux.HandleFunc("/send", api.send)
+	mux.HandleFunc("/sendfile", api.sendFile)
+	mux.HandleFunc("/export", api.export)
+	mux.HandleFunc("/drop", api.createDrop)
+	mux.HandleFunc("/drops", api.drops)
+	mux.HandleFunc("/lan", api.lanPeers)
+	mux.HandleFunc("/offer", api.createOffer)
+	mux.HandleFunc("/paste", api.paste)
+	mux.HandleFunc("/accept", api.accept)
+	mux.HandleFunc("/decline", api.decline)
+	mux.HandleFunc("/debug/loglevel", serveLogLevel)
+	mux.HandleFunc("/logs", api.logs)
+	mux.HandleFunc("/reload", api.reload)
+	server := &http.Server{Handler: requireToken(token, mux)}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+		removeControlInfo(dir, info)
+	}()
+	go func() {
+		log.Printf("control api listening addr=%s", info.Addr)
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("control api failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handlers
+type controlAPI struct {
+	ctx     context.Context
+	client  *Client
+	manager *ConnectionManager
+}
+
+type controlRequest struct {
+	ID         string `json:"id,omitempty"`
+	Purpose    string `json:"purpose,omitempty"`
+	Addr       string `json:"addr,omitempty"`
+	Blob       string `json:"blob,omitempty"`
+	Message    string `json:"message,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Dest       string `json:"dest,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+type messagesResponse struct {
+	Messages []ReceivedMessage `json:"messages"`
+	Next     uint64            `json:"next"`
+}
+
+type logsResponse struct {
+	Lines []string `json:"lines"`
+}
+
+type pendingResponse struct {
+	Requests []IntentInfo    `json:"requests"`
+	Files    []FileOfferInfo `json:"files"`
+}
+
+func (a *controlAPI) status(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, a.client.Status())
+}
+
+func (a *controlAPI) pending(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, pendingResponse{Requests: a.client.Pending(), Files: a.client.PendingFiles()})
+}
+
+func (a *controlAPI) peers(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, a.client.Peers())
+}
+
+// peerSettings shows a peer's overrides; POST with key and value sets
+// one, an empty value clearing it.
+func (a *controlAPI) peerSettings(w http.ResponseWriter, r *http.Request) {
+	peerID := r.PathValue("id")
+	if r.Method == http.MethodGet {
+		settings, err := a.client.PeerSettings(peerID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeControlJSON(w, settings)
+		return
+	}
+	req, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	settings, err := a.client.UpdatePeerSetting(peerID, req.Key, req.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeControlJSON(w, settings)
+}
+
+// remoteFiles lists the directory path shared by the connected peer.
+func (a *controlAPI) remoteFiles(w http.ResponseWriter, r *http.Request) {
+	list, err := a.client.RemoteFiles(r.Context(), r.PathValue("id"), r.URL.Query().Get("path"))
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, list)
+}
+
+// pull asks the connected peer to send the shared file at path.
+func (a *controlAPI) pull(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	entry, err := a.client.Pull(ctx, r.PathValue("id"), req.Path)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, entry)
+}
+
+// directory searches the public directory for the display name q.
+func (a *controlAPI) directory(w http.ResponseWriter, r *http.Request) {
+	results, err := a.client.SearchDirectory(r.Context(), r.URL.Query().Get("q"))
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	if results == nil {
+		results = []DirectoryEntry{}
+	}
+	writeControlJSON(w, results)
+}
+
+// shares lists the shared folders; POST with name and path adds one.
+func (a *controlAPI) shares(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		shares := a.client.Shares()
+		if shares == nil {
+			shares = []Share{}
+		}
+		writeControlJSON(w, shares)
+		return
+	}
+	req, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	if !filepath.IsAbs(req.Path) {
+		http.Error(w, "path must be absolute", http.StatusBadRequest)
+		return
+	}
+	share, err := a.client.AddShare(req.Name, req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeControlJSON(w, share)
+}
+
+func (a *controlAPI) removeShare(w http.ResponseWriter, r *http.Request) {
+	_, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	if err := a.client.RemoveShare(r.PathValue("name")); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, map[string]string{"status": "removed"})
+}
+
+// grantShare gives the peer id access to the share.
+func (a *controlAPI) grantShare(w http.ResponseWriter, r *http.Request) {
+	req, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	share, err := a.client.GrantShare(r.PathValue("name"), req.ID)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, share)
+}
+
+func (a *controlAPI) revokeShare(w http.ResponseWriter, r *http.Request) {
+	req, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	share, err := a.client.RevokeShare(r.PathValue("name"), req.ID)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, share)
+}
+
+// messages reads the receive spool. Pass the returned next value as after
+// to get only newer messages; wait=1 holds the request open until one
+// arrives or controlWaitTimeout passes.
+func (a *controlAPI) messages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var after uint64
+	if v := query.Get("after"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad after", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	limit := 100
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), controlWaitTimeout)
+	defer cancel()
+	messages := a.client.ReceivedMessages(ctx, after, limit, query.Get("wait") == "1")
+	next := after
+	if len(messages) > 0 {
+		next = messages[len(messages)-1].Seq
+	}
+	if messages == nil {
+		messages = []ReceivedMessage{}
+	}
+	writeControlJSON(w, messagesResponse{Messages: messages, Next: next})
+}
+
+func (a *controlAPI) createDrop(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	var ttl time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, "bad ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	drop, err := a.client.CreateDrop(ctx, ttl)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, drop)
+}
+
+func (a *controlAPI) drops(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, a.client.Drops())
+}
+
+// logs returns the newest log lines kept in memory, limit of them when
+// given.
+func (a *controlAPI) logs(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "bad limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	writeControlJSON(w, logsResponse{Lines: recentLogs.last(limit)})
+}
+
+func (a *controlAPI) lanPeers(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, a.manager.LANPeers())
+}
+
+func (a *controlAPI) createOffer(w http.ResponseWriter, r *http.Request) {
+	_, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	offer, err := a.manager.CreateOffer(ctx)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, map[string]string{"offer": offer})
+}
+
+// paste answers an offer in the background, so the attempt outlives
+// the request and runs under the server's context.
+func (a *controlAPI) paste(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	blob, err := decodeSignalBlob(req.Blob)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	if blob.Kind == "offer" {
+		ctx = a.ctx
+	}
+	answer, _, err := a.manager.Paste(ctx, req.Blob)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	if answer != "" {
+		writeControlJSON(w, map[string]string{"answer": answer})
+		return
+	}
+	writeControlJSON(w, a.client.Status())
+}
+
+func (a *controlAPI) export(w http.ResponseWriter, r *http.Request) {
+	req, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	path, err := a.client.ExportFile(req.Path, req.Dest)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, map[string]string{"path": path})
+}
+
+func (a *controlAPI) resetUsage(w http.ResponseWriter, r *http.Request) {
+	req, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	if err := a.client.ResetUsage(req.ID); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, a.client.Status())
+}
+
+func (a *controlAPI) reload(w http.ResponseWriter, r *http.Request) {
+	_, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	if err := a.client.ReloadSettings(); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, a.client.Status())
+}
+
+// connect starts an attempt under the server's context and returns it
+// at once; its progress is at /attempts?id=.
+func (a *controlAPI) connect(w http.ResponseWriter, r *http.Request) {
+	req, _, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	id, err := a.client.ConnectAsync(a.ctx, a.manager, req.ID, req.Purpose)
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	attempt, _ := a.client.ConnectAttempt(id)
+	writeControlJSON(w, attempt)
+}
+
+func (a *controlAPI) lastConnectReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := a.manager.LastConnectReport()
+	if !ok {
+		http.Error(w, "no connect has finished yet", http.StatusNotFound)
+		return
+	}
+	writeControlJSON(w, report)
+}
+
+// attempts lists recent connect attempts, or the one given by id.
+func (a *controlAPI) attempts(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeControlJSON(w, a.client.ConnectAttempts())
+		return
+	}
+	attempt, ok := a.client.ConnectAttempt(id)
+	if !ok {
+		http.Error(w, "unknown attempt", http.StatusNotFound)
+		return
+	}
+	writeControlJSON(w, attempt)
+}
+
+func (a *controlAPI) connectDirect(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	if _, err := a.manager.ConnectDirect(ctx, req.Addr, req.Purpose); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, a.client.Status())
+}
+
+func (a *controlAPI) send(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	state, err := a.client.SendMessage(ctx, req.ID, []byte(req.Message))
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, map[string]string{"delivery": state.String()})
+}
+
+func (a *controlAPI) sendFile(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	if !filepath.IsAbs(req.Path) {
+		http.Error(w, "path must be absolute", http.StatusBadRequest)
+		return
+	}
+	if err := a.client.SendFile(ctx, req.ID, req.Path, req.Passphrase); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, map[string]string{"status": "sent"})
+}
+
+func (a *controlAPI) accept(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	if offer, ok, err := a.client.AcceptFile(req.ID, req.Passphrase); ok {
+		if err != nil {
+			writeControlError(w, err)
+			return
+		}
+		writeControlJSON(w, offer)
+		return
+	}
+	if _, err := a.client.Accept(ctx, a.manager, req.ID); err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, a.client.Status())
+}
+
+func (a *controlAPI) decline(w http.ResponseWriter, r *http.Request) {
+	req, ctx, cancel, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+	declined, err := a.client.Decline(ctx, a.manager, req.ID, req.Reason)
+	if declined == "" {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, map[string]string{"declined": declined})
+}
+
+// decode accepts POST requests only and bounds them by controlTimeout.
+func (a *controlAPI) decode(w http.ResponseWriter, r *http.Request) (controlRequest, context.Context, context.CancelFunc, bool) {
+	var req controlRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return req, nil, nil, false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return req, nil, nil, false
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, controlTimeout)
+	return req, ctx, cancel, true
+}
+
+func writeControlJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeControlError maps the typed errors to statuses chutectl can act on.
+func writeControlError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var rpcErr *RPCError
+	switch {
+	case errors.Is(err, ErrNoSession):
+		status = http.StatusConflict
+	case errors.Is(err, ErrBusy):
+		status = http.StatusConflict
+	case errors.Is(err, ErrPeerGone):
+		status = http.StatusBadGateway
+	case errors.Is(err, errFileRefused):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrPassphraseRequired), errors.Is(err, ErrBadPassphrase):
+		status = http.StatusForbidden
+	case errors.Is(err, ErrIDTaken):
+		status = http.StatusConflict
+	case errors.Is(err, ErrIntentExpired):
+		status = http.StatusGone
+	case errors.Is(err, ErrRateLimited):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, ErrDirectoryUnsupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, errNoShare):
+		status = http.StatusNotFound
+	case errors.As(err, &rpcErr):
+		status = http.StatusBadGateway
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// Discovery file
+func newControlToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func writeControlInfo(dir string, info controlInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, controlInfoFile), data, 0o600)
+}
+
+func readControlInfo(dir string) (controlInfo, error) {
+	var info controlInfo
+	data, err := os.ReadFile(filepath.Join(dir, controlInfoFile))
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// removeControlInfo deletes the discovery file unless another instance
+// has replaced it since.
+func removeControlInfo(dir string, info controlInfo) {
+	current, err := readControlInfo(dir)
+	if err == nil && current.Token == info.Token {
+		_ = os.Remove(filepath.Join(dir, controlInfoFile))
+	}
+}
+
+// isLoopbackAddr reports whether addr only listens locally.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
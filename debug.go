@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+const defaultDebugAddr = "127.0.0.1:6060"
+
+// Debug endpoints
+func startDebugServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/loglevel", serveLogLevel)
+
+	go func() {
+		log.Printf("debug server listening addr=%s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("debug server failed: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,47 @@
+package main
+
+import "time"
+
+const sentHistoryLimit = 100
+
+// DeliveryState tracks how far an outgoing message got. Written means the
+// bytes reached the stream; Delivered means the peer acknowledged queueing
+// them for the user.
+type DeliveryState int
+
+const (
+	DeliveryPending DeliveryState = iota
+	DeliveryWritten
+	DeliveryDelivered
+	DeliveryRead
+	DeliveryFailed
+)
+
+func (d DeliveryState) String() string {
+	switch d {
+	case DeliveryPending:
+		return "pending"
+	case DeliveryWritten:
+		return "written"
+	case DeliveryDelivered:
+		return "delivered"
+	case DeliveryRead:
+		return "read"
+	case DeliveryFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// SentMessage is the client's record of one SendMessage call.
+type SentMessage struct {
+	ID     uint64
+	PeerID string
+	Bytes  int
+	State  DeliveryState
+	SentAt time.Time
+
+	session *ChuteSession
+	peerSeq uint64
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+const directDatagramLimit = 1200
+
+// directMagic starts every datagram that is not QUIC. Its first byte has
+// the two high bits clear, which is how the transport tells such packets
+// apart from QUIC.
+var directMagic = []byte("\x00chute1")
+
+// directDatagram is a small JSON message sent beside QUIC on the direct
+// endpoint, or broadcast by LAN discovery.
+type directDatagram struct {
+	Kind        string `json:"kind"`
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name,omitempty"`
+	Purpose     string `json:"purpose,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+// Direct endpoint
+//
+// The direct endpoint is one UDP socket carrying both QUIC and intent
+// datagrams, so peers that can reach each other's address need no
+// rendezvous server. A requester sends an intent from its own socket;
+// accepting dials QUIC back to the address the intent came from. The
+// requester only lets in connections from addresses it sent an intent
+// to, just as an ICE session only forms after both sides swapped
+// credentials.
+type directEndpoint struct {
+	conn      *net.UDPConn
+	counter   *addrCounter
+	transport *quic.Transport
+	listener  *quic.Listener
+
+	mu       sync.Mutex
+	expected map[string]*directRequest
+}
+
+var errDirectDisabled = errors.New("direct connections are not enabled; start with -direct-port")
+
+// directRequest is an outgoing intent waiting for the peer to connect
+// back or decline.
+type directRequest struct {
+	peerID string
+	result chan directResult
+}
+
+type directResult struct {
+	session *ChuteSession
+	err     error
+}
+
+// EnableDirect opens the direct endpoint on port, or a free port when
+// port is 0, and serves it until ctx is done.
+func (m *ConnectionManager) EnableDirect(ctx context.Context, port int) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return err
+	}
+	counter := &addrCounter{PacketConn: wrapPacketConn(conn), peers: make(map[string]*countingConn)}
+	transport := &quic.Transport{Conn: counter}
+	listener, err := transport.Listen(serverTLSConfig(m.identity), quicConfig())
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	m.direct = &directEndpoint{
+		conn:      conn,
+		counter:   counter,
+		transport: transport,
+		listener:  listener,
+		expected:  make(map[string]*directRequest),
+	}
+	supervise(ctx, "direct accept", m.acceptDirect)
+	supervise(ctx, "direct datagrams", m.readDirectDatagrams)
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+		_ = transport.Close()
+	}()
+	log.Printf("direct endpoint listening addr=%s", conn.LocalAddr())
+	return nil
+}
+
+// DirectPort is the UDP port of the direct endpoint, or 0 when disabled.
+func (m *ConnectionManager) DirectPort() int {
+	if m.direct == nil {
+		return 0
+	}
+	return m.direct.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// ConnectDirect asks the client whose direct endpoint is at addr
+// (host:port) to connect back, without any lookup. Whoever answers is
+// checked against its pin like any other peer.
+func (m *ConnectionManager) ConnectDirect(ctx context.Context, addr, purpose string) (*ChuteSession, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	if udpAddr.Port == 0 || udpAddr.IP == nil {
+		return nil, fmt.Errorf("direct address needs a host and port: %s", addr)
+	}
+	return m.requestDirect(ctx, udpAddr, "", purpose)
+}
+
+// requestDirect sends an intent to addr and waits for the peer to
+// connect back. peerID, when known, is the only id the connection may
+// present.
+func (m *ConnectionManager) requestDirect(ctx context.Context, addr *net.UDPAddr, peerID, purpose string) (*ChuteSession, error) {
+	if m.direct == nil {
+		return nil, errDirectDisabled
+	}
+	key := addr.String()
+	req := &directRequest{peerID: peerID, result: make(chan directResult, 1)}
+	m.direct.mu.Lock()
+	m.direct.expected[key] = req
+	m.direct.mu.Unlock()
+	defer func() {
+		m.direct.mu.Lock()
+		if m.direct.expected[key] == req {
+			delete(m.direct.expected, key)
+		}
+		m.direct.mu.Unlock()
+	}()
+
+	intent := directDatagram{Kind: "intent", ID: m.localID, DisplayName: m.displayName, Purpose: purpose}
+	if err := m.sendDirectDatagram(addr, intent); err != nil {
+		return nil, err
+	}
+	log.Printf("direct intent sent addr=%s", key)
+	m.reportProgress(peerID, ConnectWaiting)
+
+	waitCtx, cancel := context.WithTimeout(ctx, iceConnectTimeout)
+	defer cancel()
+	select {
+	case res := <-req.result:
+		return res.session, res.err
+	case <-waitCtx.Done():
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("timed out waiting for %s to accept", key)
+	}
+}
+
+// connectDirect answers an intent that arrived on the direct endpoint by
+// dialing back to where it came from.
+func (m *ConnectionManager) connectDirect(ctx context.Context, intent IntentInfo) (*ChuteSession, error) {
+	if m.direct == nil {
+		return nil, errDirectDisabled
+	}
+	session := m.newDirectSession(m.verifyPeer)
+	dialCtx, cancel := context.WithTimeout(ctx, iceConnectTimeout)
+	defer cancel()
+	endpoint := PeerEndpoint{IP: intent.Direct.IP.String(), Port: intent.Direct.Port}
+	if err := session.ConnectWithContext(dialCtx, endpoint, intent.ID); err != nil {
+		return nil, err
+	}
+	m.trackDirect(intent.ID, intent.Direct, session)
+	if m.sessionSetter != nil {
+		m.sessionSetter(session)
+	}
+	return session, nil
+}
+
+// declineDirect tells the requester of a direct intent it was declined.
+func (m *ConnectionManager) declineDirect(intent IntentInfo, reason string) error {
+	if m.direct == nil {
+		return errDirectDisabled
+	}
+	return m.sendDirectDatagram(intent.Direct, directDatagram{Kind: "decline", ID: m.localID, Reason: reason})
+}
+
+func (m *ConnectionManager) acceptDirect(ctx context.Context) error {
+	for {
+		conn, err := m.direct.listener.Accept(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("direct accept: %w", err)
+		}
+		go m.adoptDirect(ctx, conn)
+	}
+}
+
+func (m *ConnectionManager) adoptDirect(ctx context.Context, conn quic.Connection) {
+	key := conn.RemoteAddr().String()
+	m.direct.mu.Lock()
+	req := m.direct.expected[key]
+	delete(m.direct.expected, key)
+	m.direct.mu.Unlock()
+	if req == nil {
+		log.Printf("direct connection not expected, closing remote=%s", key)
+		_ = conn.CloseWithError(0, "unexpected")
+		return
+	}
+
+	session := m.newDirectSession(func(peerID, fingerprint string) error {
+		if req.peerID != "" && peerID != req.peerID {
+			return fmt.Errorf("expected %s, got %s", req.peerID, peerID)
+		}
+		return m.verifyPeer(peerID, fingerprint)
+	})
+	if !session.Adopt(ctx, conn) {
+		req.result <- directResult{err: errors.New("direct handshake failed")}
+		return
+	}
+	peerID := session.CurrentPeerID()
+	m.trackDirect(peerID, conn.RemoteAddr(), session)
+	if m.sessionSetter != nil {
+		m.sessionSetter(session)
+	}
+	req.result <- directResult{session: session}
+}
+
+func (m *ConnectionManager) readDirectDatagrams(ctx context.Context) error {
+	buf := make([]byte, directDatagramLimit)
+	for {
+		n, from, err := m.direct.transport.ReadNonQUICPacket(ctx, buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("direct datagrams: %w", err)
+		}
+		msg, ok := decodeDirectDatagram(buf[:n])
+		if !ok || validateClientID(msg.ID) != nil {
+			continue
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		switch msg.Kind {
+		case "intent":
+			log.Printf("direct intent received peer_id=%s addr=%s", msg.ID, addr)
+			if m.intentHandler != nil {
+				m.intentHandler(IntentInfo{
+					IceInfo:     IceInfo{ID: msg.ID},
+					DisplayName: msg.DisplayName,
+					Purpose:     msg.Purpose,
+					Direct:      addr,
+				})
+			}
+		case "decline":
+			m.direct.mu.Lock()
+			req := m.direct.expected[addr.String()]
+			delete(m.direct.expected, addr.String())
+			m.direct.mu.Unlock()
+			if req == nil {
+				continue
+			}
+			err := fmt.Errorf("%s declined", msg.ID)
+			if msg.Reason != "" {
+				err = fmt.Errorf("%s declined: %s", msg.ID, msg.Reason)
+			}
+			req.result <- directResult{err: err}
+		}
+	}
+}
+
+// trackDirect counts the traffic exchanged with addr toward peerID while
+// the session lasts.
+func (m *ConnectionManager) trackDirect(peerID string, addr net.Addr, session *ChuteSession) {
+	counted, release := m.direct.counter.count(addr)
+	session.OnClose(release)
+	m.trackUsage(peerID, counted, session)
+}
+
+func (m *ConnectionManager) newDirectSession(verify func(peerID, fingerprint string) error) *ChuteSession {
+	session := newTransportSession(m.direct.transport, m.localID, m.identity)
+	if m.streamHandler != nil {
+		session.SetStreamHandler(m.streamHandler)
+	}
+	for name, fn := range m.channels {
+		session.SetChannelHandler(name, fn)
+	}
+	for method, fn := range m.rpcHandlers {
+		session.SetRPCHandler(method, fn)
+	}
+	session.SetPeerVerifier(verify)
+	return session
+}
+
+func (m *ConnectionManager) sendDirectDatagram(addr *net.UDPAddr, msg directDatagram) error {
+	data, err := encodeDirectDatagram(msg)
+	if err != nil {
+		return err
+	}
+	_, err = m.direct.transport.WriteTo(data, addr)
+	return err
+}
+
+// Per-address counting
+
+// addrCounter splits the traffic of the shared direct socket by remote
+// address, so each session is counted on its own.
+type addrCounter struct {
+	net.PacketConn
+	mu    sync.Mutex
+	peers map[string]*countingConn
+}
+
+func (a *addrCounter) count(addr net.Addr) (*countingConn, func()) {
+	counted := &countingConn{}
+	key := addr.String()
+	a.mu.Lock()
+	a.peers[key] = counted
+	a.mu.Unlock()
+	return counted, func() {
+		a.mu.Lock()
+		if a.peers[key] == counted {
+			delete(a.peers, key)
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *addrCounter) lookup(addr net.Addr) *countingConn {
+	if addr == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.peers[addr.String()]
+}
+
+func (a *addrCounter) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := a.PacketConn.ReadFrom(p)
+	if c := a.lookup(addr); c != nil {
+		c.received.Add(uint64(n))
+	}
+	return n, addr, err
+}
+
+func (a *addrCounter) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := a.PacketConn.WriteTo(p, addr)
+	if c := a.lookup(addr); c != nil {
+		c.sent.Add(uint64(n))
+	}
+	return n, err
+}
+
+// Helpers
+func encodeDirectDatagram(msg directDatagram) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	data = append(append([]byte(nil), directMagic...), data...)
+	if len(data) > directDatagramLimit {
+		return nil, errors.New("datagram too large")
+	}
+	return data, nil
+}
+
+func decodeDirectDatagram(data []byte) (directDatagram, bool) {
+	var msg directDatagram
+	if !bytes.HasPrefix(data, directMagic) {
+		return msg, false
+	}
+	if err := json.Unmarshal(data[len(directMagic):], &msg); err != nil {
+		return msg, false
+	}
+	return msg, true
+}
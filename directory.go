@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// directoryTTLSeconds is how long a directory entry outlives the client
+// that published it; the entry is refreshed at half of it.
+const directoryTTLSeconds = 60 * 60
+
+type directoryPublishRequest struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	TTLSeconds  int    `json:"ttl_seconds"`
+}
+
+type directorySearchRequest struct {
+	Query string `json:"query"`
+}
+
+type directorySearchResponse struct {
+	Results []DirectoryEntry `json:"results"`
+}
+
+// DirectoryEntry is a client listed in the public directory.
+type DirectoryEntry struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+// ErrDirectoryUnsupported is returned when the rendezvous server has no
+// public directory.
+var ErrDirectoryUnsupported = errors.New("rendezvous server has no peer directory")
+
+// Public directory
+//
+// Listing is off unless the directory setting is on, and needs a display
+// name from -name. While listed, the client publishes its id and display
+// name for directoryTTLSeconds and keeps refreshing the entry; turning
+// the setting off or shutting down removes it, and a client that dies
+// drops out once the TTL runs out. Requests are signed like every other
+// rendezvous request, so only the owner of an id can list it. Searching
+// needs no listing: results are ids to connect to as usual.
+func publishDirectory(ctx context.Context, serverAddr, clientID, displayName string, ttlSeconds int) error {
+	payload := directoryPublishRequest{ID: clientID, DisplayName: displayName, TTLSeconds: ttlSeconds}
+	err := postJSON(ctx, serverAddr, "/directory/publish", payload, nil, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return ErrDirectoryUnsupported
+	}
+	return err
+}
+
+func unpublishDirectory(ctx context.Context, serverAddr, clientID string) error {
+	payload := unregisterRequest{ID: clientID}
+	return postJSON(ctx, serverAddr, "/directory/unpublish", payload, nil, http.StatusOK, http.StatusNotFound)
+}
+
+func searchDirectory(ctx context.Context, serverAddr, query string) ([]DirectoryEntry, error) {
+	var resp directorySearchResponse
+	err := postJSON(ctx, serverAddr, "/directory/search", directorySearchRequest{Query: query}, &resp, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrDirectoryUnsupported
+	}
+	return resp.Results, err
+}
+
+// Client
+
+// SetDisplayName sets the name published while listed in the directory.
+func (c *Client) SetDisplayName(name string) {
+	c.directoryMu.Lock()
+	c.displayName = name
+	c.directoryMu.Unlock()
+}
+
+// SetDirectoryListed turns the directory listing on or off. The change is
+// published by StartDirectory.
+func (c *Client) SetDirectoryListed(listed bool) {
+	c.directoryMu.Lock()
+	c.listed = listed
+	c.directoryMu.Unlock()
+	select {
+	case c.directoryKick <- struct{}{}:
+	default:
+	}
+}
+
+// DirectoryListed reports whether the client is listed in the directory.
+func (c *Client) DirectoryListed() bool {
+	c.directoryMu.Lock()
+	defer c.directoryMu.Unlock()
+	return c.published
+}
+
+// SearchDirectory finds listed clients whose display name matches query.
+func (c *Client) SearchDirectory(ctx context.Context, query string) ([]DirectoryEntry, error) {
+	if c.lanOnly {
+		return nil, errors.New("the directory is not available in LAN-only mode")
+	}
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, errors.New("missing name to search for")
+	}
+	results, err := searchDirectory(ctx, c.serverAddr, query)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("directory searched query=%q results=%d", query, len(results))
+	return results, nil
+}
+
+// StartDirectory keeps the directory entry in line with the setting until
+// ctx is done.
+func (c *Client) StartDirectory(ctx context.Context) {
+	ticker := time.NewTicker(directoryTTLSeconds * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		if err := c.syncDirectory(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("directory update failed client_id=%s err=%v", c.clientID, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.directoryKick:
+		}
+	}
+}
+
+// syncDirectory publishes or removes the entry to match the setting.
+func (c *Client) syncDirectory(ctx context.Context) error {
+	c.directoryMu.Lock()
+	listed, name, published := c.listed, c.displayName, c.published
+	c.directoryMu.Unlock()
+
+	switch {
+	case listed && name == "":
+		return errors.New("listing needs a display name, set one with -name")
+	case listed:
+		if err := publishDirectory(ctx, c.serverAddr, c.clientID, name, directoryTTLSeconds); err != nil {
+			return err
+		}
+		if !published {
+			log.Printf("listed in directory client_id=%s name=%q", c.clientID, name)
+		}
+	case published:
+		if err := c.unlistDirectory(ctx); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	c.directoryMu.Lock()
+	c.published = listed
+	c.directoryMu.Unlock()
+	return nil
+}
+
+// unlistDirectory removes the entry if one was published.
+func (c *Client) unlistDirectory(ctx context.Context) error {
+	c.directoryMu.Lock()
+	published := c.published
+	c.directoryMu.Unlock()
+	if !published {
+		return nil
+	}
+	if err := unpublishDirectory(ctx, c.serverAddr, c.clientID); err != nil {
+		return fmt.Errorf("unlist: %w", err)
+	}
+	c.directoryMu.Lock()
+	c.published = false
+	c.directoryMu.Unlock()
+	log.Printf("removed from directory client_id=%s", c.clientID)
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxFileNameBytes   = 255
+	maxCollisionSuffix = 1000
+)
+
+// Download directory
+func defaultDownloadDir() string {
+	if v := os.Getenv("CHUTE_DOWNLOAD_DIR"); v != "" {
+		return v
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "chute-downloads"
+	}
+	return filepath.Join(home, "Downloads", "Chute")
+}
+
+// createDownloadFile sanitizes an incoming file name and creates it inside
+// dir without ever overwriting an existing file: on collision it picks
+// "name (1).ext", "name (2).ext", and so on.
+func createDownloadFile(dir, name string) (*os.File, string, error) {
+	clean, err := sanitizeFileName(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, "", err
+	}
+
+	ext := filepath.Ext(clean)
+	stem := strings.TrimSuffix(clean, ext)
+	for i := 0; i < maxCollisionSuffix; i++ {
+		candidate := clean
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			return file, path, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, "", err
+		}
+	}
+	return nil, "", fmt.Errorf("too many files named %s", clean)
+}
+
+// Name sanitization
+func sanitizeFileName(name string) (string, error) {
+	// Treat both separators as path separators regardless of platform and
+	// keep only the final element, so "../../x" and "C:\x" collapse to "x".
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			continue
+		case strings.ContainsRune(`<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	clean := strings.Trim(b.String(), " .")
+	if clean == "" {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	if isReservedFileName(clean) {
+		clean = "_" + clean
+	}
+	return truncateFileName(clean), nil
+}
+
+func isReservedFileName(name string) bool {
+	base := strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '1' && base[3] <= '9'
+	}
+	return false
+}
+
+func truncateFileName(name string) string {
+	if len(name) <= maxFileNameBytes {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxFileNameBytes/2 {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	limit := maxFileNameBytes - len(ext)
+	for len(stem) > limit || !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return stem + ext
+}
+
+// Progress
+
+const progressInterval = 1 << 20
+
+// TransferProgress describes an incoming or outgoing transfer. Total is -1
+// when the size is not known up front.
+type TransferProgress struct {
+	PeerID string
+	Name   string
+	Bytes  int64
+	Total  int64
+	Done   bool
+	Err    error
+}
+
+// progressTracker reports progress roughly every progressInterval bytes.
+type progressTracker struct {
+	report func(TransferProgress)
+	state  TransferProgress
+	last   int64
+}
+
+func (p *progressTracker) add(n int) {
+	p.state.Bytes += int64(n)
+	if p.report != nil && p.state.Bytes-p.last >= progressInterval {
+		p.last = p.state.Bytes
+		p.report(p.state)
+	}
+}
+
+func (p *progressTracker) finish(err error) {
+	p.state.Done = true
+	p.state.Err = err
+	if p.report != nil {
+		p.report(p.state)
+	}
+}
+
+type progressWriter struct {
+	w io.Writer
+	*progressTracker
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.add(n)
+	return n, err
+}
+
+type progressReader struct {
+	r io.Reader
+	*progressTracker
+}
+
+func (p progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.add(n)
+	return n, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"../../etc/passwd", "passwd"},
+		{`C:\Windows\system.ini`, "system.ini"},
+		{"dir/sub\\file.txt", "file.txt"},
+		{`a<b>:c"d|e?f*.txt`, "a_b__c_d_e_f_.txt"},
+		{"  .hidden. ", "hidden"},
+		{"name\x00\x07\n.txt", "name.txt"},
+		{"\xff\xfeok", "ok"},
+		{"CON", "_CON"},
+		{"com1.txt", "_com1.txt"},
+		{"LPT9.log", "_LPT9.log"},
+		{"COM0", "COM0"},
+		{"console.txt", "console.txt"},
+		{"日本語.txt", "日本語.txt"},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeFileName(tt.name)
+		if err != nil {
+			t.Errorf("sanitizeFileName(%q): %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeFileNameRejects(t *testing.T) {
+	for _, name := range []string{"", "/", "..", "../", " . ", "dir/", "\x00\x01"} {
+		if got, err := sanitizeFileName(name); err == nil {
+			t.Errorf("sanitizeFileName(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestSanitizeFileNameTruncates(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  string
+	}{
+		{strings.Repeat("a", 3*maxFileNameBytes) + ".txt", ".txt"},
+		{strings.Repeat("é", maxFileNameBytes) + ".tar", ".tar"},
+		{"x" + "." + strings.Repeat("b", maxFileNameBytes), ""},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeFileName(tt.name)
+		if err != nil {
+			t.Fatalf("sanitizeFileName: %v", err)
+		}
+		if len(got) > maxFileNameBytes || !utf8.ValidString(got) || !strings.HasSuffix(got, tt.ext) {
+			t.Errorf("sanitizeFileName(%d bytes) = %q (%d bytes), want at most %d valid bytes ending in %q", len(tt.name), got, len(got), maxFileNameBytes, tt.ext)
+		}
+	}
+}
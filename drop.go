@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dropPrefix     = "drop-"
+	defaultDropTTL = time.Hour
+	maxDropTTL     = 24 * time.Hour
+)
+
+// Drop is a one-time code that lets anyone holding it connect to this
+// client once and send a single file without being accepted by hand.
+type Drop struct {
+	Code    string    `json:"code"`
+	Link    string    `json:"link"`
+	Expires time.Time `json:"expires"`
+}
+
+// Drops
+//
+// A drop code is an extra client id claimed on the rendezvous server for
+// the drop's lifetime, so the server lets nobody else register it. The
+// client polls intents for it next to its own id. The first intent uses
+// the drop up: it is answered under the code and any further intents are
+// ignored. The resulting session auto-accepts one file and then closes.
+
+// CreateDrop claims a fresh drop code valid for ttl.
+func (c *Client) CreateDrop(ctx context.Context, ttl time.Duration) (Drop, error) {
+	if ttl <= 0 {
+		ttl = defaultDropTTL
+	}
+	if c.lanOnly {
+		return Drop{}, errors.New("drops need a rendezvous server")
+	}
+	if ttl > maxDropTTL {
+		return Drop{}, fmt.Errorf("drop lifetime is limited to %s", maxDropTTL)
+	}
+	for attempt := 0; attempt < claimAttempts; attempt++ {
+		code, err := newDropCode()
+		if err != nil {
+			return Drop{}, err
+		}
+		err = claimClientID(ctx, c.serverAddr, code, int(ttl/time.Second))
+		if errors.Is(err, ErrIDTaken) {
+			continue
+		}
+		if err != nil {
+			return Drop{}, err
+		}
+		drop := Drop{Code: code, Link: deepLinkScheme + "://connect/" + code, Expires: time.Now().Add(ttl)}
+		c.dropsMu.Lock()
+		c.drops = append(c.drops, drop)
+		c.dropsMu.Unlock()
+		log.Printf("drop created code=%s expires=%s", code, drop.Expires.Format(time.RFC3339))
+		return drop, nil
+	}
+	return Drop{}, errors.New("could not claim a free drop code")
+}
+
+// Drops lists the unused, unexpired drops.
+func (c *Client) Drops() []Drop {
+	c.dropsMu.Lock()
+	defer c.dropsMu.Unlock()
+	c.pruneDropsLocked()
+	return append([]Drop(nil), c.drops...)
+}
+
+// pollDrops answers the first intent for each open drop. It runs from
+// the polling loop while no session is active.
+func (c *Client) pollDrops(ctx context.Context, manager *ConnectionManager) {
+	for _, drop := range c.Drops() {
+		intent, ok, err := pollConnectIntent(ctx, c.serverAddr, drop.Code)
+		if err != nil || !ok {
+			continue
+		}
+		if !c.useDrop(drop.Code) {
+			continue
+		}
+		log.Printf("drop used code=%s peer_id=%s", drop.Code, intent.ID)
+		if _, err := manager.ConnectAs(ctx, drop.Code, intent.IceInfo); err != nil {
+			c.takeUsedDrop(drop.Code)
+			log.Printf("drop connect failed code=%s err=%v", drop.Code, err)
+		}
+		return
+	}
+}
+
+// useDrop removes code from the open drops and reports whether it was
+// still open. The used code is remembered so the session can find it.
+func (c *Client) useDrop(code string) bool {
+	c.dropsMu.Lock()
+	defer c.dropsMu.Unlock()
+	for i, d := range c.drops {
+		if d.Code == code {
+			c.drops = append(c.drops[:i], c.drops[i+1:]...)
+			c.usedDrops[code] = true
+			return true
+		}
+	}
+	return false
+}
+
+// takeUsedDrop reports whether localID is a drop just used, and forgets
+// it so it can back one session only.
+func (c *Client) takeUsedDrop(localID string) bool {
+	c.dropsMu.Lock()
+	defer c.dropsMu.Unlock()
+	if !c.usedDrops[localID] {
+		return false
+	}
+	delete(c.usedDrops, localID)
+	return true
+}
+
+func (c *Client) pruneDropsLocked() {
+	now := time.Now()
+	kept := c.drops[:0]
+	for _, d := range c.drops {
+		if now.Before(d.Expires) {
+			kept = append(kept, d)
+		}
+	}
+	c.drops = kept
+}
+
+// receiveDropFile stores the first file offered over a drop session
+// without asking, then ends the session. A passphrase-protected offer
+// still needs the user, so it goes through the normal pending flow. A
+// session that offers nothing within fileOfferTimeout is closed.
+func (c *Client) receiveDropFile(session *ChuteSession) func(peerID string, offer FileOffer, r io.Reader) error {
+	idle := time.AfterFunc(fileOfferTimeout, func() {
+		log.Printf("drop session idle, closing")
+		_ = session.Close()
+	})
+	session.OnClose(func() {
+		idle.Stop()
+	})
+	var once sync.Once
+	return func(peerID string, offer FileOffer, r io.Reader) error {
+		first := false
+		once.Do(func() {
+			first = true
+		})
+		if !first {
+			return errFileRefused
+		}
+		idle.Stop()
+		// Close once the session has had time to send our reply, so the
+		// sender sees the outcome rather than a dropped connection.
+		defer time.AfterFunc(goodbyeTimeout, func() {
+			_ = session.Close()
+		})
+		if offer.Protection != nil {
+			return c.receiveFile(peerID, offer, r)
+		}
+		log.Printf("drop file accepted peer_id=%s name=%q", peerID, offer.Name)
+		return c.storeFile(peerID, offer, r, nil)
+	}
+}
+
+// Helpers
+func newDropCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return dropPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)), nil
+}
+
+func isDropCode(id string) bool {
+	return strings.HasPrefix(id, dropPrefix)
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+const (
+	// e2eProto is offered ahead of nextProto by peers that speak the
+	// end-to-end layer; TLS picks it only when both ends do.
+	e2eProto = "chute-quic-e2e"
+
+	e2eLabel     = "chute-e2e-v1"
+	e2eHelloSize = 32 + ed25519.SignatureSize
+	e2eSaltSize  = 16
+)
+
+var errE2EBadHello = errors.New("end-to-end key exchange failed")
+
+// End-to-end encryption
+//
+// QUIC's TLS ends at whichever UDP endpoints carry the connection, and
+// trusting those relies on pinning. On top of it, both peers exchange
+// ephemeral X25519 keys during the identity handshake, each signed by
+// the identity key behind its TLS certificate, and derive one key per
+// direction. After that every stream the session opens or accepts is
+// sealed with it, so a relay or any later hop in between only ever sees
+// ciphertext even if it could see into the QUIC layer. Each stream
+// starts with a random salt that derives its own key, so the sealed
+// chunk counters never repeat a nonce under one key. The key also binds
+// the QUIC stream id, so sealed data replayed onto another stream does
+// not open.
+//
+// Peers that predate the layer negotiate plain nextProto and sessions
+// with them run as before; PeerE2E reports which one was used.
+type e2eKeys struct {
+	send []byte
+	recv []byte
+}
+
+// e2eExchange holds our side of the key exchange until the peer's hello
+// arrives.
+type e2eExchange struct {
+	private *ecdh.PrivateKey
+	dialer  bool
+}
+
+func newE2EExchange(dialer bool) (*e2eExchange, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eExchange{private: private, dialer: dialer}, nil
+}
+
+// hello is our ephemeral public key signed by our identity key.
+func (x *e2eExchange) hello(identity ed25519.PrivateKey) []byte {
+	pub := x.private.PublicKey().Bytes()
+	sig := ed25519.Sign(identity, e2eSignedData(x.dialer, pub))
+	return append(pub, sig...)
+}
+
+// finish checks the peer's hello against its identity key and derives
+// the session keys.
+func (x *e2eExchange) finish(hello []byte, peerKey ed25519.PublicKey) (*e2eKeys, error) {
+	if len(hello) != e2eHelloSize || peerKey == nil {
+		return nil, errE2EBadHello
+	}
+	peerPub, sig := hello[:32], hello[32:]
+	if !ed25519.Verify(peerKey, e2eSignedData(!x.dialer, peerPub), sig) {
+		return nil, fmt.Errorf("%w: bad signature", errE2EBadHello)
+	}
+	remote, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errE2EBadHello, err)
+	}
+	secret, err := x.private.ECDH(remote)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errE2EBadHello, err)
+	}
+
+	local := x.private.PublicKey().Bytes()
+	salt := append(append([]byte(nil), peerPub...), local...)
+	if x.dialer {
+		salt = append(append([]byte(nil), local...), peerPub...)
+	}
+	toAcceptor, err := hkdf.Key(sha256.New, secret, salt, e2eLabel+" dialer", 32)
+	if err != nil {
+		return nil, err
+	}
+	toDialer, err := hkdf.Key(sha256.New, secret, salt, e2eLabel+" acceptor", 32)
+	if err != nil {
+		return nil, err
+	}
+	if x.dialer {
+		return &e2eKeys{send: toAcceptor, recv: toDialer}, nil
+	}
+	return &e2eKeys{send: toDialer, recv: toAcceptor}, nil
+}
+
+func e2eSignedData(dialer bool, pub []byte) []byte {
+	role := " acceptor "
+	if dialer {
+		role = " dialer "
+	}
+	return append([]byte(e2eLabel+role), pub...)
+}
+
+func readE2EHello(r io.Reader) ([]byte, error) {
+	hello := make([]byte, e2eHelloSize)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return nil, fmt.Errorf("%w: %w", errE2EBadHello, err)
+	}
+	return hello, nil
+}
+
+// connUsesE2E reports whether the peer agreed to the end-to-end layer.
+func connUsesE2E(conn quic.Connection) bool {
+	proto := conn.ConnectionState().TLS.NegotiatedProtocol
+	return proto == e2eProto || proto == channelProto
+}
+
+// connIdentity is the identity key behind the peer's TLS certificate.
+func connIdentity(conn quic.Connection) ed25519.PublicKey {
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	pub, _ := certs[0].PublicKey.(ed25519.PublicKey)
+	return pub
+}
+
+// Sealed connection
+
+// e2eConn seals every stream of conn with keys.
+type e2eConn struct {
+	quic.Connection
+	keys *e2eKeys
+}
+
+// sealConn returns conn sealed with keys, or conn itself when the peer
+// does not speak the end-to-end layer.
+func sealConn(conn quic.Connection, keys *e2eKeys) quic.Connection {
+	if keys == nil {
+		return conn
+	}
+	return &e2eConn{Connection: conn, keys: keys}
+}
+
+func (c *e2eConn) OpenStream() (quic.Stream, error) {
+	stream, err := c.Connection.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(stream), nil
+}
+
+func (c *e2eConn) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	stream, err := c.Connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(stream), nil
+}
+
+func (c *e2eConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	stream, err := c.Connection.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(stream), nil
+}
+
+func (c *e2eConn) OpenUniStream() (quic.SendStream, error) {
+	stream, err := c.Connection.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+	return &e2eSendStream{SendStream: stream, w: &e2eWriter{w: stream, key: c.keys.send, id: stream.StreamID()}}, nil
+}
+
+func (c *e2eConn) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	stream, err := c.Connection.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eSendStream{SendStream: stream, w: &e2eWriter{w: stream, key: c.keys.send, id: stream.StreamID()}}, nil
+}
+
+func (c *e2eConn) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	stream, err := c.Connection.AcceptUniStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &e2eReceiveStream{ReceiveStream: stream, r: &e2eReader{r: stream, key: c.keys.recv, id: stream.StreamID()}}, nil
+}
+
+func (c *e2eConn) wrap(stream quic.Stream) quic.Stream {
+	return &e2eStream{
+		Stream: stream,
+		w:      &e2eWriter{w: stream, key: c.keys.send, id: stream.StreamID()},
+		r:      &e2eReader{r: stream, key: c.keys.recv, id: stream.StreamID()},
+	}
+}
+
+type e2eStream struct {
+	quic.Stream
+	w *e2eWriter
+	r *e2eReader
+}
+
+func (s *e2eStream) Read(p []byte) (int, error)  { return s.r.Read(p) }
+func (s *e2eStream) Write(p []byte) (int, error) { return s.w.Write(p) }
+
+// Close seals the end of the data before closing the write direction.
+func (s *e2eStream) Close() error {
+	if err := s.w.Close(); err != nil {
+		_ = s.Stream.Close()
+		return err
+	}
+	return s.Stream.Close()
+}
+
+type e2eSendStream struct {
+	quic.SendStream
+	w *e2eWriter
+}
+
+func (s *e2eSendStream) Write(p []byte) (int, error) { return s.w.Write(p) }
+
+func (s *e2eSendStream) Close() error {
+	if err := s.w.Close(); err != nil {
+		_ = s.SendStream.Close()
+		return err
+	}
+	return s.SendStream.Close()
+}
+
+type e2eReceiveStream struct {
+	quic.ReceiveStream
+	r *e2eReader
+}
+
+func (s *e2eReceiveStream) Read(p []byte) (int, error) { return s.r.Read(p) }
+
+// e2eWriter seals each Write as it comes, so interactive streams are
+// not held back until a chunk fills up.
+type e2eWriter struct {
+	w    io.Writer
+	key  []byte
+	id   quic.StreamID
+	seal *sealWriter
+}
+
+func (e *e2eWriter) start() error {
+	if e.seal != nil {
+		return nil
+	}
+	salt := make([]byte, e2eSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	key, err := e2eStreamKey(e.key, salt, e.id)
+	if err != nil {
+		return err
+	}
+	if _, err := e.w.Write(salt); err != nil {
+		return err
+	}
+	e.seal, err = newSealWriter(e.w, key)
+	return err
+}
+
+func (e *e2eWriter) Write(p []byte) (int, error) {
+	if err := e.start(); err != nil {
+		return 0, err
+	}
+	n, err := e.seal.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, e.seal.Flush()
+}
+
+func (e *e2eWriter) Close() error {
+	if err := e.start(); err != nil {
+		return err
+	}
+	return e.seal.Close()
+}
+
+type e2eReader struct {
+	r    io.Reader
+	key  []byte
+	id   quic.StreamID
+	open *openReader
+}
+
+func (e *e2eReader) Read(p []byte) (int, error) {
+	if e.open == nil {
+		salt := make([]byte, e2eSaltSize)
+		if _, err := io.ReadFull(e.r, salt); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, errSealedTruncated
+			}
+			return 0, err
+		}
+		key, err := e2eStreamKey(e.key, salt, e.id)
+		if err != nil {
+			return 0, err
+		}
+		if e.open, err = newOpenReader(e.r, key); err != nil {
+			return 0, err
+		}
+	}
+	return e.open.Read(p)
+}
+
+// e2eStreamKey derives the key for the stream id from its salt.
+func e2eStreamKey(key, salt []byte, id quic.StreamID) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, salt, fmt.Sprintf("%s stream %d", e2eLabel, id), 32)
+}
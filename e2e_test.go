@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"testing"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+func TestE2EExchange(t *testing.T) {
+	dialerID := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	acceptorID := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize))
+	dialer, err := newE2EExchange(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptor, err := newE2EExchange(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialerHello := dialer.hello(dialerID)
+	acceptorHello := acceptor.hello(acceptorID)
+
+	dialerKeys, err := dialer.finish(acceptorHello, acceptorID.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatalf("dialer finish: %v", err)
+	}
+	acceptorKeys, err := acceptor.finish(dialerHello, dialerID.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatalf("acceptor finish: %v", err)
+	}
+	if !bytes.Equal(dialerKeys.send, acceptorKeys.recv) || !bytes.Equal(dialerKeys.recv, acceptorKeys.send) {
+		t.Fatal("the two sides derived different keys")
+	}
+	if bytes.Equal(dialerKeys.send, dialerKeys.recv) {
+		t.Fatal("both directions share one key")
+	}
+
+	// A hello signed for the acceptor role must not pass as the dialer's,
+	// or one side's hello could be reflected back to it.
+	other, err := newE2EExchange(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lowOrder := make([]byte, 32)
+	tests := []struct {
+		name    string
+		hello   []byte
+		peerKey ed25519.PublicKey
+	}{
+		{"other identity", dialerHello, acceptorID.Public().(ed25519.PublicKey)},
+		{"reflected role", other.hello(dialerID), dialerID.Public().(ed25519.PublicKey)},
+		{"no peer key", dialerHello, nil},
+		{"short hello", dialerHello[:e2eHelloSize-1], dialerID.Public().(ed25519.PublicKey)},
+		{"flipped signature", append(bytes.Clone(dialerHello[:e2eHelloSize-1]), dialerHello[e2eHelloSize-1]^1), dialerID.Public().(ed25519.PublicKey)},
+		{"low order point", append(lowOrder, ed25519.Sign(dialerID, e2eSignedData(true, lowOrder))...), dialerID.Public().(ed25519.PublicKey)},
+	}
+	for _, tt := range tests {
+		if _, err := acceptor.finish(tt.hello, tt.peerKey); !errors.Is(err, errE2EBadHello) {
+			t.Errorf("%s: err = %v, want errE2EBadHello", tt.name, err)
+		}
+	}
+}
+
+func TestE2EStreamKeyBindsStreamID(t *testing.T) {
+	key := bytes.Repeat([]byte{9}, 32)
+	var wire bytes.Buffer
+	w := &e2eWriter{w: &wire, key: key, id: 4}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		id quic.StreamID
+		ok bool
+	}{
+		{4, true},
+		{8, false},
+		{5, false},
+	}
+	for _, tt := range tests {
+		got, err := io.ReadAll(&e2eReader{r: bytes.NewReader(wire.Bytes()), key: key, id: tt.id})
+		if tt.ok && (err != nil || string(got) != "hello") {
+			t.Errorf("stream %d: got %q, err=%v", tt.id, got, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("stream 4 data opened on stream %d", tt.id)
+		}
+	}
+}
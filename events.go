@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const eventBuffer = 64
+
+type EventKind string
+
+const (
+	EventConnected        EventKind = "connected"
+	EventDisconnected     EventKind = "disconnected"
+	EventIntentReceived   EventKind = "intent"
+	EventIntentExpired    EventKind = "intent-expired"
+	EventFileOffered      EventKind = "file-offered"
+	EventTransferStarted  EventKind = "transfer-started"
+	EventTransferFinished EventKind = "transfer-finished"
+	EventRendezvousHealth EventKind = "rendezvous"
+	EventIDTaken          EventKind = "id-taken"
+	EventPeerUnresponsive EventKind = "peer-unresponsive"
+	EventPeerResponsive   EventKind = "peer-responsive"
+	EventIdleWarning      EventKind = "idle-warning"
+	EventConnectProgress  EventKind = "connect-progress"
+)
+
+// Event is one state change. Detail carries kind-specific text: the
+// intent description, the transfer name, "up", "down" or "registered"
+// for rendezvous, the time left before an idle session closes, or the
+// ConnectState of a connect. Attempt is the id of the connect attempt a
+// progress event belongs to, if any.
+type Event struct {
+	Kind    EventKind
+	PeerID  string
+	Attempt string
+	Detail  string
+	Err     error
+	Time    time.Time
+}
+
+// eventBus fans events out to subscribers. A subscriber that falls more
+// than eventBuffer events behind misses the overflow rather than stalling
+// the publisher.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[int]chan Event
+	next int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[int]chan Event)}
+}
+
+// Subscribe returns a channel of future events and a function that ends
+// the subscription and closes the channel.
+func (b *eventBus) Subscribe() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	ch := make(chan Event, eventBuffer)
+	b.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
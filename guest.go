@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+const maxGuestTTL = 24 * time.Hour
+
+// Guest ids
+//
+// A guest run uses a throwaway client id and identity key, so a stranger
+// learns neither the permanent id nor a fingerprint that could be
+// recognised later. Neither is saved, and the guest skips the pin,
+// usage and inbox stores. The id is claimed only for the guest lifetime,
+// and the client shuts itself down when it runs out, so the id stops
+// answering even if the server keeps it a little longer.
+func claimGuestID(ctx context.Context, serverAddr string, ttl time.Duration) (string, error) {
+	for attempt := 0; attempt < claimAttempts; attempt++ {
+		id, err := generateClientID()
+		if err != nil {
+			return "", err
+		}
+		err = claimClientID(ctx, serverAddr, id, int(ttl/time.Second))
+		if errors.Is(err, ErrIDTaken) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+	return "", errors.New("could not claim a free guest id")
+}
+
+func newGuestIdentity() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	return key, err
+}
+
+// expireGuest ends the process when the guest lifetime is over.
+func expireGuest(client *Client, cancel context.CancelFunc, expires time.Time) {
+	time.Sleep(time.Until(expires))
+	log.Printf("guest id expired client_id=%s", client.clientID)
+	shutdown(client, cancel)
+	os.Exit(0)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// heartbeatMisses is how many pings in a row may go unanswered before
+// the peer counts as unresponsive.
+const heartbeatMisses = 3
+
+// Tunable via flags; see main. Zero disables the heartbeat.
+var heartbeatInterval = 10 * time.Second
+
+// Peer heartbeat
+//
+// QUIC keepalives only prove the peer's stack is alive, and a dead peer
+// is noticed when the idle timeout finally closes the session. The
+// heartbeat pings through the control frames instead, so a peer whose
+// client is stuck, or whose network went away, shows as unresponsive
+// after a few missed pings. The session stays open: the peer may come
+// back, and the liveness handler hears about that too.
+func (s *ChuteSession) heartbeat(conn quic.Connection) {
+	if heartbeatInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	misses := 0
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(conn.Context(), heartbeatInterval)
+		rtt, err := s.ping(ctx, conn)
+		cancel()
+		if errors.Is(err, ErrPeerGone) || conn.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			misses++
+			if misses == heartbeatMisses {
+				log.Printf("peer unresponsive peer_id=%s misses=%d", s.CurrentPeerID(), misses)
+				s.setUnresponsive(conn, true)
+			}
+			continue
+		}
+		if misses >= heartbeatMisses {
+			log.Printf("peer responsive again peer_id=%s rtt=%s", s.CurrentPeerID(), rtt.Round(time.Millisecond))
+			s.setUnresponsive(conn, false)
+		}
+		misses = 0
+		s.mu.Lock()
+		s.peerRTT = rtt
+		s.mu.Unlock()
+	}
+}
+
+func (s *ChuteSession) setUnresponsive(conn quic.Connection, unresponsive bool) {
+	s.mu.Lock()
+	if s.conn != conn {
+		s.mu.Unlock()
+		return
+	}
+	s.peerUnresponsive = unresponsive
+	fn := s.livenessHandler
+	s.mu.Unlock()
+	if fn != nil {
+		fn(unresponsive)
+	}
+}
+
+// SetLivenessHandler registers fn to be told when the peer stops or
+// resumes answering heartbeats.
+func (s *ChuteSession) SetLivenessHandler(fn func(unresponsive bool)) {
+	s.mu.Lock()
+	s.livenessHandler = fn
+	s.mu.Unlock()
+}
+
+// PeerUnresponsive reports whether the peer missed its last heartbeats.
+func (s *ChuteSession) PeerUnresponsive() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerUnresponsive
+}
+
+// PeerRTT is the round trip of the last answered heartbeat.
+func (s *ChuteSession) PeerRTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerRTT
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	historyFile  = "transfers.jsonl"
+	historyLimit = 500
+)
+
+// TransferRecord is one finished transfer, successful or not.
+type TransferRecord struct {
+	PeerID    string        `json:"peer_id"`
+	Name      string        `json:"name"`
+	Direction string        `json:"direction"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"duration"`
+	Status    string        `json:"status"`
+	Error     string        `json:"error,omitempty"`
+	Finished  time.Time     `json:"finished"`
+}
+
+const (
+	directionIncoming = "in"
+	directionOutgoing = "out"
+
+	transferCompleted = "completed"
+	transferFailed    = "failed"
+)
+
+// historyMu serializes appends so concurrent transfers do not interleave
+// lines.
+var historyMu sync.Mutex
+
+// Storage
+
+// appendTransferRecord adds rec as one JSON line to the history file,
+// trimming it to the last historyLimit lines once it grows past them.
+func appendTransferRecord(dir string, rec TransferRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, historyFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return trimHistoryLocked(dir)
+}
+
+// trimHistoryLocked rewrites the history file with only its last
+// historyLimit lines when it holds more. historyMu must be held.
+func trimHistoryLocked(dir string) error {
+	path := filepath.Join(dir, historyFile)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	var lines [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+		if len(lines) > historyLimit+1 {
+			lines = lines[1:]
+		}
+	}
+	_ = file.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(lines) <= historyLimit {
+		return nil
+	}
+	lines = lines[1:]
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for _, line := range lines {
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadTransferHistory returns up to historyLimit of the most recent
+// records, oldest first. Lines that fail to parse are skipped.
+func loadTransferHistory(dir string) ([]TransferRecord, error) {
+	file, err := os.Open(filepath.Join(dir, historyFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []TransferRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec TransferRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+		if len(records) > historyLimit {
+			records = records[1:]
+		}
+	}
+	return records, scanner.Err()
+}
+
+func newTransferRecord(peerID, name, direction string, bytes int64, started time.Time, err error) TransferRecord {
+	rec := TransferRecord{
+		PeerID:    peerID,
+		Name:      name,
+		Direction: direction,
+		Bytes:     bytes,
+		Duration:  time.Since(started),
+		Status:    transferCompleted,
+		Finished:  time.Now(),
+	}
+	if err != nil {
+		rec.Status = transferFailed
+		rec.Error = err.Error()
+	}
+	return rec
+}
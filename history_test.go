@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestAppendTransferRecordTrims(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < historyLimit+10; i++ {
+		rec := TransferRecord{PeerID: "alice", Name: strconv.Itoa(i), Status: transferCompleted}
+		if err := appendTransferRecord(dir, rec); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, historyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != historyLimit {
+		t.Fatalf("history file has %d lines, want %d", lines, historyLimit)
+	}
+	records, err := loadTransferHistory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != historyLimit || records[0].Name != "10" || records[len(records)-1].Name != strconv.Itoa(historyLimit+9) {
+		t.Fatalf("kept %d records from %q to %q", len(records), records[0].Name, records[len(records)-1].Name)
+	}
+}
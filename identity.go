@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const identityKeyFile = "identity.pem"
+
+// Storage
+func configDir() (string, error) {
+	if v := os.Getenv("CHUTE_CONFIG_DIR"); v != "" {
+		return v, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "chute"), nil
+}
+
+// profileDir is the config dir for a named profile. Each profile keeps
+// its own identity key, client id, pins and settings; the unnamed
+// profile uses base itself, so existing setups are unaffected.
+func profileDir(base, name string) (string, error) {
+	if name == "" || name == "default" {
+		return base, nil
+	}
+	// -profile used to pick the performance preset, so a preset name here
+	// is almost certainly meant for -performance.
+	if validateProfile(name) == nil {
+		return "", fmt.Errorf("%q is a performance profile, use -performance %s; -profile names an identity", name, name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return "", fmt.Errorf("invalid profile name %q: use letters, digits, - and _", name)
+		}
+	}
+	return filepath.Join(base, "profiles", name), nil
+}
+
+// Identity key
+func loadOrCreateIdentity(dir string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dir, identityKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return parseIdentity(data)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	block := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, block, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func parseIdentity(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("identity key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key has unexpected type %T", parsed)
+	}
+	return key, nil
+}
+
+// Helpers
+
+// identityFingerprint renders the first 128 bits of the key's SHA-256 in
+// colon-separated groups, short enough to compare by eye.
+func identityFingerprint(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	encoded := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(encoded)/4)
+	for i := 0; i < len(encoded); i += 4 {
+		groups = append(groups, encoded[i:i+4])
+	}
+	return strings.Join(groups, ":")
+}
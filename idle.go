@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+const (
+	idleStrict    = "strict"
+	idleTransfers = "transfers"
+
+	// idleWarning is how long before an idle close the warning goes out,
+	// capped at half the idle timeout.
+	idleWarning = 30 * time.Second
+)
+
+// idlePolicy decides whether a pending transfer holds off the idle
+// close. Set through setIdlePolicy.
+var (
+	idlePolicyMu sync.Mutex
+	idlePolicy   = idleTransfers
+)
+
+func setIdlePolicy(name string) error {
+	if name == "" {
+		name = idleTransfers
+	}
+	if err := validateIdlePolicy(name); err != nil {
+		return err
+	}
+	idlePolicyMu.Lock()
+	idlePolicy = name
+	idlePolicyMu.Unlock()
+	return nil
+}
+
+func currentIdlePolicy() string {
+	idlePolicyMu.Lock()
+	defer idlePolicyMu.Unlock()
+	return idlePolicy
+}
+
+func validateIdlePolicy(name string) error {
+	if name != idleStrict && name != idleTransfers {
+		return fmt.Errorf("unknown idle policy %q (want %s or %s)", name, idleStrict, idleTransfers)
+	}
+	return nil
+}
+
+// Idle timeout
+//
+// QUIC keepalives and heartbeats keep the connection itself alive, so a
+// session is closed here once nobody has used it for sessionIdle:
+// messages, files, typing and receipts count, pings do not. Under the
+// transfers policy a file that is offered, waiting to be accepted or in
+// flight holds the close off, as does an open pipe stream or channel, and
+// the countdown restarts when it ends.
+// The idle handler is warned shortly before the close.
+func (s *ChuteSession) watchIdle(conn quic.Connection) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		remaining := s.IdleRemaining()
+		s.mu.Lock()
+		if s.conn != conn {
+			s.mu.Unlock()
+			return
+		}
+		warn := remaining <= min(idleWarning, sessionIdle/2) && !s.idleWarned
+		if warn {
+			s.idleWarned = true
+		}
+		fn := s.idleHandler
+		peerID := s.peerID
+		s.mu.Unlock()
+
+		if remaining <= 0 {
+			log.Printf("session idle, closing peer_id=%s idle=%s", peerID, sessionIdle)
+			_ = s.Close()
+			return
+		}
+		if warn && fn != nil {
+			fn(remaining)
+		}
+	}
+}
+
+// touch records use of the session, restarting the idle countdown.
+func (s *ChuteSession) touch() {
+	s.mu.Lock()
+	s.lastActivity = time.Now()
+	s.idleWarned = false
+	s.mu.Unlock()
+}
+
+// beginTransfer marks a file transfer as pending until the returned
+// function is called.
+func (s *ChuteSession) beginTransfer() func() {
+	s.mu.Lock()
+	s.transfers++
+	s.mu.Unlock()
+	s.touch()
+	return func() {
+		s.mu.Lock()
+		s.transfers--
+		s.mu.Unlock()
+		s.touch()
+	}
+}
+
+// holdIdleOpen counts stream as a transfer until our side of it is
+// closed or the connection ends, so a quiet stream is not closed as idle.
+func (s *ChuteSession) holdIdleOpen(stream quic.Stream) {
+	release := s.beginTransfer()
+	go func() {
+		<-stream.Context().Done()
+		release()
+	}()
+}
+
+// IdleRemaining is how long the session may stay unused before it is
+// closed. It stays at the full timeout while the idle policy holds it.
+func (s *ChuteSession) IdleRemaining() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if currentIdlePolicy() == idleTransfers && s.transfers > 0 {
+		return sessionIdle
+	}
+	return max(0, sessionIdle-time.Since(s.lastActivity))
+}
+
+// SetIdleHandler registers fn to be warned, with the time left, shortly
+// before an unused session is closed.
+func (s *ChuteSession) SetIdleHandler(fn func(remaining time.Duration)) {
+	s.mu.Lock()
+	s.idleHandler = fn
+	s.mu.Unlock()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	instanceProbeTimeout = 2 * time.Second
+	instanceLockFile     = "instance.lock"
+)
+
+var errInstanceLocked = errors.New("another instance holds the config dir")
+
+// instanceLock stays open, and so locked, for the life of the process.
+var instanceLock *os.File
+
+// Instance discovery
+//
+// A running client holds an exclusive lock on instance.lock in its config
+// dir, so two processes never register or poll as the same user, with or
+// without a control API. It also advertises the control API in
+// control.json: a second invocation that finds the lock taken probes it,
+// forwards one-shot commands to the running instance, and otherwise
+// refuses to start.
+func lockInstance(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, instanceLockFile), os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	instanceLock = f
+	return nil
+}
+
+func findRunningInstance(dir string) (controlInfo, ClientStatus, bool) {
+	info, err := readControlInfo(dir)
+	if err != nil {
+		return controlInfo{}, ClientStatus{}, false
+	}
+	var status ClientStatus
+	code, err := callInstance(info, http.MethodGet, "/status", nil, &status, instanceProbeTimeout)
+	if err != nil || code != http.StatusOK {
+		return controlInfo{}, ClientStatus{}, false
+	}
+	return info, status, true
+}
+
+// forwardOneShot runs a one-shot command against a running instance and
+// returns the exit code it would have had locally.
+func forwardOneShot(info controlInfo, args []string) int {
+	var path string
+	var body map[string]string
+	switch {
+	case args[0] == "status" && len(args) == 1:
+		path = "/status"
+	case args[0] == "connect" && len(args) == 2:
+		path, body = "/connect", map[string]string{"id": args[1]}
+	case args[0] == "send" && len(args) == 3:
+		abs, err := filepath.Abs(args[2])
+		if err != nil {
+			log.Printf("send failed: %v", err)
+			return exitUsage
+		}
+		path, body = "/sendfile", map[string]string{"id": args[1], "path": abs}
+	default:
+		log.Printf("usage: send <id> <file> | connect <id> | status")
+		return exitUsage
+	}
+
+	method := http.MethodPost
+	if body == nil {
+		method = http.MethodGet
+	}
+	var status ClientStatus
+	var response any
+	if path == "/status" {
+		response = &status
+	}
+	code, err := callInstance(info, method, path, body, response, controlTimeout)
+	if err != nil {
+		log.Printf("%s via running instance failed: %v", args[0], err)
+		return exitFailure
+	}
+	switch code {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return exitRefused
+	case http.StatusConflict, http.StatusBadGateway:
+		return exitUnreachable
+	default:
+		return exitFailure
+	}
+	if path == "/status" {
+		printStatus(status)
+		if !status.RendezvousHealthy {
+			return exitUnreachable
+		}
+	}
+	return exitOK
+}
+
+// callInstance makes one control API request. Error responses are logged
+// and reported through the status code.
+func callInstance(info controlInfo, method, path string, body, response any, timeout time.Duration) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, "http://"+info.Addr+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+info.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		log.Printf("running instance answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		return resp.StatusCode, nil
+	}
+	if response != nil {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			return resp.StatusCode, fmt.Errorf("decode response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
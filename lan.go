@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	lanDiscoveryPort    = 47300
+	lanAnnounceInterval = 2 * time.Second
+	lanPeerTTL          = 3 * lanAnnounceInterval
+)
+
+// LANPeer is a client announcing itself on the local network.
+type LANPeer struct {
+	ID          string    `json:"id"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Addr        string    `json:"addr"`
+	Seen        time.Time `json:"seen"`
+}
+
+// LAN discovery
+//
+// In LAN-only mode the client never talks to a rendezvous server. Every
+// client broadcasts its id and direct port on lanDiscoveryPort, and
+// connecting by id sends the intent straight to the announced address.
+// Only one process per host can listen for announcements; later ones
+// still announce themselves, so they can be found but not find others.
+type lanDiscovery struct {
+	localID     string
+	displayName string
+	port        int
+
+	mu    sync.Mutex
+	peers map[string]LANPeer
+}
+
+// EnableLAN switches the manager to LAN-only mode: it opens the direct
+// endpoint on port and starts announcing and discovering peers.
+func (m *ConnectionManager) EnableLAN(ctx context.Context, port int) error {
+	if err := m.EnableDirect(ctx, port); err != nil {
+		return err
+	}
+	m.lan = &lanDiscovery{
+		localID:     m.localID,
+		displayName: m.displayName,
+		port:        m.DirectPort(),
+		peers:       make(map[string]LANPeer),
+	}
+	sender, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+	go closeWhenDone(ctx, sender)
+	supervise(ctx, "lan announce", func(ctx context.Context) error {
+		return m.lan.announce(ctx, sender)
+	})
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{Port: lanDiscoveryPort})
+	if err != nil {
+		log.Printf("lan discovery listen failed, announcing only: %v", err)
+		return nil
+	}
+	go closeWhenDone(ctx, listener)
+	supervise(ctx, "lan discovery", func(ctx context.Context) error {
+		return m.lan.listen(ctx, listener)
+	})
+	return nil
+}
+
+// LANOnly reports whether the manager runs without a rendezvous server.
+func (m *ConnectionManager) LANOnly() bool {
+	return m.lan != nil
+}
+
+// LANPeers lists the peers heard from recently, by id.
+func (m *ConnectionManager) LANPeers() []LANPeer {
+	if m.lan == nil {
+		return nil
+	}
+	return m.lan.list()
+}
+
+// connectLAN sends an intent to targetID's announced address.
+func (m *ConnectionManager) connectLAN(ctx context.Context, targetID, purpose string) (*ChuteSession, error) {
+	peer, ok := m.lan.peer(targetID)
+	if !ok {
+		return nil, fmt.Errorf("%s not found on the local network", targetID)
+	}
+	addr, err := net.ResolveUDPAddr("udp4", peer.Addr)
+	if err != nil {
+		return nil, err
+	}
+	session, err := m.requestDirect(ctx, addr, targetID, purpose)
+	if err == nil {
+		m.reports.update(targetID, func(r *connectReport) { r.Path = pathDirect })
+	}
+	return session, err
+}
+
+func (d *lanDiscovery) announce(ctx context.Context, conn *net.UDPConn) error {
+	ticker := time.NewTicker(lanAnnounceInterval)
+	defer ticker.Stop()
+	msg, err := encodeDirectDatagram(directDatagram{Kind: "announce", ID: d.localID, DisplayName: d.displayName, Port: d.port})
+	if err != nil {
+		return fmt.Errorf("lan announce: %w", err)
+	}
+	for {
+		for _, addr := range broadcastAddrs() {
+			if _, err := conn.WriteToUDP(msg, &net.UDPAddr{IP: addr, Port: lanDiscoveryPort}); err != nil {
+				log.Printf("lan announce failed addr=%s err=%v", addr, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *lanDiscovery) listen(ctx context.Context, conn *net.UDPConn) error {
+	buf := make([]byte, directDatagramLimit)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("lan discovery: %w", err)
+		}
+		msg, ok := decodeDirectDatagram(buf[:n])
+		if !ok || msg.Kind != "announce" || msg.ID == d.localID || validateClientID(msg.ID) != nil {
+			continue
+		}
+		if msg.Port <= 0 || msg.Port > 65535 {
+			continue
+		}
+		addr := &net.UDPAddr{IP: from.IP, Port: msg.Port}
+		d.mu.Lock()
+		if _, known := d.peers[msg.ID]; !known {
+			log.Printf("lan peer found peer_id=%s addr=%s", msg.ID, addr)
+		}
+		d.peers[msg.ID] = LANPeer{ID: msg.ID, DisplayName: msg.DisplayName, Addr: addr.String(), Seen: time.Now()}
+		d.mu.Unlock()
+	}
+}
+
+func (d *lanDiscovery) peer(id string) (LANPeer, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pruneLocked()
+	peer, ok := d.peers[id]
+	return peer, ok
+}
+
+func (d *lanDiscovery) list() []LANPeer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pruneLocked()
+	peers := make([]LANPeer, 0, len(d.peers))
+	for _, p := range d.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+func (d *lanDiscovery) pruneLocked() {
+	for id, p := range d.peers {
+		if time.Since(p.Seen) > lanPeerTTL {
+			delete(d.peers, id)
+		}
+	}
+}
+
+// Helpers
+func closeWhenDone(ctx context.Context, conn *net.UDPConn) {
+	<-ctx.Done()
+	_ = conn.Close()
+}
+
+// broadcastAddrs returns the broadcast address of every IPv4 network the
+// host is on, falling back to the limited broadcast address.
+func broadcastAddrs() []net.IP {
+	var addrs []net.IP
+	ifaces, err := net.Interfaces()
+	if err == nil {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+				continue
+			}
+			ifAddrs, err := iface.Addrs()
+			if err != nil {
+				continue
+			}
+			for _, a := range ifAddrs {
+				ipNet, ok := a.(*net.IPNet)
+				if !ok {
+					continue
+				}
+				ip := ipNet.IP.To4()
+				if ip == nil || ip.IsLoopback() {
+					continue
+				}
+				mask := ipNet.Mask
+				if len(mask) == net.IPv6len {
+					mask = mask[12:]
+				}
+				if len(mask) != net.IPv4len {
+					continue
+				}
+				broadcast := make(net.IP, 4)
+				for i := range broadcast {
+					broadcast[i] = ip[i] | ^mask[i]
+				}
+				addrs = append(addrs, broadcast)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, net.IPv4bcast)
+	}
+	return addrs
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	lastSeenFile = "last_seen.json"
+
+	// lastSeenResolution is how stale a saved time may get before a new
+	// sighting is written out, so frequent sightings do not rewrite the
+	// file each time.
+	lastSeenResolution = time.Minute
+)
+
+// LastSeen is when a peer was last connected to, and when it was last
+// seen registered with the rendezvous server.
+type LastSeen struct {
+	Connected  time.Time `json:"connected,omitzero"`
+	Registered time.Time `json:"registered,omitzero"`
+}
+
+// Last seen
+//
+// A peer counts as seen registered when a lookup finds its ICE info, when
+// its connection request arrives through the server, and when presence
+// reports it online or idle. A peer that has never been seen at all is
+// more likely a wrong id than one that is offline, and failed connects
+// say which it is. A nil store records nothing.
+type lastSeenStore struct {
+	path string
+
+	mu    sync.Mutex
+	seen  map[string]LastSeen
+	saved map[string]LastSeen
+}
+
+// Storage
+func loadLastSeenStore(dir string) (*lastSeenStore, error) {
+	store := &lastSeenStore{
+		path: filepath.Join(dir, lastSeenFile),
+		seen: make(map[string]LastSeen),
+	}
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		store.saved = make(map[string]LastSeen)
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.seen); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", store.path, err)
+	}
+	store.saved = make(map[string]LastSeen, len(store.seen))
+	for id, seen := range store.seen {
+		store.saved[id] = seen
+	}
+	return store, nil
+}
+
+func (l *lastSeenStore) saveLocked() error {
+	data, err := json.MarshalIndent(l.seen, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(l.path, data, 0o600); err != nil {
+		return err
+	}
+	for id, seen := range l.seen {
+		l.saved[id] = seen
+	}
+	return nil
+}
+
+// Tracking
+func (l *lastSeenStore) markConnected(peerID string) {
+	l.mark(peerID, func(seen *LastSeen) *time.Time { return &seen.Connected })
+}
+
+func (l *lastSeenStore) markRegistered(peerID string) {
+	l.mark(peerID, func(seen *LastSeen) *time.Time { return &seen.Registered })
+}
+
+func (l *lastSeenStore) mark(peerID string, field func(*LastSeen) *time.Time) {
+	if l == nil || peerID == "" {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := l.seen[peerID]
+	*field(&seen) = now
+	l.seen[peerID] = seen
+
+	saved := l.saved[peerID]
+	if now.Sub(*field(&saved)) < lastSeenResolution {
+		return
+	}
+	if err := l.saveLocked(); err != nil {
+		log.Printf("last seen write failed err=%v", err)
+	}
+}
+
+func (l *lastSeenStore) get(peerID string) LastSeen {
+	if l == nil {
+		return LastSeen{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seen[peerID]
+}
+
+// list returns every peer seen so far.
+func (l *lastSeenStore) list() map[string]LastSeen {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string]LastSeen, len(l.seen))
+	for id, seen := range l.seen {
+		out[id] = seen
+	}
+	return out
+}
+
+// explainUnreachable adds to a failed connect's error whether peerID has
+// ever been seen, to tell an offline peer from a wrong id.
+func (l *lastSeenStore) explainUnreachable(peerID string, err error) error {
+	if l == nil {
+		return err
+	}
+	seen := l.get(peerID)
+	last := seen.Registered
+	if seen.Connected.After(last) {
+		last = seen.Connected
+	}
+	if last.IsZero() {
+		return fmt.Errorf("%w (%s has never been seen online; check the id)", err, peerID)
+	}
+	return fmt.Errorf("%w (%s last seen %s)", err, peerID, formatAgo(last))
+}
+
+// Helpers
+func formatAgo(t time.Time) string {
+	d := time.Since(t)
+	if d < time.Minute {
+		return "just now"
+	}
+	return d.Round(time.Minute).String() + " ago"
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// logRingSize is how many recent log lines are kept in memory.
+const logRingSize = 1000
+
+// recentLogs holds the latest log lines; main tees the log output into
+// it at startup.
+var recentLogs = newLogRing(logRingSize)
+
+// Log ring
+//
+// The ring keeps the tail of the log in memory so the diagnostics view
+// and bug reports can get it from a running client, without knowing
+// where, or whether, stderr was saved. The log package writes each
+// entry in one call, so every Write is stored as one line.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size)}
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	r.mu.Lock()
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+	r.mu.Unlock()
+	return len(p), nil
+}
+
+// last returns up to n of the newest lines, oldest first; n <= 0 returns
+// them all.
+func (r *logRing) last(n int) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ordered := append(append([]string(nil), r.lines[r.next:]...), r.lines[:r.next]...)
+	if !r.full {
+		ordered = r.lines[:r.next:r.next]
+	}
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return append([]string(nil), ordered...)
+}
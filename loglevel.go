@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/logging"
+	quic "github.com/quic-go/quic-go"
+	qlogging "github.com/quic-go/quic-go/logging"
+)
+
+// logSubsystems can have verbose logging switched on separately.
+var logSubsystems = []string{"ice", "quic", "rendezvous", "rpc", "transfer"}
+
+var (
+	verboseMu sync.Mutex
+	verbose   = make(map[string]bool)
+)
+
+// Verbose logging
+//
+// Normal logs cover what a user needs to follow a session. Verbose logs
+// add the detail needed to debug one and are off by default; they can be
+// switched per subsystem while the client runs, so a problem can be
+// reproduced with them on without a restart.
+
+// setVerbose switches verbose logging for the named subsystems, or all
+// of them when names is empty or "all".
+func setVerbose(names []string, on bool) error {
+	if len(names) == 0 || len(names) == 1 && names[0] == "all" {
+		names = logSubsystems
+	}
+	for _, name := range names {
+		if !isLogSubsystem(name) {
+			return fmt.Errorf("unknown log subsystem %q (want all or one of %s)", name, strings.Join(logSubsystems, ", "))
+		}
+	}
+	verboseMu.Lock()
+	defer verboseMu.Unlock()
+	for _, name := range names {
+		verbose[name] = on
+	}
+	return nil
+}
+
+// setLogLevel applies a named level, debug or info, to the named
+// subsystems.
+func setLogLevel(level string, names []string) error {
+	switch level {
+	case "debug":
+		return setVerbose(names, true)
+	case "info":
+		return setVerbose(names, false)
+	}
+	return fmt.Errorf("unknown log level %q (want debug or info)", level)
+}
+
+// verboseLevels reports whether each subsystem logs verbosely.
+func verboseLevels() map[string]bool {
+	verboseMu.Lock()
+	defer verboseMu.Unlock()
+	levels := make(map[string]bool, len(logSubsystems))
+	for _, name := range logSubsystems {
+		levels[name] = verbose[name]
+	}
+	return levels
+}
+
+func verboseOn(subsystem string) bool {
+	verboseMu.Lock()
+	defer verboseMu.Unlock()
+	return verbose[subsystem]
+}
+
+// debugf logs only while subsystem is verbose.
+func debugf(subsystem, format string, args ...any) {
+	if verboseOn(subsystem) {
+		log.Printf(subsystem+": "+format, args...)
+	}
+}
+
+// serveLogLevel shows the level of each subsystem; POST with level and
+// an optional comma-separated subsystem query parameter changes them.
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		query := r.URL.Query()
+		names := splitServers(query.Get("subsystem"))
+		if err := setLogLevel(query.Get("level"), names); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("log level changed level=%s subsystems=%s", query.Get("level"), strings.Join(names, ","))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeControlJSON(w, verboseLevels())
+}
+
+func isLogSubsystem(name string) bool {
+	for _, s := range logSubsystems {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ICE
+
+// iceLoggerFactory routes pion's logs into ours. Errors always show, as
+// with pion's default logger; everything else only when ice is verbose.
+type iceLoggerFactory struct{}
+
+func (iceLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
+	return iceLogger{scope: scope}
+}
+
+type iceLogger struct {
+	scope string
+}
+
+func (l iceLogger) Trace(msg string)                  { debugf("ice", "%s: %s", l.scope, msg) }
+func (l iceLogger) Tracef(format string, args ...any) { l.Trace(fmt.Sprintf(format, args...)) }
+func (l iceLogger) Debug(msg string)                  { debugf("ice", "%s: %s", l.scope, msg) }
+func (l iceLogger) Debugf(format string, args ...any) { l.Debug(fmt.Sprintf(format, args...)) }
+func (l iceLogger) Info(msg string)                   { debugf("ice", "%s: %s", l.scope, msg) }
+func (l iceLogger) Infof(format string, args ...any)  { l.Info(fmt.Sprintf(format, args...)) }
+func (l iceLogger) Warn(msg string)                   { debugf("ice", "%s: %s", l.scope, msg) }
+func (l iceLogger) Warnf(format string, args ...any)  { l.Warn(fmt.Sprintf(format, args...)) }
+func (l iceLogger) Error(msg string)                  { log.Printf("ice %s: %s", l.scope, msg) }
+func (l iceLogger) Errorf(format string, args ...any) { l.Error(fmt.Sprintf(format, args...)) }
+
+// QUIC
+
+// connectionTracer is the tracer of every QUIC connection: verbose quic
+// logs, plus a qlog file when -qlog is set.
+func connectionTracer(ctx context.Context, p qlogging.Perspective, odcid quic.ConnectionID) *qlogging.ConnectionTracer {
+	tracers := []*qlogging.ConnectionTracer{quicDebugTracer(odcid)}
+	if qlogDir != "" {
+		if t := qlogTracer(ctx, p, odcid); t != nil {
+			tracers = append(tracers, t)
+		}
+	}
+	return qlogging.NewMultiplexedConnectionTracer(tracers...)
+}
+
+// quicDebugTracer logs connection milestones and loss while quic is
+// verbose, checked per event so switching it on covers open connections.
+func quicDebugTracer(odcid quic.ConnectionID) *qlogging.ConnectionTracer {
+	return &qlogging.ConnectionTracer{
+		StartedConnection: func(local, remote net.Addr, _, _ qlogging.ConnectionID) {
+			debugf("quic", "connection started odcid=%s local=%s remote=%s", odcid, local, remote)
+		},
+		NegotiatedVersion: func(chosen qlogging.VersionNumber, _, _ []qlogging.VersionNumber) {
+			debugf("quic", "version negotiated odcid=%s version=%v", odcid, chosen)
+		},
+		ChoseALPN: func(protocol string) {
+			debugf("quic", "alpn chosen odcid=%s protocol=%s", odcid, protocol)
+		},
+		UpdatedPTOCount: func(value uint32) {
+			if value > 0 {
+				debugf("quic", "probe timeout odcid=%s count=%d", odcid, value)
+			}
+		},
+		LostPacket: func(level qlogging.EncryptionLevel, pn qlogging.PacketNumber, reason qlogging.PacketLossReason) {
+			debugf("quic", "packet lost odcid=%s level=%v pn=%d reason=%v", odcid, level, pn, reason)
+		},
+		DroppedPacket: func(typ qlogging.PacketType, pn qlogging.PacketNumber, size qlogging.ByteCount, reason qlogging.PacketDropReason) {
+			debugf("quic", "packet dropped odcid=%s type=%v pn=%d size=%d reason=%v", odcid, typ, pn, size, reason)
+		},
+		ClosedConnection: func(err error) {
+			debugf("quic", "connection closed odcid=%s err=%v", odcid, err)
+		},
+	}
+}
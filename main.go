@@ -2,49 +2,494 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
-	serverAddr := flag.String("server", "chute-rendezvous-server.fly.dev", "rendezvous server address (host:port)")
+	serverAddr := flag.String("server", "chute-rendezvous-server.fly.dev", "rendezvous server addresses (host:port or https://host), comma-separated for failover")
+	proxy := flag.String("proxy", "", "proxy URL for rendezvous traffic (http, https or socks5; default: HTTP_PROXY/HTTPS_PROXY)")
+	caFile := flag.String("ca-file", "", "PEM file with extra CA certificates for https rendezvous servers")
+	requestedID := flag.String("id", "", "client id or alias to claim (default: the persisted id)")
+	displayName := flag.String("name", "", "display name shown to peers you connect to")
+	downloadDir := flag.String("download-dir", defaultDownloadDir(), "directory for received files")
+	flag.DurationVar(&sessionIdle, "idle-timeout", sessionIdle, "close a session after this long without messages, transfers or open streams; pings and keepalives no longer count as use")
+	flag.DurationVar(&keepAlive, "keepalive", keepAlive, "QUIC keepalive interval (must be below -idle-timeout)")
+	flag.DurationVar(&handshakeIdle, "handshake-timeout", handshakeIdle, "QUIC and identity handshake timeout")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", heartbeatInterval, "ping the peer this often and report it unresponsive after 3 misses (0 to disable)")
+	flag.Int64Var(&messageLimit, "message-limit", messageLimit, "largest message held in memory, in bytes; longer ones are saved to the download directory")
+	flag.DurationVar(&iceConnectTimeout, "ice-timeout", iceConnectTimeout, "how long to wait for the peer and for ICE to connect")
+	profile := flag.String("profile", os.Getenv("CHUTE_PROFILE"), "named profile with its own identity, client id, contacts and settings (default: the main one)")
+	performance := flag.String("performance", defaultProfile, "performance profile for new sessions: balanced, throughput or background")
+	idle := flag.String("idle-policy", idleTransfers, "idle timeout policy: strict, or transfers to keep sessions with a pending transfer or open stream open")
+	encryptDownloads := flag.Bool("encrypt-downloads", false, "encrypt received files with a key kept in the config dir (the message inbox stays plaintext)")
+	readReceipts := flag.Bool("read-receipts", true, "tell peers when their messages have been shown")
+	guest := flag.Duration("guest", 0, "run under a throwaway client id and key for this long, e.g. 30m")
+	lanOnly := flag.Bool("lan", false, "LAN-only mode: never contact a rendezvous server, find peers by local broadcast")
+	directPort := flag.Int("direct-port", 0, "open a UDP port peers can connect to directly by address (0 picks a free one); off unless given")
+	flag.StringVar(&qlogDir, "qlog", "", "write a qlog trace of every QUIC connection to this directory")
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	controlAddr := flag.String("control-addr", defaultControlAddr, "loopback address for the control API used by chutectl (empty to disable)")
+	verboseLogs := flag.String("verbose", "", "comma-separated subsystems to log verbosely from startup: ice, quic, rendezvous, rpc, transfer or all")
+	debug := flag.Bool("debug", false, "serve pprof handlers on the debug address")
+	debugAddr := flag.String("debug-addr", defaultDebugAddr, "debug server address (host:port)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [chute://connect/<id> | pipe [id] | send <id> <file> | connect <id> | status | daemon | service install|uninstall|run]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
 
 	// Startup
-	clientID, err := generateClientID()
-	if err != nil {
-		panic(err)
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+	serviceRun := flag.Arg(0) == "service" && flag.Arg(1) == "run"
+	if flag.Arg(0) == "service" && !serviceRun {
+		runServiceCommand(flag.Arg(1), *profile)
+		return
+	}
+	if err := validateTimeouts(); err != nil {
+		log.Fatalf("invalid timeouts: %v", err)
+	}
+	if qlogDir != "" {
+		if err := os.MkdirAll(qlogDir, 0o700); err != nil {
+			log.Fatalf("create qlog dir failed: %v", err)
+		}
+		log.Printf("writing qlog traces dir=%s", qlogDir)
+	}
+	if *guest < 0 || *guest > maxGuestTTL {
+		log.Fatalf("guest lifetime must be between 0 and %s", maxGuestTTL)
+	}
+	guestMode := *guest > 0
+	if guestMode && *requestedID != "" {
+		log.Fatalf("-guest and -id cannot be combined")
+	}
+
+	var startupTarget string
+	pipeMode := flag.Arg(0) == "pipe"
+	oneShot := oneShotCommands[flag.Arg(0)]
+	daemonMode := flag.Arg(0) == "daemon" || serviceRun
+	if *controlAddr != "" && !isLoopbackAddr(*controlAddr) {
+		log.Fatalf("control address must be loopback: %s", *controlAddr)
+	}
+	if pipeMode {
+		startupTarget = flag.Arg(1)
+	} else if link := flag.Arg(0); link != "" && !oneShot && !daemonMode {
+		id, ok := parseDeepLink(link)
+		if !ok {
+			log.Fatalf("unsupported link: %s", link)
+		}
+		startupTarget = id
+	}
+
+	// Pipe mode owns stdout, and one-shot commands keep it for their
+	// result, so status lines go to stderr.
+	out := os.Stdout
+	if pipeMode || oneShot {
+		out = os.Stderr
 	}
 
-	fmt.Println("chute client starting")
-	fmt.Printf("client id: %s\n", formatClientID(clientID))
-	fmt.Printf("server: %s\n", *serverAddr)
+	if *caFile != "" {
+		if err := configureRendezvousCA(*caFile); err != nil {
+			log.Fatalf("load ca file failed: %v", err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	dir, err := configDir()
+	if err != nil {
+		log.Fatalf("config dir failed: %v", err)
+	}
+	if dir, err = profileDir(dir, *profile); err != nil {
+		log.Fatalf("profile failed: %v", err)
+	}
+	// A service has no console, so it logs to a file in its config dir.
+	var serviceStop <-chan struct{}
+	serviceDone := func() {}
+	if serviceRun {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			log.Fatalf("config dir failed: %v", err)
+		}
+		logFile, err := os.OpenFile(filepath.Join(dir, serviceLogFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalf("open service log failed: %v", err)
+		}
+		log.SetOutput(io.MultiWriter(logFile, recentLogs))
+		if serviceStop, serviceDone, err = startServiceControl(); err != nil {
+			log.Fatalf("service control failed: %v", err)
+		}
+	}
+	// Profiles run side by side, so only the main one gets the fixed
+	// control port; the others pick a free one and publish it in their
+	// own control.json.
+	namedProfile := *profile != "" && *profile != "default"
+	if namedProfile && !flagGiven("control-addr") {
+		*controlAddr = "127.0.0.1:0"
+	}
+	// A guest runs beside the regular instance and never touches its
+	// control file or stores.
+	if !guestMode {
+		if err := lockInstance(dir); errors.Is(err, errInstanceLocked) {
+			if info, status, running := findRunningInstance(dir); running {
+				if oneShot {
+					os.Exit(forwardOneShot(info, flag.Args()))
+				}
+				log.Fatalf("chute is already running (pid %d, client id %s); use chutectl to control it", info.PID, status.ClientID)
+			}
+			log.Fatalf("chute is already running with config dir %s", dir)
+		} else if err != nil {
+			log.Fatalf("instance lock failed: %v", err)
+		}
+	}
+	settings, err := loadSettings(dir)
+	if err != nil {
+		log.Fatalf("load settings failed: %v", err)
+	}
+	applySettings(settings, serverAddr, downloadDir, proxy, performance, idle, verboseLogs, encryptDownloads, lanOnly)
+	if *lanOnly && guestMode {
+		log.Fatalf("-guest needs a rendezvous server and cannot be combined with -lan")
+	}
+	if err := configureRendezvousProxy(*proxy); err != nil {
+		log.Fatalf("invalid proxy: %v", err)
+	}
+	if err := setPerformanceProfile(*performance); err != nil {
+		log.Fatalf("invalid performance profile: %v", err)
+	}
+	if err := setIdlePolicy(*idle); err != nil {
+		log.Fatalf("invalid idle policy: %v", err)
+	}
+	if *verboseLogs != "" {
+		if err := setVerbose(splitServers(*verboseLogs), true); err != nil {
+			log.Fatalf("invalid verbose subsystems: %v", err)
+		}
+	}
+	var identity ed25519.PrivateKey
+	if guestMode {
+		identity, err = newGuestIdentity()
+	} else {
+		identity, err = loadOrCreateIdentity(dir)
+	}
+	if err != nil {
+		log.Fatalf("load identity failed: %v", err)
+	}
+	useRendezvousIdentity(identity)
+	var pins *pinStore
+	var peerSettings *peerSettingsStore
+	var shares *shareStore
+	var usage *usageStore
+	var lastSeen *lastSeenStore
+	var spool *messageSpool
+	if !guestMode {
+		if pins, err = loadPinStore(dir); err != nil {
+			log.Fatalf("load pins failed: %v", err)
+		}
+		if peerSettings, err = loadPeerSettingsStore(dir); err != nil {
+			log.Fatalf("load peer settings failed: %v", err)
+		}
+		if shares, err = loadShareStore(dir); err != nil {
+			log.Fatalf("load shares failed: %v", err)
+		}
+		if usage, err = loadUsageStore(dir); err != nil {
+			log.Fatalf("load usage failed: %v", err)
+		}
+		if lastSeen, err = loadLastSeenStore(dir); err != nil {
+			log.Fatalf("load last seen failed: %v", err)
+		}
+		// The inbox is a cache of past messages; losing part of it is no
+		// reason not to start.
+		if spool, err = loadMessageSpool(dir); err != nil {
+			log.Printf("load inbox failed, keeping what was read: %v", err)
+		}
+		if settings.LegacyShareDir != "" {
+			if err := migrateShareDir(dir, settings.LegacyShareDir, shares, pins); err != nil {
+				log.Printf("share-dir not migrated: %v", err)
+			} else {
+				settings.LegacyShareDir = ""
+				if err := saveSettings(dir, settings); err != nil {
+					log.Printf("save settings failed: %v", err)
+				}
+			}
+		}
+	}
+
+	var clientID string
+	var guestUntil time.Time
+	claimed := true
+	switch {
+	case *lanOnly:
+		clientID, err = localClientID(dir, *requestedID)
+	case guestMode:
+		guestUntil = time.Now().Add(*guest)
+		clientID, err = claimGuestID(ctx, *serverAddr, *guest)
+	default:
+		clientID, claimed, err = claimPersistentClientID(ctx, dir, *serverAddr, *requestedID)
+	}
+	if err != nil {
+		log.Fatalf("client id failed: %v", err)
+	}
+
+	fmt.Fprintln(out, "chute client starting")
+	fmt.Fprintf(out, "version: %s (%s)\n", version, commit)
+	if namedProfile {
+		fmt.Fprintf(out, "profile: %s\n", *profile)
+	}
+	fmt.Fprintf(out, "client id: %s\n", formatClientID(clientID))
+	if guestMode {
+		fmt.Fprintf(out, "guest id, valid until %s\n", guestUntil.Format("15:04:05"))
+	}
+	fmt.Fprintf(out, "identity: %s\n", identityFingerprint(identity.Public().(ed25519.PublicKey)))
+	if *lanOnly {
+		fmt.Fprintln(out, "server: none, LAN only")
+	} else {
+		fmt.Fprintf(out, "server: %s\n", *serverAddr)
+	}
+	fmt.Fprintf(out, "downloads: %s\n", *downloadDir)
+	if !claimed {
+		fmt.Fprintln(out, "rendezvous server unreachable, starting offline")
+	}
+
+	if *debug {
+		startDebugServer(*debugAddr)
+	}
+
 	client := NewClient(clientID, *serverAddr)
+	client.SetDownloadDir(*downloadDir)
+	// Guests keep no settings or history, so nothing lands in the main
+	// profile's files.
+	if !guestMode {
+		client.SetConfigDir(dir)
+	}
+	client.SetPinStore(pins)
+	client.SetPeerSettingsStore(peerSettings)
+	client.SetShareStore(shares)
+	client.SetUsageStore(usage)
+	client.SetLastSeenStore(lastSeen)
+	client.SetMessageSpool(spool)
+	if *encryptDownloads {
+		key, err := loadOrCreateStorageKey(dir)
+		if err != nil {
+			log.Fatalf("load storage key failed: %v", err)
+		}
+		client.SetStorageKey(key)
+	}
+	client.SetAutoAcceptFrom(settings.AutoAcceptFrom)
+	client.SetDisplayName(*displayName)
+	// Guests never list their throwaway id.
+	client.SetDirectoryListed(settings.Directory && !guestMode)
+	client.SetIdentity(identity)
+	client.SetReadReceipts(*readReceipts)
+	if guestMode {
+		client.SetGuestUntil(guestUntil)
+	}
+	if !claimed {
+		client.SetOffline()
+	}
 	manager := NewConnectionManager(clientID, *serverAddr)
 	manager.SetSessionSetter(client.SetSession)
+	manager.SetDisplayName(*displayName)
+	manager.SetIdentity(identity)
+	manager.SetPinStore(pins)
+	manager.SetUsageStore(usage)
+	manager.SetLastSeenStore(lastSeen)
+	manager.SetPinWarning(func(mismatch *pinMismatchError) {
+		printPinWarning(out, mismatch)
+	})
+	manager.SetIntentHandler(func(intent IntentInfo) {
+		client.HandleIntent(ctx, manager, intent)
+	})
+	manager.SetConnectProgress(client.connectProgress)
+	client.RegisterPullHandlers(manager)
+	if *lanOnly {
+		client.SetLANOnly(true)
+		if err := manager.EnableLAN(ctx, *directPort); err != nil {
+			log.Fatalf("lan mode failed: %v", err)
+		}
+	} else if flagGiven("direct-port") && !guestMode {
+		if err := manager.EnableDirect(ctx, *directPort); err != nil {
+			log.Printf("direct connections disabled: %v", err)
+		}
+	}
+	if port := manager.DirectPort(); port != 0 {
+		fmt.Fprintf(out, "direct port: %d\n", port)
+	}
 	go handleSignals(client, cancel)
-	go client.StartPolling(ctx, manager)
+	go handleReload(ctx, client)
+	if guestMode {
+		go expireGuest(client, cancel, guestUntil)
+	}
+
+	if pipeMode {
+		pipeErr := runPipe(ctx, client, manager, startupTarget)
+		shutdown(client, cancel)
+		if pipeErr != nil {
+			log.Printf("pipe failed: %v", pipeErr)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if oneShot {
+		code := runOneShot(ctx, client, manager, flag.Args())
+		shutdown(client, cancel)
+		os.Exit(code)
+	}
+
+	if *controlAddr != "" && !guestMode {
+		if err := startControlServer(ctx, *controlAddr, dir, client, manager); err != nil {
+			log.Printf("control api disabled: %v", err)
+		}
+	}
+	if !*lanOnly {
+		supervise(ctx, "intent polling", func(ctx context.Context) error {
+			client.StartPolling(ctx, manager)
+			return nil
+		})
+		supervise(ctx, "registration heartbeat", func(ctx context.Context) error {
+			client.StartHeartbeat(ctx)
+			return nil
+		})
+		supervise(ctx, "directory listing", func(ctx context.Context) error {
+			client.StartDirectory(ctx)
+			return nil
+		})
+		supervise(ctx, "presence", func(ctx context.Context) error {
+			client.StartPresence(ctx)
+			return nil
+		})
+	}
 
-	runCLI(ctx, cancel, client, manager, clientID, *serverAddr)
+	if daemonMode {
+		log.Printf("running as daemon client_id=%s", clientID)
+		select {
+		case <-ctx.Done():
+		case <-serviceStop:
+			shutdown(client, cancel)
+		}
+		serviceDone()
+		return
+	}
+	runCLI(ctx, client, manager, clientID, *serverAddr, startupTarget)
+	shutdown(client, cancel)
+}
+
+func validateTimeouts() error {
+	if sessionIdle <= 0 || handshakeIdle <= 0 || iceConnectTimeout <= 0 {
+		return errors.New("timeouts must be positive")
+	}
+	if heartbeatInterval < 0 {
+		return errors.New("heartbeat interval must not be negative")
+	}
+	if messageLimit <= 0 {
+		return errors.New("message limit must be positive")
+	}
+	if keepAlive < 0 || keepAlive >= sessionIdle {
+		return fmt.Errorf("keepalive %s must be below idle timeout %s", keepAlive, sessionIdle)
+	}
+	return nil
+}
+
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// applySettings fills in values from the settings file for flags that
+// were not given on the command line.
+func applySettings(settings Settings, serverAddr, downloadDir, proxy, performance, idle, verboseLogs *string, encryptDownloads, lanOnly *bool) {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if settings.Server != "" && !explicit["server"] {
+		*serverAddr = settings.Server
+	}
+	if settings.DownloadDir != "" && !explicit["download-dir"] {
+		*downloadDir = settings.DownloadDir
+	}
+	if settings.Proxy != "" && !explicit["proxy"] {
+		*proxy = settings.Proxy
+	}
+	if settings.Performance != "" && !explicit["performance"] {
+		*performance = settings.Performance
+	}
+	if settings.IdlePolicy != "" && !explicit["idle-policy"] {
+		*idle = settings.IdlePolicy
+	}
+	if len(settings.Verbose) > 0 && !explicit["verbose"] {
+		*verboseLogs = strings.Join(settings.Verbose, ",")
+	}
+	if settings.EncryptDownloads && !explicit["encrypt-downloads"] {
+		*encryptDownloads = true
+	}
+	if settings.LANOnly && !explicit["lan"] {
+		*lanOnly = true
+	}
+	setConfiguredSTUNServers(settings.STUNServers)
 }
 
 // Shutdown
+// handleReload reloads the settings file on SIGHUP.
+func handleReload(ctx context.Context, client *Client) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			if err := client.ReloadSettings(); err != nil {
+				log.Printf("settings reload failed: %v", err)
+			}
+		}
+	}
+}
+
 func handleSignals(client *Client, cancel context.CancelFunc) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	<-sigs
+	shutdown(client, cancel)
+	os.Exit(0)
+}
+
+// shutdown closes the session, cancels the app context so every loop,
+// listener and socket tied to it is released, unregisters, and waits for
+// the supervised loops to return.
+func shutdown(client *Client, cancel context.CancelFunc) {
 	_ = client.Disconnect()
 	cancel()
-	if err := client.Unregister(); err != nil {
+	unregister(client)
+	if !loops.wait(loopStopTimeout) {
+		for _, loop := range loops.health() {
+			log.Printf("loop still running at exit name=%s", loop.Name)
+		}
+	}
+}
+
+func unregister(client *Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), unregisterTimeout)
+	defer cancel()
+	if err := client.Unregister(ctx); err != nil {
 		log.Printf("unregister failed: %v", err)
 	}
-	os.Exit(0)
 }
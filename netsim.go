@@ -0,0 +1,141 @@
+//go:build netsim
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Network simulation
+//
+// Building with -tags netsim wraps every session's packet conn in a
+// simConn configured from CHUTE_NETSIM, e.g.
+//
+//	CHUTE_NETSIM="latency=80ms,jitter=20ms,loss=0.02,reorder=0.05,seed=7"
+//
+// or by enableNetSim from a test. Outgoing packets are dropped, delayed,
+// and reordered using a generator seeded from the explicit seed, so a
+// given seed makes the same decisions on every run.
+func init() {
+	spec := os.Getenv("CHUTE_NETSIM")
+	if spec == "" {
+		return
+	}
+	cfg, err := parseSimConfig(spec)
+	if err != nil {
+		log.Fatalf("invalid CHUTE_NETSIM: %v", err)
+	}
+	enableNetSim(cfg)
+}
+
+// enableNetSim impairs every packet conn opened from now on with cfg.
+func enableNetSim(cfg simConfig) {
+	log.Printf("netsim enabled latency=%s jitter=%s loss=%.3f reorder=%.3f seed=%d", cfg.Latency, cfg.Jitter, cfg.Loss, cfg.Reorder, cfg.Seed)
+	wrapPacketConn = func(conn net.PacketConn) net.PacketConn {
+		return newSimConn(conn, cfg)
+	}
+}
+
+type simConfig struct {
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64
+	Reorder float64
+	Seed    int64
+}
+
+// parseSimConfig reads a CHUTE_NETSIM spec. The seed must be given, so
+// every impaired run can be repeated.
+func parseSimConfig(spec string) (simConfig, error) {
+	var cfg simConfig
+	seeded := false
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return cfg, fmt.Errorf("expected key=value, got %q", field)
+		}
+		var err error
+		switch key {
+		case "latency":
+			cfg.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			cfg.Jitter, err = time.ParseDuration(value)
+		case "loss":
+			cfg.Loss, err = strconv.ParseFloat(value, 64)
+		case "reorder":
+			cfg.Reorder, err = strconv.ParseFloat(value, 64)
+		case "seed":
+			cfg.Seed, err = strconv.ParseInt(value, 10, 64)
+			seeded = true
+		default:
+			return cfg, fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	if !seeded {
+		return cfg, errors.New("seed is required, e.g. seed=1")
+	}
+	return cfg, nil
+}
+
+// simConn impairs writes only; the peer's simConn impairs the other
+// direction.
+type simConn struct {
+	net.PacketConn
+	cfg simConfig
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func newSimConn(conn net.PacketConn, cfg simConfig) *simConn {
+	return &simConn{
+		PacketConn: conn,
+		cfg:        cfg,
+		rng:        rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+func (c *simConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	drop, delay := c.decide()
+	if drop {
+		return len(p), nil
+	}
+	if delay <= 0 {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	packet := append([]byte(nil), p...)
+	time.AfterFunc(delay, func() {
+		_, _ = c.PacketConn.WriteTo(packet, addr)
+	})
+	return len(p), nil
+}
+
+// decide draws the fate of one packet. Reordered packets are held back an
+// extra latency so later packets overtake them.
+func (c *simConn) decide() (bool, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rng.Float64() < c.cfg.Loss {
+		return true, 0
+	}
+	delay := c.cfg.Latency
+	if c.cfg.Jitter > 0 {
+		delay += time.Duration(c.rng.Int63n(int64(2*c.cfg.Jitter))) - c.cfg.Jitter
+	}
+	if c.rng.Float64() < c.cfg.Reorder {
+		delay += c.cfg.Latency + c.cfg.Jitter
+	}
+	return false, delay
+}
@@ -0,0 +1,94 @@
+//go:build netsim
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseSimConfig(t *testing.T) {
+	cfg, err := parseSimConfig("latency=80ms,jitter=20ms,loss=0.02,reorder=0.05,seed=7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := simConfig{Latency: 80 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.02, Reorder: 0.05, Seed: 7}
+	if cfg != want {
+		t.Fatalf("parsed %+v, want %+v", cfg, want)
+	}
+	for _, spec := range []string{"latency=80ms", "seed=x", "latency", "speed=1,seed=1"} {
+		if _, err := parseSimConfig(spec); err == nil {
+			t.Errorf("parseSimConfig(%q) accepted", spec)
+		}
+	}
+}
+
+func TestSimConnSeedRepeats(t *testing.T) {
+	cfg := simConfig{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.2, Reorder: 0.2, Seed: 42}
+	a, b := newSimConn(nil, cfg), newSimConn(nil, cfg)
+	for i := range 1000 {
+		dropA, delayA := a.decide()
+		dropB, delayB := b.decide()
+		if dropA != dropB || delayA != delayB {
+			t.Fatalf("packet %d: seed %d decided differently", i, cfg.Seed)
+		}
+	}
+}
+
+// TestSessionOverNetSim runs a session over impaired loopback sockets and
+// checks that every message still arrives.
+func TestSessionOverNetSim(t *testing.T) {
+	cfg := simConfig{Latency: 5 * time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.05, Reorder: 0.1, Seed: 3}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	listen := func() net.PacketConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	aliceConn, bobConn := listen(), listen()
+	alice := NewChuteSession(newSimConn(aliceConn, cfg), "alice", nil)
+	bob := NewChuteSession(newSimConn(bobConn, cfg), "bob", nil)
+	defer alice.Close()
+	defer bob.Close()
+	bob.Start(ctx)
+
+	bobAddr := bobConn.LocalAddr().(*net.UDPAddr)
+	if err := alice.ConnectWithContext(ctx, PeerEndpoint{IP: bobAddr.IP.String(), Port: bobAddr.Port}, "bob"); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	const messages = 50
+	received := make(chan []byte, messages)
+	go func() {
+		for range messages {
+			select {
+			case msg := <-bob.Messages():
+				received <- msg
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := range messages {
+		state, err := alice.Deliver(ctx, []byte{byte(i)})
+		if err != nil || state != DeliveryDelivered {
+			t.Fatalf("deliver %d: state=%v err=%v", i, state, err)
+		}
+	}
+	for i := range messages {
+		select {
+		case msg := <-received:
+			if len(msg) != 1 || msg[0] != byte(i) {
+				t.Fatalf("message %d arrived as %v", i, msg)
+			}
+		case <-ctx.Done():
+			t.Fatalf("message %d never arrived", i)
+		}
+	}
+}
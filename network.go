@@ -2,20 +2,37 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func postJSON(serverAddr, path string, payload any, response any, okStatuses ...int) error {
+func postJSON(ctx context.Context, serverAddr, path string, payload any, response any, okStatuses ...int) error {
 	body, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
 
-	url := "http://" + serverAddr + path
-	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	resp, err := postWithRetry(ctx, serverAddr, path, body)
 	if err != nil {
 		return err
 	}
@@ -23,7 +40,7 @@ func postJSON(serverAddr, path string, payload any, response any, okStatuses ...
 
 	for _, status := range okStatuses {
 		if resp.StatusCode == status {
-			if response != nil {
+			if response != nil && status != http.StatusNoContent {
 				if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
 					return err
 				}
@@ -32,28 +49,360 @@ func postJSON(serverAddr, path string, payload any, response any, okStatuses ...
 		}
 	}
 
-	return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	return newServerError(path, resp)
 }
 
-func postJSONWithStatus(serverAddr, path string, payload any, response any) (int, error) {
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return 0, err
+// Server errors
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrRateLimited = errors.New("rate limited by rendezvous server")
+	ErrForbidden   = errors.New("refused by rendezvous server")
+	ErrIDTaken     = errors.New("client id already taken")
+)
+
+// ServerError is a rendezvous response with an unexpected status. It
+// unwraps to ErrNotFound, ErrForbidden, ErrIDTaken or ErrRateLimited
+// where the status has one of those meanings; a 409 is ErrIDTaken only
+// from /register and /claim.
+type ServerError struct {
+	Path       string
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+const serverErrorBodyLimit = 4096
+
+func newServerError(path string, resp *http.Response) *ServerError {
+	e := &ServerError{Path: path, Status: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, serverErrorBodyLimit))
+	var structured struct {
+		Error   string `json:"error"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &structured) == nil {
+		e.Code = structured.Code
+		e.Message = structured.Error
+		if e.Message == "" {
+			e.Message = structured.Message
+		}
+	} else {
+		e.Message = strings.TrimSpace(string(data))
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
+func (e *ServerError) Error() string {
+	text := fmt.Sprintf("rendezvous %s: %d %s", e.Path, e.Status, http.StatusText(e.Status))
+	if e.Message != "" {
+		text += ": " + e.Message
+	}
+	return text
+}
+
+func (e *ServerError) Unwrap() error {
+	switch e.Status {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusConflict:
+		// Only registering or claiming an ID can conflict with its owner.
+		if e.Path == "/register" || e.Path == "/claim" {
+			return ErrIDTaken
+		}
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
 	}
+	return nil
+}
+
+// Retries
+//
+// Idempotent calls are retried when every server failed or answered with
+// a server error, with exponential backoff and jitter so many clients
+// recovering from the same outage do not retry in lockstep. /poll hands
+// out an intent once and /intent and /decline notify a peer, so those
+// are never repeated.
+const (
+	rendezvousRetries    = 3
+	rendezvousBackoff    = 250 * time.Millisecond
+	rendezvousMaxBackoff = 4 * time.Second
+)
+
+var idempotentPaths = map[string]bool{
+	"/register":         true,
+	"/lookup":           true,
+	"/claim":            true,
+	"/unregister":       true,
+	"/turn-credentials": true,
+}
+
+func postWithRetry(ctx context.Context, serverAddr, path string, body []byte) (*http.Response, error) {
+	attempts := 1
+	if idempotentPaths[path] {
+		attempts += rendezvousRetries
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := postWithFailover(ctx, serverAddr, path, body)
+		retryable := err != nil || resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
+		if !retryable || attempt == attempts || ctx.Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		delay := retryDelay(attempt, rendezvousBackoff, rendezvousMaxBackoff)
+		log.Printf("rendezvous retry path=%s attempt=%d delay=%s err=%v", path, attempt, delay.Round(time.Millisecond), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryDelay doubles from base up to limit and picks uniformly from the
+// upper half of that, so it never drops close to zero.
+func retryDelay(attempt int, base, limit time.Duration) time.Duration {
+	d := base << (attempt - 1)
+	if d > limit || d <= 0 {
+		d = limit
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// Server failover
+func postWithFailover(ctx context.Context, serverAddr, path string, body []byte) (*http.Response, error) {
+	servers := rendezvousHealth.order(splitServers(serverAddr))
+	if len(servers) == 0 {
+		return nil, errors.New("no rendezvous server configured")
+	}
+
+	var lastErr error
+	for i, server := range servers {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL(server, path), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		signRequest(req, body)
+
+		debugf("rendezvous", "request server=%s path=%s bytes=%d", server, path, len(body))
+		start := time.Now()
+		resp, err := currentRendezvousClient().Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			debugf("rendezvous", "request failed server=%s path=%s err=%v", server, path, err)
+			rendezvousHealth.markFailure(server, err)
+			lastErr = err
+			continue
+		}
+		debugf("rendezvous", "response server=%s path=%s status=%d took=%s", server, path, resp.StatusCode, time.Since(start).Round(time.Millisecond))
+		if resp.StatusCode >= http.StatusInternalServerError && i < len(servers)-1 {
+			resp.Body.Close()
+			rendezvousHealth.markFailure(server, fmt.Errorf("unexpected status: %d", resp.StatusCode))
+			continue
+		}
+		rendezvousHealth.markSuccess(server)
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+func splitServers(serverAddr string) []string {
+	var servers []string
+	for _, server := range strings.Split(serverAddr, ",") {
+		server = strings.TrimSpace(server)
+		if server != "" {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
 
-	url := "http://" + serverAddr + path
-	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+// serverURL builds the request URL for a server. Addresses without a
+// scheme keep the historical plain-HTTP behavior.
+func serverURL(server, path string) string {
+	if strings.HasPrefix(server, "http://") || strings.HasPrefix(server, "https://") {
+		return strings.TrimSuffix(server, "/") + path
+	}
+	return "http://" + server + path
+}
+
+// HTTP client
+//
+// Rendezvous calls are small, so every stage gets a short timeout: a dead
+// server or a proxy that swallows the connection should fail over to the
+// next server instead of hanging registration.
+const (
+	rendezvousDialTimeout    = 10 * time.Second
+	rendezvousTLSTimeout     = 10 * time.Second
+	rendezvousHeaderTimeout  = 15 * time.Second
+	rendezvousRequestTimeout = 30 * time.Second
+)
+
+// The rendezvous client is rebuilt when the proxy or CA changes, which a
+// reload can do while requests are in flight; rendezvousClientMu guards
+// all three.
+var (
+	rendezvousClientMu sync.Mutex
+	rendezvousClient   = newRendezvousClient()
+	rendezvousCAs      *x509.CertPool
+	rendezvousProxy    *url.URL
+)
+
+func currentRendezvousClient() *http.Client {
+	rendezvousClientMu.Lock()
+	defer rendezvousClientMu.Unlock()
+	return rendezvousClient
+}
+
+// newRendezvousClient builds a client for the current proxy and CA. It
+// runs with rendezvousClientMu held, except at init.
+func newRendezvousClient() *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if rendezvousProxy != nil {
+		proxy = http.ProxyURL(rendezvousProxy)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: rendezvousDialTimeout}).DialContext,
+		TLSHandshakeTimeout:   rendezvousTLSTimeout,
+		ResponseHeaderTimeout: rendezvousHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   2,
+	}
+	if rendezvousCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: rendezvousCAs}
+	}
+	return &http.Client{Transport: transport, Timeout: rendezvousRequestTimeout}
+}
+
+func configureRendezvousCA(caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool, err := x509.SystemCertPool()
 	if err != nil {
-		return 0, err
+		pool = x509.NewCertPool()
 	}
-	defer resp.Body.Close()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", caFile)
+	}
+	rendezvousClientMu.Lock()
+	rendezvousCAs = pool
+	rendezvousClient = newRendezvousClient()
+	rendezvousClientMu.Unlock()
+	return nil
+}
 
-	if response != nil && resp.StatusCode == http.StatusOK {
-		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
-			return resp.StatusCode, err
+// configureRendezvousProxy routes rendezvous traffic through an http,
+// https or socks5 proxy URL. Empty goes back to HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY from the environment.
+func configureRendezvousProxy(raw string) error {
+	var proxy *url.URL
+	if raw != "" {
+		parsed, err := parseProxyURL(raw)
+		if err != nil {
+			return err
 		}
+		proxy = parsed
+	}
+	rendezvousClientMu.Lock()
+	rendezvousProxy = proxy
+	rendezvousClient = newRendezvousClient()
+	rendezvousClientMu.Unlock()
+	return nil
+}
+
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("proxy %q: want an http, https or socks5 URL", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q: missing host", raw)
+	}
+	return u, nil
+}
+
+// Request signing
+var rendezvousIdentity ed25519.PrivateKey
+
+// useRendezvousIdentity makes every rendezvous request carry a signature
+// from the client's persistent identity key, so the server can bind a
+// client ID to its key and reject unregister/intent calls from others.
+func useRendezvousIdentity(key ed25519.PrivateKey) {
+	rendezvousIdentity = key
+}
+
+func signRequest(req *http.Request, body []byte) {
+	if rendezvousIdentity == nil {
+		return
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	digest := sha256.Sum256(body)
+	message := req.Method + " " + req.URL.Path + "\n" + timestamp + "\n" + hex.EncodeToString(digest[:])
+	signature := ed25519.Sign(rendezvousIdentity, []byte(message))
+
+	pub := rendezvousIdentity.Public().(ed25519.PublicKey)
+	req.Header.Set("X-Chute-Key", base64.StdEncoding.EncodeToString(pub))
+	req.Header.Set("X-Chute-Timestamp", timestamp)
+	req.Header.Set("X-Chute-Signature", base64.StdEncoding.EncodeToString(signature))
+}
+
+// Server health
+var rendezvousHealth = &serverHealth{failures: make(map[string]int)}
+
+type serverHealth struct {
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+// order returns servers with healthy ones first, keeping the configured
+// order among servers with the same number of consecutive failures.
+func (h *serverHealth) order(servers []string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ordered := append([]string(nil), servers...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return h.failures[ordered[i]] < h.failures[ordered[j]]
+	})
+	return ordered
+}
+
+func (h *serverHealth) markFailure(server string, err error) {
+	h.mu.Lock()
+	h.failures[server]++
+	failures := h.failures[server]
+	h.mu.Unlock()
+	if failures == 1 {
+		log.Printf("rendezvous server down server=%s err=%v", server, err)
+	}
+}
+
+func (h *serverHealth) markSuccess(server string) {
+	h.mu.Lock()
+	failures := h.failures[server]
+	h.failures[server] = 0
+	h.mu.Unlock()
+	if failures > 0 {
+		log.Printf("rendezvous server recovered server=%s", server)
 	}
-	return resp.StatusCode, nil
 }
 
 func sendUDP(conn *net.UDPConn, peerIP string, peerPort int, payload []byte) error {
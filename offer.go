@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v2"
+)
+
+const (
+	offerTimeout   = 10 * time.Minute
+	signalPrefix   = "chute1."
+	signalMaxBytes = 16 << 10
+)
+
+// signalBlob is an offer or answer passed between users by hand. Keys
+// are short to keep the pasted text small.
+type signalBlob struct {
+	Kind        string   `json:"k"`
+	ID          string   `json:"i"`
+	DisplayName string   `json:"n,omitempty"`
+	Ufrag       string   `json:"u"`
+	Password    string   `json:"p"`
+	Candidates  []string `json:"c"`
+	ReplyTo     string   `json:"r,omitempty"`
+}
+
+// pendingOffer is an exported offer waiting for its answer.
+type pendingOffer struct {
+	agent *ice.Agent
+	info  IceInfo
+	timer *time.Timer
+}
+
+// Offer & answer
+//
+// Offers replace the rendezvous server with copy and paste, SDP style.
+// The offerer exports its ICE credentials and candidates; the other side
+// pastes them, gets an answer to send back, and starts checking at once.
+// Pasting the answer makes the offerer lead the ICE checks, since its
+// pairs are fresh while the answerer's early checks may have given up;
+// the answerer still responds and picks the pair the offerer nominates.
+// Only one offer is open at a time and it lapses after offerTimeout.
+
+// CreateOffer gathers candidates and returns the offer to send.
+func (m *ConnectionManager) CreateOffer(ctx context.Context) (string, error) {
+	agent, info, err := m.createICEAgent(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	blob, err := encodeSignalBlob(signalBlob{
+		Kind:        "offer",
+		ID:          m.localID,
+		DisplayName: m.displayName,
+		Ufrag:       info.Ufrag,
+		Password:    info.Password,
+		Candidates:  info.Candidates,
+	})
+	if err != nil {
+		_ = agent.Close()
+		return "", err
+	}
+
+	offer := &pendingOffer{agent: agent, info: info}
+	offer.timer = time.AfterFunc(offerTimeout, func() {
+		if m.takeOffer(offer.info.Ufrag) != nil {
+			log.Printf("offer expired")
+			_ = agent.Close()
+		}
+	})
+	m.offerMu.Lock()
+	old := m.offer
+	m.offer = offer
+	m.offerMu.Unlock()
+	if old != nil {
+		old.timer.Stop()
+		_ = old.agent.Close()
+	}
+	log.Printf("offer created candidates=%d", len(info.Candidates))
+	return blob, nil
+}
+
+// Paste takes a blob from the other side. For an offer it returns the
+// answer to send back and connects in the background; for an answer to
+// our open offer it connects and returns the session.
+func (m *ConnectionManager) Paste(ctx context.Context, text string) (string, *ChuteSession, error) {
+	blob, err := decodeSignalBlob(text)
+	if err != nil {
+		return "", nil, err
+	}
+	switch blob.Kind {
+	case "offer":
+		answer, err := m.answerOffer(ctx, blob)
+		return answer, nil, err
+	case "answer":
+		session, err := m.completeOffer(ctx, blob)
+		return "", session, err
+	}
+	return "", nil, fmt.Errorf("unknown blob kind %q", blob.Kind)
+}
+
+func (m *ConnectionManager) answerOffer(ctx context.Context, offer signalBlob) (string, error) {
+	agent, info, err := m.createICEAgent(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	answer, err := encodeSignalBlob(signalBlob{
+		Kind:        "answer",
+		ID:          m.localID,
+		DisplayName: m.displayName,
+		Ufrag:       info.Ufrag,
+		Password:    info.Password,
+		Candidates:  info.Candidates,
+		ReplyTo:     offer.Ufrag,
+	})
+	if err != nil {
+		_ = agent.Close()
+		return "", err
+	}
+
+	remote := IceInfo{ID: offer.ID, Ufrag: offer.Ufrag, Password: offer.Password, Candidates: offer.Candidates}
+	log.Printf("offer answered peer_id=%s, waiting for the answer to be pasted", offer.ID)
+	go func() {
+		if _, err := m.startICE(ctx, agent, m.localID, offer.ID, remote, iceStart{timeout: offerTimeout}); err != nil {
+			log.Printf("offer connect failed peer_id=%s err=%v", offer.ID, err)
+		}
+	}()
+	return answer, nil
+}
+
+func (m *ConnectionManager) completeOffer(ctx context.Context, answer signalBlob) (*ChuteSession, error) {
+	offer := m.takeOffer(answer.ReplyTo)
+	if offer == nil {
+		return nil, errors.New("answer does not match an open offer")
+	}
+	offer.timer.Stop()
+	remote := IceInfo{ID: answer.ID, Ufrag: answer.Ufrag, Password: answer.Password, Candidates: answer.Candidates}
+	return m.startICE(ctx, offer.agent, m.localID, answer.ID, remote, iceStart{controlling: true, timeout: iceConnectTimeout})
+}
+
+// takeOffer removes and returns the open offer if its ufrag matches.
+func (m *ConnectionManager) takeOffer(ufrag string) *pendingOffer {
+	m.offerMu.Lock()
+	defer m.offerMu.Unlock()
+	offer := m.offer
+	if offer == nil || offer.info.Ufrag != ufrag {
+		return nil
+	}
+	m.offer = nil
+	return offer
+}
+
+// Helpers
+func encodeSignalBlob(blob signalBlob) (string, error) {
+	data, err := json.Marshal(blob)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return signalPrefix + base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeSignalBlob(text string) (signalBlob, error) {
+	var blob signalBlob
+	// Mail and chat clients like to wrap long lines.
+	text = strings.Join(strings.Fields(text), "")
+	if !strings.HasPrefix(text, signalPrefix) {
+		return blob, errors.New("not a chute offer or answer")
+	}
+	compressed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(text, signalPrefix))
+	if err != nil {
+		return blob, errors.New("offer or answer is damaged")
+	}
+	data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), signalMaxBytes))
+	if err != nil {
+		return blob, errors.New("offer or answer is damaged")
+	}
+	if err := json.Unmarshal(data, &blob); err != nil {
+		return blob, errors.New("offer or answer is damaged")
+	}
+	if err := validateClientID(blob.ID); err != nil {
+		return blob, err
+	}
+	if blob.Ufrag == "" || blob.Password == "" || len(blob.Candidates) == 0 {
+		return blob, errors.New("offer or answer has no ICE details")
+	}
+	return blob, nil
+}
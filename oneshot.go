@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Exit codes for one-shot commands, so scripts can tell failures apart.
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitUnreachable = 3
+	exitRefused     = 4
+)
+
+var oneShotCommands = map[string]bool{"send": true, "connect": true, "status": true}
+
+// One-shot mode
+//
+// "chute send <id> <file>", "chute connect <id>" and "chute status" do a
+// single operation without the interactive loop and return an exit code.
+func runOneShot(ctx context.Context, client *Client, manager *ConnectionManager, args []string) int {
+	switch args[0] {
+	case "status":
+		return oneShotStatus(ctx, client)
+	case "connect":
+		if len(args) != 2 {
+			log.Printf("usage: connect <id>")
+			return exitUsage
+		}
+		if _, err := manager.Connect(ctx, args[1], ""); err != nil {
+			log.Printf("connect failed target=%s err=%v", args[1], err)
+			return exitUnreachable
+		}
+		fmt.Printf("connected to %s\n", args[1])
+		return exitOK
+	case "send":
+		if len(args) != 3 {
+			log.Printf("usage: send <id> <file>")
+			return exitUsage
+		}
+		return oneShotSend(ctx, client, manager, args[1], args[2])
+	}
+	return exitUsage
+}
+
+func oneShotStatus(ctx context.Context, client *Client) int {
+	if client.lanOnly {
+		printStatus(client.Status())
+		return exitOK
+	}
+	_, _, err := lookupICE(ctx, client.serverAddr, client.clientID)
+	client.updateRendezvousHealth(ctx, err)
+	printStatus(client.Status())
+	if err != nil {
+		return exitUnreachable
+	}
+	return exitOK
+}
+
+func oneShotSend(ctx context.Context, client *Client, manager *ConnectionManager, id, path string) int {
+	if _, err := manager.Connect(ctx, id, "wants to send you a file"); err != nil {
+		log.Printf("connect failed target=%s err=%v", id, err)
+		return exitUnreachable
+	}
+	err := client.SendFile(ctx, id, path, "")
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errFileRefused):
+		log.Printf("send refused target=%s", id)
+		return exitRefused
+	case errors.Is(err, ErrPeerGone):
+		log.Printf("send failed target=%s err=%v", id, err)
+		return exitUnreachable
+	default:
+		log.Printf("send failed target=%s err=%v", id, err)
+		return exitFailure
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const peerSettingsFile = "peer_settings.json"
+
+// PeerSettings override the global settings for one peer. Unset fields
+// fall back to the global behavior.
+type PeerSettings struct {
+	DownloadDir   string `json:"download_dir,omitempty"`
+	AutoAccept    *bool  `json:"auto_accept,omitempty"`
+	BandwidthKBps int64  `json:"bandwidth_kbps,omitempty"`
+	Notifications *bool  `json:"notifications,omitempty"`
+	Presence      *bool  `json:"presence,omitempty"`
+}
+
+// peerSettingKeys lists the names accepted by set, in display order.
+var peerSettingKeys = []string{"download-dir", "auto-accept", "bandwidth", "notifications", "presence"}
+
+// Per-peer settings
+//
+// Overrides are keyed by the fingerprint pinned for the peer rather than
+// by its id, so they follow the identity: a peer id that comes back with
+// another key does not inherit them, and a peer can only have overrides
+// once it has been pinned. auto-accept covers connection requests and
+// unprotected file offers; bandwidth caps file transfers both ways;
+// presence shares our online status with the peer.
+type peerSettingsStore struct {
+	path string
+
+	mu       sync.Mutex
+	settings map[string]PeerSettings
+}
+
+// Storage
+func loadPeerSettingsStore(dir string) (*peerSettingsStore, error) {
+	store := &peerSettingsStore{
+		path:     filepath.Join(dir, peerSettingsFile),
+		settings: make(map[string]PeerSettings),
+	}
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.settings); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", store.path, err)
+	}
+	return store, nil
+}
+
+func (p *peerSettingsStore) saveLocked() error {
+	data, err := json.MarshalIndent(p.settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, data, 0o600)
+}
+
+func (p *peerSettingsStore) get(fingerprint string) PeerSettings {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.settings[fingerprint]
+}
+
+// update sets one override for fingerprint and saves the store.
+func (p *peerSettingsStore) update(fingerprint, key, value string) (PeerSettings, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	previous, had := p.settings[fingerprint]
+	settings := previous
+	if err := settings.set(key, value); err != nil {
+		return previous, err
+	}
+	if settings == (PeerSettings{}) {
+		delete(p.settings, fingerprint)
+	} else {
+		p.settings[fingerprint] = settings
+	}
+	if err := p.saveLocked(); err != nil {
+		if had {
+			p.settings[fingerprint] = previous
+		} else {
+			delete(p.settings, fingerprint)
+		}
+		return previous, err
+	}
+	return settings, nil
+}
+
+// Editing
+
+// set updates one override from its text form; an empty value clears it.
+func (s *PeerSettings) set(key, value string) error {
+	switch key {
+	case "download-dir":
+		s.DownloadDir = value
+	case "auto-accept", "notifications", "presence":
+		var on *bool
+		if value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: want true or false", key)
+			}
+			on = &b
+		}
+		switch key {
+		case "auto-accept":
+			s.AutoAccept = on
+		case "notifications":
+			s.Notifications = on
+		default:
+			s.Presence = on
+		}
+	case "bandwidth":
+		var kbps int64
+		if value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("bandwidth: want a rate in KB/s")
+			}
+			kbps = n
+		}
+		s.BandwidthKBps = kbps
+	case "pull":
+		return errors.New("pull was replaced by share grants, see share grant")
+	default:
+		return fmt.Errorf("unknown peer setting %q (want one of %s)", key, strings.Join(peerSettingKeys, ", "))
+	}
+	return nil
+}
+
+func (s PeerSettings) get(key string) string {
+	switch key {
+	case "download-dir":
+		return s.DownloadDir
+	case "auto-accept":
+		return formatOptionalBool(s.AutoAccept)
+	case "bandwidth":
+		if s.BandwidthKBps == 0 {
+			return ""
+		}
+		return strconv.FormatInt(s.BandwidthKBps, 10)
+	case "notifications":
+		return formatOptionalBool(s.Notifications)
+	case "presence":
+		return formatOptionalBool(s.Presence)
+	}
+	return ""
+}
+
+// Client
+
+// PeerSettings returns the overrides for peerID.
+func (c *Client) PeerSettings(peerID string) (PeerSettings, error) {
+	fingerprint, err := c.pinnedFingerprint(peerID)
+	if err != nil {
+		return PeerSettings{}, err
+	}
+	return c.peerSettings.get(fingerprint), nil
+}
+
+// UpdatePeerSetting sets one override for peerID and returns them all.
+func (c *Client) UpdatePeerSetting(peerID, key, value string) (PeerSettings, error) {
+	fingerprint, err := c.pinnedFingerprint(peerID)
+	if err != nil {
+		return PeerSettings{}, err
+	}
+	settings, err := c.peerSettings.update(fingerprint, key, value)
+	if err != nil {
+		return settings, err
+	}
+	log.Printf("peer setting changed peer_id=%s key=%s value=%q", peerID, key, value)
+	return settings, nil
+}
+
+// Notifies reports whether events from peerID should be shown to the
+// user.
+func (c *Client) Notifies(peerID string) bool {
+	if on := c.settingsFor(peerID).Notifications; on != nil {
+		return *on
+	}
+	return true
+}
+
+func (c *Client) pinnedFingerprint(peerID string) (string, error) {
+	if c.peerSettings == nil || c.pins == nil {
+		return "", errors.New("peer settings are not available")
+	}
+	fingerprint, ok := c.pins.lookup(peerID)
+	if !ok {
+		return "", fmt.Errorf("%s is not pinned yet; connect to it once first", peerID)
+	}
+	return fingerprint, nil
+}
+
+// settingsFor returns the overrides for peerID, or none when it has no
+// pin.
+func (c *Client) settingsFor(peerID string) PeerSettings {
+	fingerprint, err := c.pinnedFingerprint(peerID)
+	if err != nil {
+		return PeerSettings{}
+	}
+	return c.peerSettings.get(fingerprint)
+}
+
+func (c *Client) downloadDirFor(peerID string) string {
+	if dir := c.settingsFor(peerID).DownloadDir; dir != "" {
+		return dir
+	}
+	return c.DownloadDir()
+}
+
+// limitFor caps r at peerID's bandwidth, if it has one.
+func (c *Client) limitFor(peerID string, r io.Reader) io.Reader {
+	if kbps := c.settingsFor(peerID).BandwidthKBps; kbps > 0 {
+		return &rateLimitedReader{r: r, rate: kbps << 10, started: time.Now()}
+	}
+	return r
+}
+
+// Helpers
+
+// rateLimitedReader sleeps as needed to keep the average rate since the
+// first read at or below rate bytes per second.
+type rateLimitedReader struct {
+	r       io.Reader
+	rate    int64
+	started time.Time
+	read    int64
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.rate {
+		p = p[:l.rate]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	due := time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second))
+	if wait := due - time.Since(l.started); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
+
+func formatOptionalBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
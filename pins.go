@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const pinsFile = "pins.json"
+
+// pinStore remembers the fingerprint each peer presented the first time
+// we talked to it. Later sessions must present the same one.
+type pinStore struct {
+	path string
+
+	mu   sync.Mutex
+	pins map[string]string
+}
+
+// pinMismatchError means a peer ID is now backed by a different key than
+// the one pinned on first use.
+type pinMismatchError struct {
+	PeerID    string
+	Pinned    string
+	Presented string
+}
+
+func (e *pinMismatchError) Error() string {
+	return fmt.Sprintf("fingerprint for %s changed from %s to %s", e.PeerID, e.Pinned, e.Presented)
+}
+
+// Storage
+func loadPinStore(dir string) (*pinStore, error) {
+	store := &pinStore{
+		path: filepath.Join(dir, pinsFile),
+		pins: make(map[string]string),
+	}
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.pins); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", store.path, err)
+	}
+	return store, nil
+}
+
+func (p *pinStore) saveLocked() error {
+	data, err := json.MarshalIndent(p.pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(p.path, data, 0o600)
+}
+
+// Verification
+
+// verify pins fingerprint for peerID on first use and rejects any other
+// fingerprint afterwards.
+func (p *pinStore) verify(peerID, fingerprint string) error {
+	if fingerprint == "" {
+		return errors.New("peer presented no certificate")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pinned, ok := p.pins[peerID]
+	if ok && pinned != fingerprint {
+		return &pinMismatchError{PeerID: peerID, Pinned: pinned, Presented: fingerprint}
+	}
+	if ok {
+		return nil
+	}
+
+	p.pins[peerID] = fingerprint
+	if err := p.saveLocked(); err != nil {
+		delete(p.pins, peerID)
+		return fmt.Errorf("save pin: %w", err)
+	}
+	return nil
+}
+
+// list returns a copy of the pins, keyed by peer ID.
+func (p *pinStore) list() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pins := make(map[string]string, len(p.pins))
+	for id, fingerprint := range p.pins {
+		pins[id] = fingerprint
+	}
+	return pins
+}
+
+// lookup returns the fingerprint pinned for peerID.
+func (p *pinStore) lookup(peerID string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fingerprint, ok := p.pins[peerID]
+	return fingerprint, ok
+}
+
+// forget drops the pin for peerID so the next session re-pins it.
+func (p *pinStore) forget(peerID string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pins[peerID]; !ok {
+		return false, nil
+	}
+	fingerprint := p.pins[peerID]
+	delete(p.pins, peerID)
+	if err := p.saveLocked(); err != nil {
+		p.pins[peerID] = fingerprint
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPinStoreVerify(t *testing.T) {
+	dir := t.TempDir()
+	store, err := loadPinStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		peerID      string
+		fingerprint string
+		mismatch    bool
+		fail        bool
+	}{
+		{"alice", "fp-a", false, false},
+		{"alice", "fp-a", false, false},
+		{"alice", "fp-x", true, false},
+		{"bob", "fp-b", false, false},
+		{"bob", "fp-a", true, false},
+		{"carol", "", false, true},
+		{"carol", "fp-c", false, false},
+	}
+	for i, step := range steps {
+		err := store.verify(step.peerID, step.fingerprint)
+		var mismatch *pinMismatchError
+		switch {
+		case step.mismatch:
+			if !errors.As(err, &mismatch) || mismatch.Pinned == step.fingerprint || mismatch.Presented != step.fingerprint {
+				t.Fatalf("step %d: verify(%s, %s) = %v, want a mismatch", i, step.peerID, step.fingerprint, err)
+			}
+		case step.fail:
+			if err == nil {
+				t.Fatalf("step %d: verify(%s, %q) succeeded", i, step.peerID, step.fingerprint)
+			}
+		case err != nil:
+			t.Fatalf("step %d: verify(%s, %s): %v", i, step.peerID, step.fingerprint, err)
+		}
+	}
+
+	// Pins survive a restart, and forgetting one lets the peer re-pin.
+	reloaded, err := loadPinStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"alice": "fp-a", "bob": "fp-b", "carol": "fp-c"}
+	for id, fingerprint := range want {
+		if got, ok := reloaded.lookup(id); !ok || got != fingerprint {
+			t.Errorf("reloaded pin for %s = %q, want %q", id, got, fingerprint)
+		}
+	}
+	if len(reloaded.list()) != len(want) {
+		t.Errorf("reloaded %d pins, want %d", len(reloaded.list()), len(want))
+	}
+	if ok, err := reloaded.forget("alice"); !ok || err != nil {
+		t.Fatalf("forget alice: ok=%t err=%v", ok, err)
+	}
+	if ok, _ := reloaded.forget("alice"); ok {
+		t.Fatal("forgot alice twice")
+	}
+	if err := reloaded.verify("alice", "fp-x"); err != nil {
+		t.Fatalf("re-pin alice: %v", err)
+	}
+}
+
+func TestPinStoreKeepsNothingUnsaved(t *testing.T) {
+	dir := t.TempDir()
+	store, err := loadPinStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file where the directory should be makes every save fail.
+	blocker := filepath.Join(dir, "blocked")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store.path = filepath.Join(blocker, pinsFile)
+	if err := store.verify("alice", "fp-a"); err == nil {
+		t.Fatal("verify saved a pin under a file")
+	}
+	if _, ok := store.lookup("alice"); ok {
+		t.Fatal("pin kept after the save failed")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const pipeLinger = 1 * time.Second
+
+// Pipe mode
+//
+// Each side opens one stream, copies stdin into it, and closes its write
+// direction at EOF. The peer writes the stream to stdout and closes its
+// side when done, which tells the sender everything was consumed. The run
+// ends once both directions have finished, like netcat with -N.
+func runPipe(ctx context.Context, client *Client, manager *ConnectionManager, targetID string) error {
+	received := make(chan error, 1)
+	manager.SetStreamHandler(func(r io.Reader) {
+		_, err := io.Copy(os.Stdout, r)
+		select {
+		case received <- err:
+		default:
+		}
+	})
+
+	var session *ChuteSession
+	var err error
+	if targetID != "" {
+		session, err = manager.Connect(ctx, targetID, "pipe")
+	} else {
+		log.Printf("pipe waiting for incoming connection")
+		client.SetAutoAccept(true)
+		go client.StartPolling(ctx, manager)
+		session, err = waitForIncomingSession(ctx, client)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("pipe connected peer_id=%s", session.CurrentPeerID())
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- pipeStdin(ctx, session)
+	}()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var sendDone, receiveDone bool
+	for !sendDone || !receiveDone {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-sent:
+			if err != nil {
+				return err
+			}
+			sendDone = true
+		case err := <-received:
+			if err != nil {
+				return err
+			}
+			receiveDone = true
+		case <-ticker.C:
+			if !session.IsConnected() {
+				return ErrPeerGone
+			}
+		}
+	}
+
+	// Give the peer a moment to see our final acknowledgement before the
+	// connection is torn down.
+	deadline := time.Now().Add(pipeLinger)
+	for session.IsConnected() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+func pipeStdin(ctx context.Context, session *ChuteSession) error {
+	stream, err := session.OpenStream(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(stream, os.Stdin); err != nil {
+		_ = stream.Close()
+		return err
+	}
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	// Wait for the peer to close its side, signalling it read everything.
+	_, err = io.Copy(io.Discard, stream)
+	return err
+}
+
+func waitForIncomingSession(ctx context.Context, client *Client) (*ChuteSession, error) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+			if session := client.getSession(); session != nil && session.IsConnected() {
+				return session, nil
+			}
+		}
+	}
+}
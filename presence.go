@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Presence states. The server reports a mutual contact as offline when
+// it has not published within its TTL, and leaves out contacts that do
+// not share presence back.
+const (
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresenceOffline = "offline"
+)
+
+const (
+	presenceInterval   = 1 * time.Minute
+	presenceTTLSeconds = 3 * 60
+	// presenceIdleAfter is how long after the last session the client
+	// still counts as online.
+	presenceIdleAfter = 15 * time.Minute
+)
+
+type presencePublishRequest struct {
+	ID         string   `json:"id"`
+	State      string   `json:"state"`
+	Contacts   []string `json:"contacts"`
+	TTLSeconds int      `json:"ttl_seconds"`
+}
+
+type presenceQueryRequest struct {
+	ID       string   `json:"id"`
+	Contacts []string `json:"contacts"`
+}
+
+type presenceQueryResponse struct {
+	Presence map[string]string `json:"presence"`
+}
+
+// ErrPresenceUnsupported is returned when the rendezvous server does not
+// track presence.
+var ErrPresenceUnsupported = errors.New("rendezvous server has no presence support")
+
+// Presence
+//
+// Presence is shared per contact through the presence peer setting. The
+// client publishes its state along with the ids it shares with, and the
+// server only reveals a client's state to contacts on that list that
+// list it back, so presence flows only between mutual opt-ins. Each
+// round also asks for the state of those contacts and keeps it for
+// Peers, where a contact the server left out shows no state at all. A
+// client is online while it has a session or had one within
+// presenceIdleAfter, and idle otherwise; one that stops publishing shows
+// offline once presenceTTLSeconds pass.
+func publishPresence(ctx context.Context, serverAddr, clientID, state string, contacts []string) error {
+	payload := presencePublishRequest{ID: clientID, State: state, Contacts: contacts, TTLSeconds: presenceTTLSeconds}
+	err := postJSON(ctx, serverAddr, "/presence/publish", payload, nil, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return ErrPresenceUnsupported
+	}
+	return err
+}
+
+func unpublishPresence(ctx context.Context, serverAddr, clientID string) error {
+	payload := unregisterRequest{ID: clientID}
+	return postJSON(ctx, serverAddr, "/presence/unpublish", payload, nil, http.StatusOK, http.StatusNotFound)
+}
+
+func queryPresence(ctx context.Context, serverAddr, clientID string, contacts []string) (map[string]string, error) {
+	var resp presenceQueryResponse
+	err := postJSON(ctx, serverAddr, "/presence/query", presenceQueryRequest{ID: clientID, Contacts: contacts}, &resp, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrPresenceUnsupported
+	}
+	return resp.Presence, err
+}
+
+// Client
+
+// StartPresence publishes presence and refreshes the contacts' states
+// every presenceInterval until ctx is done.
+func (c *Client) StartPresence(ctx context.Context) {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		err := c.syncPresence(ctx)
+		switch {
+		case err != nil && !failing && ctx.Err() == nil:
+			log.Printf("presence update failed client_id=%s err=%v", c.clientID, err)
+			failing = true
+		case err == nil && failing:
+			log.Printf("presence updates working again client_id=%s", c.clientID)
+			failing = false
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// syncPresence runs one publish and query round.
+func (c *Client) syncPresence(ctx context.Context) error {
+	contacts := c.presenceContacts()
+	c.presenceMu.Lock()
+	published := c.presencePublished
+	c.presenceMu.Unlock()
+
+	if len(contacts) == 0 {
+		c.presenceMu.Lock()
+		c.presence = nil
+		c.presenceMu.Unlock()
+		if !published {
+			return nil
+		}
+		if err := unpublishPresence(ctx, c.serverAddr, c.clientID); err != nil {
+			return err
+		}
+		c.presenceMu.Lock()
+		c.presencePublished = false
+		c.presenceMu.Unlock()
+		return nil
+	}
+
+	if err := publishPresence(ctx, c.serverAddr, c.clientID, c.presenceState(), contacts); err != nil {
+		return err
+	}
+	states, err := queryPresence(ctx, c.serverAddr, c.clientID, contacts)
+	if err != nil {
+		return err
+	}
+	c.presenceMu.Lock()
+	c.presencePublished = true
+	c.presence = states
+	c.presenceMu.Unlock()
+	for id, state := range states {
+		if state == PresenceOnline || state == PresenceIdle {
+			c.lastSeen.markRegistered(id)
+		}
+	}
+	return nil
+}
+
+// unpublishPresenceIfPublished takes the client off its contacts' lists
+// at shutdown.
+func (c *Client) unpublishPresenceIfPublished(ctx context.Context) error {
+	c.presenceMu.Lock()
+	published := c.presencePublished
+	c.presenceMu.Unlock()
+	if !published {
+		return nil
+	}
+	if err := unpublishPresence(ctx, c.serverAddr, c.clientID); err != nil {
+		return err
+	}
+	c.presenceMu.Lock()
+	c.presencePublished = false
+	c.presenceMu.Unlock()
+	return nil
+}
+
+// presenceState is our own state: online while in or recently out of a
+// session, idle otherwise.
+func (c *Client) presenceState() string {
+	if session := c.getSession(); session != nil && session.IsConnected() {
+		return PresenceOnline
+	}
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	if time.Since(c.lastActive) < presenceIdleAfter {
+		return PresenceOnline
+	}
+	return PresenceIdle
+}
+
+// markActive records session activity for presenceState.
+func (c *Client) markActive() {
+	c.presenceMu.Lock()
+	c.lastActive = time.Now()
+	c.presenceMu.Unlock()
+}
+
+// presenceContacts lists the pinned peers presence is shared with.
+func (c *Client) presenceContacts() []string {
+	if c.pins == nil || c.peerSettings == nil {
+		return nil
+	}
+	var contacts []string
+	for id, fingerprint := range c.pins.list() {
+		if on := c.peerSettings.get(fingerprint).Presence; on != nil && *on {
+			contacts = append(contacts, id)
+		}
+	}
+	sort.Strings(contacts)
+	return contacts
+}
+
+// contactPresence is the last known state of peerID, or "" when presence
+// is not shared with it.
+func (c *Client) contactPresence(peerID string) string {
+	if on := c.settingsFor(peerID).Presence; on == nil || !*on {
+		return ""
+	}
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	return c.presence[peerID]
+}
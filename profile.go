@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+const defaultProfile = "balanced"
+
+// performanceProfile tunes QUIC flow control for a kind of traffic.
+// quic-go does not expose its congestion controller or pacer, so the
+// receive windows are what we can shape: large windows let bulk drops
+// fill a fat pipe, small ones keep background sync from crowding out
+// everything else on the link. Zero values keep the quic-go defaults.
+type performanceProfile struct {
+	initialStreamWindow uint64
+	maxStreamWindow     uint64
+	initialConnWindow   uint64
+	maxConnWindow       uint64
+}
+
+var performanceProfiles = map[string]performanceProfile{
+	"balanced": {},
+	"throughput": {
+		initialStreamWindow: 2 << 20,
+		maxStreamWindow:     32 << 20,
+		initialConnWindow:   4 << 20,
+		maxConnWindow:       64 << 20,
+	},
+	"background": {
+		initialStreamWindow: 128 << 10,
+		maxStreamWindow:     256 << 10,
+		initialConnWindow:   256 << 10,
+		maxConnWindow:       512 << 10,
+	},
+}
+
+// activeProfile is applied to sessions opened after it changes.
+var (
+	profileMu     sync.Mutex
+	activeProfile = defaultProfile
+)
+
+func setPerformanceProfile(name string) error {
+	if name == "" {
+		name = defaultProfile
+	}
+	if err := validateProfile(name); err != nil {
+		return err
+	}
+	profileMu.Lock()
+	activeProfile = name
+	profileMu.Unlock()
+	return nil
+}
+
+func currentProfile() performanceProfile {
+	profileMu.Lock()
+	defer profileMu.Unlock()
+	return performanceProfiles[activeProfile]
+}
+
+func validateProfile(name string) error {
+	if _, ok := performanceProfiles[name]; !ok {
+		return fmt.Errorf("unknown profile %q (want one of %s)", name, strings.Join(profileNames(), ", "))
+	}
+	return nil
+}
+
+func profileNames() []string {
+	names := make([]string, 0, len(performanceProfiles))
+	for name := range performanceProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p performanceProfile) apply(config *quic.Config) {
+	config.InitialStreamReceiveWindow = p.initialStreamWindow
+	config.MaxStreamReceiveWindow = p.maxStreamWindow
+	config.InitialConnectionReceiveWindow = p.initialConnWindow
+	config.MaxConnectionReceiveWindow = p.maxConnWindow
+}
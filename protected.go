@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+const (
+	passphraseSaltSize   = 16
+	passphraseIterations = 600000
+)
+
+var (
+	ErrPassphraseRequired = errors.New("file is passphrase protected")
+	ErrBadPassphrase      = errors.New("wrong passphrase")
+)
+
+// FileProtection is sent with the offer of a passphrase-protected file.
+// Both keys come from the passphrase alone: the verifier lets the
+// receiver check an entered passphrase before anything is written, and
+// the payload is sealed under the data key, so a peer that took over
+// the session without the passphrase gets only ciphertext.
+type FileProtection struct {
+	Salt     []byte `json:"salt"`
+	Verifier []byte `json:"verifier"`
+}
+
+// Passphrase keys
+func newFileProtection(passphrase string) (*FileProtection, []byte, error) {
+	if passphrase == "" {
+		return nil, nil, errors.New("empty passphrase")
+	}
+	salt := make([]byte, passphraseSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	protection := &FileProtection{Salt: salt}
+	verifier, key, err := protection.derive(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	protection.Verifier = verifier
+	return protection, key, nil
+}
+
+// unlock returns the data key if passphrase matches the verifier.
+func (p *FileProtection) unlock(passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, ErrPassphraseRequired
+	}
+	verifier, key, err := p.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(verifier, p.Verifier) != 1 {
+		return nil, ErrBadPassphrase
+	}
+	return key, nil
+}
+
+func (p *FileProtection) derive(passphrase string) ([]byte, []byte, error) {
+	if len(p.Salt) != passphraseSaltSize {
+		return nil, nil, errors.New("bad passphrase salt")
+	}
+	master, err := pbkdf2.Key(sha256.New, passphrase, p.Salt, passphraseIterations, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier, err := hkdf.Key(sha256.New, master, nil, "chute transfer verifier v1", 16)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := hkdf.Key(sha256.New, master, nil, "chute transfer data v1", 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return verifier, key, nil
+}
+
+// Helpers
+
+// sealedSize is the length of a sealed stream of n plaintext bytes.
+func sealedSize(n int64) int64 {
+	chunks := (n + sealChunk - 1) / sealChunk
+	if chunks == 0 {
+		chunks = 1
+	}
+	return n + chunks*(5+16)
+}
+
+// sealReader returns a reader yielding r sealed under key. Closing it
+// stops the sealing goroutine.
+func sealReader(r io.Reader, key []byte) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	sealer, err := newSealWriter(pw, key)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		_, err := copyChunked(sealer, r)
+		if err == nil {
+			err = sealer.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
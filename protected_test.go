@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFileProtectionUnlock(t *testing.T) {
+	protection, key, err := newFileProtection("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(protection.Salt) != passphraseSaltSize || len(protection.Verifier) == 0 || len(key) != 32 {
+		t.Fatalf("protection = %+v with a %d byte key", protection, len(key))
+	}
+	if bytes.Contains(key, protection.Verifier) {
+		t.Fatal("verifier reveals the data key")
+	}
+
+	tests := []struct {
+		passphrase string
+		want       error
+	}{
+		{"correct horse", nil},
+		{"correct horse ", ErrBadPassphrase},
+		{"Correct horse", ErrBadPassphrase},
+		{"", ErrPassphraseRequired},
+	}
+	for _, tt := range tests {
+		got, err := protection.unlock(tt.passphrase)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("unlock(%q) err = %v, want %v", tt.passphrase, err, tt.want)
+		}
+		if tt.want == nil && !bytes.Equal(got, key) {
+			t.Errorf("unlock(%q) returned another key", tt.passphrase)
+		}
+	}
+
+	if _, _, err := newFileProtection(""); err == nil {
+		t.Error("protected a file with an empty passphrase")
+	}
+	bad := &FileProtection{Salt: []byte("short"), Verifier: protection.Verifier}
+	if _, err := bad.unlock("correct horse"); err == nil {
+		t.Error("unlocked with a short salt")
+	}
+}
+
+func TestSealedSize(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	for _, n := range []int64{0, 1, sealChunk - 1, sealChunk, sealChunk + 1, 2 * sealChunk, 2*sealChunk + 5} {
+		r, err := sealReader(io.LimitReader(zeroReader{}, n), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatalf("seal %d bytes: %v", n, err)
+		}
+		if got := int64(len(sealed)); got != sealedSize(n) {
+			t.Errorf("sealedSize(%d) = %d, sealed stream is %d", n, sealedSize(n), got)
+		}
+		opened, err := openBytes(key, sealed)
+		if err != nil || int64(len(opened)) != n {
+			t.Errorf("open %d sealed bytes: got %d, err=%v", n, len(opened), err)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	rpcFilesList = "files.list"
+	rpcFilesPull = "files.pull"
+)
+
+// SharedEntry is one file or directory in a peer's shared directory.
+type SharedEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir,omitempty"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+type pullParams struct {
+	Path string `json:"path"`
+}
+
+// errSharedNotFound is also the answer for shares the peer was not
+// granted, so it cannot tell them from ones that do not exist.
+var errSharedNotFound = errors.New("no such file or directory")
+
+// Remote pull
+//
+// A peer can browse the shares granted to it and pull files out of them.
+// Listing and pull requests are RPC calls with a slash-separated path
+// whose first element names the share; listing the root lists the shares.
+// A pull request is answered right away and the file then travels as a
+// normal transfer, which the puller accepts without asking because it
+// asked for it. Paths are resolved with symlinks followed and must stay
+// inside the share.
+
+// RemoteFiles lists the directory dir shared by peerID, or its shares
+// when dir is empty.
+func (c *Client) RemoteFiles(ctx context.Context, peerID, dir string) ([]SharedEntry, error) {
+	session, err := c.sessionWith(peerID)
+	if err != nil {
+		return nil, err
+	}
+	var list []SharedEntry
+	if err := session.Call(ctx, rpcFilesList, pullParams{Path: dir}, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Pull asks peerID to send the file at name from its shared directory.
+// It returns once the peer has agreed; the file arrives as a transfer.
+func (c *Client) Pull(ctx context.Context, peerID, name string) (SharedEntry, error) {
+	session, err := c.sessionWith(peerID)
+	if err != nil {
+		return SharedEntry{}, err
+	}
+	base := path.Base(cleanSharedPath(name))
+	if base == "/" {
+		return SharedEntry{}, errors.New("missing file name")
+	}
+	c.expectPull(peerID, base)
+	var entry SharedEntry
+	if err := session.Call(ctx, rpcFilesPull, pullParams{Path: name}, &entry); err != nil {
+		c.takePull(peerID, base)
+		return SharedEntry{}, err
+	}
+	log.Printf("pull requested peer_id=%s path=%q bytes=%d", peerID, name, entry.Size)
+	return entry, nil
+}
+
+// RegisterPullHandlers answers the peer's listing and pull calls.
+func (c *Client) RegisterPullHandlers(manager *ConnectionManager) {
+	manager.SetRPCHandler(rpcFilesList, c.serveFileList)
+	manager.SetRPCHandler(rpcFilesPull, c.serveFilePull)
+}
+
+func (c *Client) serveFileList(ctx context.Context, peerID string, params json.RawMessage) (any, error) {
+	share, dir, err := c.resolvePull(peerID, "list", params)
+	if err != nil {
+		return nil, err
+	}
+	if share.Name == "" {
+		shares := c.sharesFor(peerID)
+		list := make([]SharedEntry, 0, len(shares))
+		for _, s := range shares {
+			list = append(list, SharedEntry{Name: s.Name, Dir: true})
+		}
+		return list, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errSharedNotFound
+	}
+	list := make([]SharedEntry, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+		list = append(list, SharedEntry{Name: e.Name(), Dir: info.IsDir(), Size: info.Size(), Modified: info.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func (c *Client) serveFilePull(ctx context.Context, peerID string, params json.RawMessage) (any, error) {
+	share, file, err := c.resolvePull(peerID, "pull", params)
+	if err != nil {
+		return nil, err
+	}
+	if share.Name == "" {
+		return nil, errSharedNotFound
+	}
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, errSharedNotFound
+	}
+	var p pullParams
+	_ = json.Unmarshal(params, &p)
+	name := path.Base(cleanSharedPath(p.Path))
+
+	go func() {
+		if err := c.sendFile(context.Background(), peerID, file, name, ""); err != nil {
+			log.Printf("pull send failed peer_id=%s name=%q err=%v", peerID, name, err)
+		}
+	}()
+	return SharedEntry{Name: name, Size: info.Size(), Modified: info.ModTime()}, nil
+}
+
+// resolvePull checks the requested path against the grants of its share
+// and resolves it inside the share, logging the outcome. The root
+// resolves to no share at all. Hidden files, which listings leave out,
+// cannot be reached by name either.
+func (c *Client) resolvePull(peerID, op string, params json.RawMessage) (Share, string, error) {
+	var p pullParams
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &p); err != nil {
+			return Share{}, "", fmt.Errorf("bad params: %w", err)
+		}
+	}
+	name, rest, _ := strings.Cut(strings.TrimPrefix(cleanSharedPath(p.Path), "/"), "/")
+	if name == "" {
+		log.Printf("share access peer_id=%s op=%s path=/ allowed=true", peerID, op)
+		return Share{}, "", nil
+	}
+	var share Share
+	allowed := false
+	if c.shares != nil {
+		var ok bool
+		share, ok = c.shares.get(name)
+		fingerprint, err := c.pinnedFingerprint(peerID)
+		allowed = ok && err == nil && share.grants(fingerprint) && !hiddenSharedPath(rest)
+	}
+	log.Printf("share access peer_id=%s op=%s share=%s path=%q allowed=%t", peerID, op, name, rest, allowed)
+	if !allowed {
+		return Share{}, "", errSharedNotFound
+	}
+	file, err := resolveShared(share.Path, rest)
+	if err != nil {
+		return Share{}, "", err
+	}
+	return share, file, nil
+}
+
+// expectPull marks a file from peerID as asked for until the offer
+// arrives or fileOfferTimeout passes.
+func (c *Client) expectPull(peerID, name string) {
+	c.pullsMu.Lock()
+	defer c.pullsMu.Unlock()
+	if c.pulls == nil {
+		c.pulls = make(map[string]time.Time)
+	}
+	c.pulls[peerID+"/"+name] = time.Now().Add(fileOfferTimeout)
+}
+
+// takePull reports whether name from peerID was asked for, and forgets it.
+func (c *Client) takePull(peerID, name string) bool {
+	c.pullsMu.Lock()
+	defer c.pullsMu.Unlock()
+	key := peerID + "/" + name
+	expires, ok := c.pulls[key]
+	delete(c.pulls, key)
+	for k, t := range c.pulls {
+		if time.Now().After(t) {
+			delete(c.pulls, k)
+		}
+	}
+	return ok && time.Now().Before(expires)
+}
+
+// sessionWith returns the session if it is connected to peerID.
+func (c *Client) sessionWith(peerID string) (*ChuteSession, error) {
+	session := c.getSession()
+	if session == nil || !session.IsConnected() {
+		return nil, ErrNoSession
+	}
+	if activePeer := session.CurrentPeerID(); activePeer != peerID {
+		return nil, fmt.Errorf("%w: connected to %s", ErrBusy, activePeer)
+	}
+	return session, nil
+}
+
+// Helpers
+
+// hiddenSharedPath reports whether any component of the clean path p
+// starts with a dot.
+func hiddenSharedPath(p string) bool {
+	for _, part := range strings.Split(p, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanSharedPath turns a requested path into a clean slash-separated
+// path rooted at "/", so ".." can never climb above the root.
+func cleanSharedPath(p string) string {
+	return path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+}
+
+func resolveShared(root, p string) (string, error) {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", errSharedNotFound
+	}
+	real, err := filepath.EvalSymlinks(filepath.Join(realRoot, filepath.FromSlash(cleanSharedPath(p))))
+	if err != nil {
+		return "", errSharedNotFound
+	}
+	if real != realRoot && !strings.HasPrefix(real, realRoot+string(filepath.Separator)) {
+		return "", errSharedNotFound
+	}
+	return real, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sharedTree lays out a share root with a sibling directory outside it
+// and returns both, with symlinks resolved.
+func sharedTree(t *testing.T) (root, outside string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(base, "share")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{filepath.Join(root, "a.txt"), filepath.Join(root, "sub", "b.txt"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(file, []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link-out")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "sub", "b.txt"), filepath.Join(root, "link-in")); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func TestResolveShared(t *testing.T) {
+	root, _ := sharedTree(t)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", root},
+		{"/", root},
+		{"a.txt", filepath.Join(root, "a.txt")},
+		{"sub/b.txt", filepath.Join(root, "sub", "b.txt")},
+		{"sub/../a.txt", filepath.Join(root, "a.txt")},
+		{`sub\b.txt`, filepath.Join(root, "sub", "b.txt")},
+		{"link-in", filepath.Join(root, "sub", "b.txt")},
+		{"../outside/secret", ""},
+		{"sub/../../outside/secret", ""},
+		{`..\outside\secret`, ""},
+		{"link-out/secret", ""},
+		{"link-out", ""},
+		{"missing.txt", ""},
+	}
+	for _, tt := range tests {
+		got, err := resolveShared(root, tt.path)
+		if tt.want == "" {
+			if !errors.Is(err, errSharedNotFound) {
+				t.Errorf("resolveShared(%q) = %q, %v; want errSharedNotFound", tt.path, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveShared(%q) = %q, %v; want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestHiddenSharedPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		hidden bool
+	}{
+		{"", false},
+		{"a.txt", false},
+		{"sub/b.txt", false},
+		{"a.b/c", false},
+		{".env", true},
+		{"sub/.git/config", true},
+		{".ssh/id_ed25519", true},
+		{"sub/..hidden", true},
+	}
+	for _, tt := range tests {
+		if got := hiddenSharedPath(tt.path); got != tt.hidden {
+			t.Errorf("hiddenSharedPath(%q) = %t, want %t", tt.path, got, tt.hidden)
+		}
+	}
+}
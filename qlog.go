@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+)
+
+// qlogDir receives one qlog file per QUIC connection when set. Tunable
+// via flags; see main.
+var qlogDir string
+
+// QUIC tracing
+//
+// Files are named <time>_<odcid>_<client|server>.qlog, so both ends of a
+// failed connection can be matched up by connection id and loaded into
+// qvis or any other qlog viewer.
+func qlogTracer(_ context.Context, p logging.Perspective, odcid quic.ConnectionID) *logging.ConnectionTracer {
+	label := "server"
+	if p == logging.PerspectiveClient {
+		label = "client"
+	}
+	name := fmt.Sprintf("%s_%s_%s.qlog", time.Now().Format("20060102-150405"), odcid, label)
+	f, err := os.OpenFile(filepath.Join(qlogDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Printf("qlog create failed: %v", err)
+		return nil
+	}
+	return qlog.NewConnectionTracer(&bufferedFile{Writer: bufio.NewWriter(f), file: f}, p, odcid)
+}
+
+// bufferedFile batches the many small qlog writes and flushes on close.
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func (b *bufferedFile) Close() error {
+	if err := b.Flush(); err != nil {
+		_ = b.file.Close()
+		return err
+	}
+	return b.file.Close()
+}
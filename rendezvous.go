@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"time"
 )
 
 type registerRequest struct {
@@ -23,20 +27,48 @@ type unregisterRequest struct {
 }
 
 type connectIntentRequest struct {
-	FromID     string `json:"from_id"`
-	ToID       string `json:"to_id"`
-	TTLSeconds int    `json:"ttl_seconds"`
+	FromID      string `json:"from_id"`
+	ToID        string `json:"to_id"`
+	TTLSeconds  int    `json:"ttl_seconds"`
+	DisplayName string `json:"display_name,omitempty"`
+	Purpose     string `json:"purpose,omitempty"`
+}
+
+type declineRequest struct {
+	FromID string `json:"from_id"`
+	ToID   string `json:"to_id"`
+	Reason string `json:"reason,omitempty"`
 }
 
 type pollIntentRequest struct {
 	ID string `json:"id"`
 }
 
+type claimRequest struct {
+	ID         string `json:"id"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+type turnCredentialsRequest struct {
+	ID string `json:"id"`
+}
+
+type turnCredentialsResponse struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+	TTLSeconds int      `json:"ttl_seconds"`
+}
+
 type lookupResponse struct {
-	ID         string   `json:"id"`
-	Ufrag      string   `json:"ufrag"`
-	Password   string   `json:"password"`
-	Candidates []string `json:"candidates"`
+	ID          string   `json:"id"`
+	Ufrag       string   `json:"ufrag"`
+	Password    string   `json:"password"`
+	Candidates  []string `json:"candidates"`
+	DisplayName string   `json:"display_name,omitempty"`
+	Purpose     string   `json:"purpose,omitempty"`
+	Declined    bool     `json:"declined,omitempty"`
+	Reason      string   `json:"reason,omitempty"`
 }
 
 type IceInfo struct {
@@ -46,8 +78,20 @@ type IceInfo struct {
 	Candidates []string
 }
 
+// IntentInfo is an incoming connect request: the requester's ICE info
+// plus the optional details it chose to share. Direct is set instead of
+// ICE info for intents sent straight to the direct endpoint. Expires is
+// set once the intent is held for the user.
+type IntentInfo struct {
+	IceInfo
+	DisplayName string
+	Purpose     string
+	Direct      *net.UDPAddr
+	Expires     time.Time
+}
+
 // ICE registration & lookup
-func registerICE(serverAddr, clientID string, info IceInfo, ttlSeconds int) error {
+func registerICE(ctx context.Context, serverAddr, clientID string, info IceInfo, ttlSeconds int) error {
 	payload := registerRequest{
 		ID:         clientID,
 		Ufrag:      info.Ufrag,
@@ -56,21 +100,28 @@ func registerICE(serverAddr, clientID string, info IceInfo, ttlSeconds int) erro
 		TTLSeconds: ttlSeconds,
 	}
 	log.Printf("registering ICE info client_id=%s candidates=%d ttl=%ds", clientID, len(info.Candidates), ttlSeconds)
-	return postJSON(serverAddr, "/register", payload, nil, http.StatusOK)
+	err := postJSON(ctx, serverAddr, "/register", payload, nil, http.StatusOK)
+	if errors.Is(err, ErrForbidden) {
+		// The id is claimed by another identity key. Never retry under
+		// the same id: that would be an attempt to take over someone
+		// else's registration.
+		return fmt.Errorf("%w: %w", ErrIDTaken, err)
+	}
+	return err
 }
 
-func lookupICE(serverAddr, targetID string) (IceInfo, bool, error) {
+func lookupICE(ctx context.Context, serverAddr, targetID string) (IceInfo, bool, error) {
 	payload := lookupRequest{ID: targetID}
 	var peer lookupResponse
-	status, err := postJSONWithStatus(serverAddr, "/lookup", payload, &peer)
+	err := postJSON(ctx, serverAddr, "/lookup", payload, &peer, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return IceInfo{}, false, nil
+	}
 	if err != nil {
 		return IceInfo{}, false, err
 	}
-	if status == http.StatusNotFound {
-		return IceInfo{}, false, nil
-	}
-	if status != http.StatusOK {
-		return IceInfo{}, false, fmt.Errorf("unexpected status: %d", status)
+	if peer.Declined {
+		return IceInfo{}, false, &declineError{peerID: targetID, reason: peer.Reason}
 	}
 	return IceInfo{
 		ID:         peer.ID,
@@ -81,45 +132,126 @@ func lookupICE(serverAddr, targetID string) (IceInfo, bool, error) {
 }
 
 // Intents
-func sendConnectIntent(serverAddr, fromID, toID string, ttlSeconds int) error {
+func sendConnectIntent(ctx context.Context, serverAddr, fromID, toID string, ttlSeconds int, displayName, purpose string) error {
 	payload := connectIntentRequest{
-		FromID:     fromID,
-		ToID:       toID,
-		TTLSeconds: ttlSeconds,
+		FromID:      fromID,
+		ToID:        toID,
+		TTLSeconds:  ttlSeconds,
+		DisplayName: displayName,
+		Purpose:     purpose,
 	}
 	log.Printf("intent sent from=%s to=%s", fromID, toID)
-	return postJSON(serverAddr, "/intent", payload, nil, http.StatusOK)
+	return postJSON(ctx, serverAddr, "/intent", payload, nil, http.StatusOK)
+}
+
+// sendDecline tells toID that fromID turned its request down. The server
+// reports it, with the reason, on toID's next lookup of fromID.
+func sendDecline(ctx context.Context, serverAddr, fromID, toID, reason string) error {
+	payload := declineRequest{
+		FromID: fromID,
+		ToID:   toID,
+		Reason: reason,
+	}
+	log.Printf("decline sent from=%s to=%s reason=%q", fromID, toID, reason)
+	return postJSON(ctx, serverAddr, "/decline", payload, nil, http.StatusOK, http.StatusNotFound)
 }
 
-func pollConnectIntent(serverAddr, clientID string) (IceInfo, bool, error) {
+type declineError struct {
+	peerID string
+	reason string
+}
+
+func (e *declineError) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("declined by %s", e.peerID)
+	}
+	return fmt.Sprintf("declined by %s: %s", e.peerID, e.reason)
+}
+
+func pollConnectIntent(ctx context.Context, serverAddr, clientID string) (IntentInfo, bool, error) {
 	payload := pollIntentRequest{ID: clientID}
 	var peer lookupResponse
-	status, err := postJSONWithStatus(serverAddr, "/poll", payload, &peer)
+	err := postJSON(ctx, serverAddr, "/poll", payload, &peer, http.StatusOK)
+	if errors.Is(err, ErrNotFound) {
+		return IntentInfo{}, false, nil
+	}
 	if err != nil {
-		return IceInfo{}, false, err
+		return IntentInfo{}, false, err
 	}
-	if status == http.StatusNotFound {
-		return IceInfo{}, false, nil
+	return IntentInfo{
+		IceInfo: IceInfo{
+			ID:         peer.ID,
+			Ufrag:      peer.Ufrag,
+			Password:   peer.Password,
+			Candidates: peer.Candidates,
+		},
+		DisplayName: peer.DisplayName,
+		Purpose:     peer.Purpose,
+	}, true, nil
+}
+
+// Claims
+
+// claimClientID reserves clientID for this identity key. Servers without
+// claim support answer 404, which is treated as success. A claim held by
+// another key is reported as ErrIDTaken.
+func claimClientID(ctx context.Context, serverAddr, clientID string, ttlSeconds int) error {
+	payload := claimRequest{
+		ID:         clientID,
+		TTLSeconds: ttlSeconds,
 	}
-	if status != http.StatusOK {
-		return IceInfo{}, false, fmt.Errorf("unexpected status: %d", status)
+	err := postJSON(ctx, serverAddr, "/claim", payload, nil, http.StatusOK)
+	switch {
+	case err == nil:
+		log.Printf("client id claimed client_id=%s ttl=%ds", clientID, ttlSeconds)
+		return nil
+	case errors.Is(err, ErrNotFound):
+		return nil
+	case errors.Is(err, ErrForbidden):
+		return fmt.Errorf("%w: %w", ErrIDTaken, err)
 	}
-	return IceInfo{
-		ID:         peer.ID,
-		Ufrag:      peer.Ufrag,
-		Password:   peer.Password,
-		Candidates: peer.Candidates,
+	return err
+}
+
+// TURN credentials
+type TurnCredentials struct {
+	URLs       []string
+	Username   string
+	Credential string
+	Expires    time.Time
+}
+
+// fetchTURNCredentials asks the server for short-lived TURN credentials.
+// ok is false when the server has no relay to offer.
+func fetchTURNCredentials(ctx context.Context, serverAddr, clientID string) (TurnCredentials, bool, error) {
+	payload := turnCredentialsRequest{ID: clientID}
+	var creds turnCredentialsResponse
+	err := postJSON(ctx, serverAddr, "/turn-credentials", payload, &creds, http.StatusOK, http.StatusNoContent)
+	if errors.Is(err, ErrNotFound) {
+		return TurnCredentials{}, false, nil
+	}
+	if err != nil {
+		return TurnCredentials{}, false, err
+	}
+	if len(creds.URLs) == 0 {
+		return TurnCredentials{}, false, nil
+	}
+	return TurnCredentials{
+		URLs:       creds.URLs,
+		Username:   creds.Username,
+		Credential: creds.Credential,
+		Expires:    time.Now().Add(time.Duration(creds.TTLSeconds) * time.Second),
 	}, true, nil
 }
 
 // Unregister
-func unregisterWithServer(serverAddr, clientID string) error {
+func unregisterWithServer(ctx context.Context, serverAddr, clientID string) error {
 	payload := unregisterRequest{ID: clientID}
-	return postJSON(serverAddr, "/unregister", payload, nil, http.StatusOK, http.StatusNotFound)
+	return postJSON(ctx, serverAddr, "/unregister", payload, nil, http.StatusOK, http.StatusNotFound)
 }
 
 // RegisterICE is a test-friendly wrapper around registerICE.
-func RegisterICE(serverAddr, clientID string, info IceInfo, ttlSeconds int) error {
-	return registerICE(serverAddr, clientID, info, ttlSeconds)
+func RegisterICE(ctx context.Context, serverAddr, clientID string, info IceInfo, ttlSeconds int) error {
+	return registerICE(ctx, serverAddr, clientID, info, ttlSeconds)
 }
 
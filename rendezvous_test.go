@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockRendezvous is an in-process rendezvous server implementing
+// /register, /lookup, /intent, /poll and /unregister. Registrations are
+// bound to the key that signed them, like on the real server, and
+// setRateLimit makes the next requests fail with 429.
+type mockRendezvous struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	registered map[string]mockRegistration
+	intents    map[string][]connectIntentRequest
+	limited    int
+	requests   map[string]int
+}
+
+type mockRegistration struct {
+	registerRequest
+	key     string
+	expires time.Time
+}
+
+func newMockRendezvous(t *testing.T) *mockRendezvous {
+	t.Helper()
+	m := &mockRendezvous{
+		registered: make(map[string]mockRegistration),
+		intents:    make(map[string][]connectIntentRequest),
+		requests:   make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", m.handleRegister)
+	mux.HandleFunc("/lookup", m.handleLookup)
+	mux.HandleFunc("/intent", m.handleIntent)
+	mux.HandleFunc("/poll", m.handlePoll)
+	mux.HandleFunc("/unregister", m.handleUnregister)
+	m.Server = httptest.NewServer(m.limit(mux))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// setRateLimit answers the next n requests with 429.
+func (m *mockRendezvous) setRateLimit(n int) {
+	m.mu.Lock()
+	m.limited = n
+	m.mu.Unlock()
+}
+
+// requestCount is how many requests reached path, limited or not.
+func (m *mockRendezvous) requestCount(path string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests[path]
+}
+
+func (m *mockRendezvous) limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		m.requests[r.URL.Path]++
+		limited := m.limited > 0
+		if limited {
+			m.limited--
+		}
+		m.mu.Unlock()
+		if limited {
+			w.Header().Set("Retry-After", "1")
+			mockError(w, http.StatusTooManyRequests, "slow down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *mockRendezvous) handleRegister(w http.ResponseWriter, r *http.Request) {
+	var req registerRequest
+	if !mockDecode(w, r, &req) {
+		return
+	}
+	key := r.Header.Get("X-Chute-Key")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if prev, ok := m.registered[req.ID]; ok && prev.key != key && time.Now().Before(prev.expires) {
+		mockError(w, http.StatusForbidden, "id registered by another key")
+		return
+	}
+	m.registered[req.ID] = mockRegistration{
+		registerRequest: req,
+		key:             key,
+		expires:         time.Now().Add(time.Duration(req.TTLSeconds) * time.Second),
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *mockRendezvous) handleLookup(w http.ResponseWriter, r *http.Request) {
+	var req lookupRequest
+	if !mockDecode(w, r, &req) {
+		return
+	}
+	m.mu.Lock()
+	reg, ok := m.lookupLocked(req.ID)
+	m.mu.Unlock()
+	if !ok {
+		mockError(w, http.StatusNotFound, "not registered")
+		return
+	}
+	mockReply(w, lookupResponse{ID: reg.ID, Ufrag: reg.Ufrag, Password: reg.Password, Candidates: reg.Candidates})
+}
+
+func (m *mockRendezvous) handleIntent(w http.ResponseWriter, r *http.Request) {
+	var req connectIntentRequest
+	if !mockDecode(w, r, &req) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lookupLocked(req.ToID); !ok {
+		mockError(w, http.StatusNotFound, "not registered")
+		return
+	}
+	m.intents[req.ToID] = append(m.intents[req.ToID], req)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *mockRendezvous) handlePoll(w http.ResponseWriter, r *http.Request) {
+	var req pollIntentRequest
+	if !mockDecode(w, r, &req) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.intents[req.ID]) > 0 {
+		intent := m.intents[req.ID][0]
+		m.intents[req.ID] = m.intents[req.ID][1:]
+		from, ok := m.lookupLocked(intent.FromID)
+		if !ok {
+			continue
+		}
+		mockReply(w, lookupResponse{
+			ID:          from.ID,
+			Ufrag:       from.Ufrag,
+			Password:    from.Password,
+			Candidates:  from.Candidates,
+			DisplayName: intent.DisplayName,
+			Purpose:     intent.Purpose,
+		})
+		return
+	}
+	mockError(w, http.StatusNotFound, "no intent")
+}
+
+func (m *mockRendezvous) handleUnregister(w http.ResponseWriter, r *http.Request) {
+	var req unregisterRequest
+	if !mockDecode(w, r, &req) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reg, ok := m.registered[req.ID]
+	if !ok {
+		mockError(w, http.StatusNotFound, "not registered")
+		return
+	}
+	if reg.key != r.Header.Get("X-Chute-Key") {
+		mockError(w, http.StatusForbidden, "id registered by another key")
+		return
+	}
+	delete(m.registered, req.ID)
+	delete(m.intents, req.ID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (m *mockRendezvous) lookupLocked(id string) (mockRegistration, bool) {
+	reg, ok := m.registered[id]
+	if !ok || time.Now().After(reg.expires) {
+		return mockRegistration{}, false
+	}
+	return reg, true
+}
+
+func mockDecode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.Method != http.MethodPost {
+		mockError(w, http.StatusMethodNotAllowed, "POST only")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		mockError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func mockReply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func mockError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func TestRendezvousRegisterLookupPoll(t *testing.T) {
+	server := newMockRendezvous(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	alice := IceInfo{Ufrag: "ufrag-a", Password: "pass-a", Candidates: []string{"candidate:1 1 udp 1 192.0.2.1 5000 typ host"}}
+	bob := IceInfo{Ufrag: "ufrag-b", Password: "pass-b", Candidates: []string{"candidate:2 1 udp 1 192.0.2.2 5000 typ host"}}
+	if err := registerICE(ctx, server.URL, "alice", alice, 60); err != nil {
+		t.Fatalf("register alice: %v", err)
+	}
+	if err := registerICE(ctx, server.URL, "bob", bob, 60); err != nil {
+		t.Fatalf("register bob: %v", err)
+	}
+
+	info, ok, err := lookupICE(ctx, server.URL, "bob")
+	if err != nil || !ok {
+		t.Fatalf("lookup bob: ok=%t err=%v", ok, err)
+	}
+	if info.Ufrag != bob.Ufrag || info.Password != bob.Password || len(info.Candidates) != 1 {
+		t.Fatalf("lookup bob = %+v", info)
+	}
+	if _, ok, err := lookupICE(ctx, server.URL, "carol"); err != nil || ok {
+		t.Fatalf("lookup carol: ok=%t err=%v, want not found", ok, err)
+	}
+
+	if _, ok, err := pollConnectIntent(ctx, server.URL, "bob"); err != nil || ok {
+		t.Fatalf("poll before intent: ok=%t err=%v", ok, err)
+	}
+	if err := sendConnectIntent(ctx, server.URL, "alice", "bob", 20, "Alice", "photos"); err != nil {
+		t.Fatalf("intent: %v", err)
+	}
+	intent, ok, err := pollConnectIntent(ctx, server.URL, "bob")
+	if err != nil || !ok {
+		t.Fatalf("poll: ok=%t err=%v", ok, err)
+	}
+	if intent.ID != "alice" || intent.Ufrag != alice.Ufrag || intent.DisplayName != "Alice" || intent.Purpose != "photos" {
+		t.Fatalf("poll = %+v", intent)
+	}
+	if _, ok, _ := pollConnectIntent(ctx, server.URL, "bob"); ok {
+		t.Fatal("intent delivered twice")
+	}
+
+	if err := unregisterWithServer(ctx, server.URL, "bob"); err != nil {
+		t.Fatalf("unregister: %v", err)
+	}
+	if _, ok, err := lookupICE(ctx, server.URL, "bob"); err != nil || ok {
+		t.Fatalf("lookup after unregister: ok=%t err=%v", ok, err)
+	}
+}
+
+func TestRendezvousRateLimit(t *testing.T) {
+	server := newMockRendezvous(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := registerICE(ctx, server.URL, "alice", IceInfo{Ufrag: "u", Password: "p"}, 60); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	// Lookups are idempotent, so a 429 is retried after a backoff.
+	server.setRateLimit(1)
+	if _, ok, err := lookupICE(ctx, server.URL, "alice"); err != nil || !ok {
+		t.Fatalf("lookup after one 429: ok=%t err=%v", ok, err)
+	}
+	if got := server.requestCount("/lookup"); got != 2 {
+		t.Fatalf("lookup requests = %d, want 2", got)
+	}
+
+	// Polls hand an intent out once and are never repeated.
+	server.setRateLimit(1)
+	_, _, err := pollConnectIntent(ctx, server.URL, "alice")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("poll err = %v, want ErrRateLimited", err)
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.RetryAfter != time.Second {
+		t.Fatalf("poll err = %#v, want Retry-After of 1s", err)
+	}
+	if got := server.requestCount("/poll"); got != 1 {
+		t.Fatalf("poll requests = %d, want 1", got)
+	}
+}
+
+func TestServerErrorConflict(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/register", true},
+		{"/claim", true},
+		{"/intent", false},
+		{"/lookup", false},
+	}
+	for _, tt := range tests {
+		err := &ServerError{Path: tt.path, Status: http.StatusConflict}
+		if got := errors.Is(err, ErrIDTaken); got != tt.want {
+			t.Errorf("409 from %s is ErrIDTaken = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+}
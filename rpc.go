@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+const (
+	controlRPC      = "rpc"
+	controlRPCReply = "rpc-reply"
+
+	rpcPayloadLimit = 1 << 20
+	// rpcTimeout bounds a call whose context has no deadline of its own.
+	rpcTimeout = 30 * time.Second
+
+	rpcCapabilities = "capabilities"
+)
+
+// RPCHandler answers one call from peerID. params is the raw JSON the
+// caller sent, or nil; the result is marshaled back as JSON.
+type RPCHandler func(ctx context.Context, peerID string, params json.RawMessage) (any, error)
+
+// RPCError is an error returned by the peer's handler rather than by the
+// transport.
+type RPCError struct {
+	Method  string
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return e.Method + ": " + e.Message
+}
+
+// Capabilities is the answer to the built-in capabilities call.
+type Capabilities struct {
+	Version  string   `json:"version"`
+	E2E      bool     `json:"e2e"`
+	Channels bool     `json:"channels"`
+	Methods  []string `json:"methods"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type rpcReply struct {
+	response rpcResponse
+	err      error
+}
+
+// RPC
+//
+// A call travels on its own control stream: an "rpc <token> <method>"
+// frame followed by the JSON params up to the end of the stream. The
+// peer runs the handler registered for method and answers the same way
+// with an "rpc-reply <token>" frame and a JSON response holding either
+// the result or the handler's error. Tokens come from the waiter counter,
+// so they never collide with other replies in flight. Peers that predate
+// RPC log an unknown frame and the call runs into its deadline.
+
+// Call invokes method on the peer with params and decodes the result into
+// result, which may be nil to discard it.
+func (s *ChuteSession) Call(ctx context.Context, method string, params, result any) error {
+	if method == "" || strings.ContainsAny(method, " \t") {
+		return fmt.Errorf("invalid method %q", method)
+	}
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return ErrNoSession
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rpcTimeout)
+		defer cancel()
+	}
+
+	var payload []byte
+	if params != nil {
+		var err error
+		if payload, err = json.Marshal(params); err != nil {
+			return err
+		}
+		if len(payload) > rpcPayloadLimit {
+			return fmt.Errorf("%s: params too large", method)
+		}
+	}
+
+	token, done := s.addCall()
+	defer s.removeCall(token)
+
+	if err := writeControlPayload(ctx, conn, controlRPC+" "+token+" "+method, payload); err != nil {
+		return sendError(conn, err)
+	}
+	debugf("rpc", "call sent token=%s method=%s bytes=%d", token, method, len(payload))
+
+	var reply rpcReply
+	select {
+	case reply = <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.Context().Done():
+		return ErrPeerGone
+	}
+	if reply.err != nil {
+		return reply.err
+	}
+	if reply.response.Error != "" {
+		return &RPCError{Method: method, Message: reply.response.Error}
+	}
+	if result == nil || len(reply.response.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(reply.response.Result, result); err != nil {
+		return fmt.Errorf("%s: decode result: %w", method, err)
+	}
+	return nil
+}
+
+// SetRPCHandler registers fn to answer the peer's calls to method.
+func (s *ChuteSession) SetRPCHandler(method string, fn RPCHandler) {
+	s.mu.Lock()
+	if s.rpcHandlers == nil {
+		s.rpcHandlers = make(map[string]RPCHandler)
+	}
+	s.rpcHandlers[method] = fn
+	s.mu.Unlock()
+}
+
+// PeerCapabilities asks the peer what it supports.
+func (s *ChuteSession) PeerCapabilities(ctx context.Context) (Capabilities, error) {
+	var caps Capabilities
+	err := s.Call(ctx, rpcCapabilities, nil, &caps)
+	return caps, err
+}
+
+// serveRPC reads one call and answers it.
+func (s *ChuteSession) serveRPC(conn quic.Connection, stream quic.ReceiveStream, arg string) {
+	token, method, _ := strings.Cut(arg, " ")
+	_ = stream.SetReadDeadline(time.Now().Add(handshakeIdle))
+	params, err := readRPCPayload(stream)
+	if err != nil {
+		stream.CancelRead(0)
+		log.Printf("rpc read failed method=%s err=%v", method, err)
+		return
+	}
+
+	s.mu.Lock()
+	fn := s.rpcHandlers[method]
+	peerID := s.peerID
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(conn.Context(), rpcTimeout)
+	defer cancel()
+
+	var response rpcResponse
+	var result any
+	switch {
+	case method == rpcCapabilities:
+		result = s.capabilities(conn)
+	case fn == nil:
+		err = errors.New("unknown method")
+	default:
+		result, err = fn(ctx, peerID, params)
+	}
+	if err != nil {
+		response.Error = err.Error()
+	} else if result != nil {
+		if response.Result, err = json.Marshal(result); err != nil {
+			response = rpcResponse{Error: "encode result: " + err.Error()}
+		}
+	}
+	payload, err := json.Marshal(response)
+	if err == nil && len(payload) > rpcPayloadLimit {
+		payload, err = json.Marshal(rpcResponse{Error: "result too large"})
+	}
+	if err != nil {
+		return
+	}
+	debugf("rpc", "call served token=%s method=%s peer_id=%s error=%q", token, method, peerID, response.Error)
+	if err := writeControlPayload(ctx, conn, controlRPCReply+" "+token, payload); err != nil {
+		log.Printf("rpc reply failed method=%s peer_id=%s err=%v", method, peerID, err)
+	}
+}
+
+// readRPCReply reads a reply and hands it to the waiting call.
+func (s *ChuteSession) readRPCReply(stream quic.ReceiveStream, token string) {
+	_ = stream.SetReadDeadline(time.Now().Add(handshakeIdle))
+	var reply rpcReply
+	payload, err := readRPCPayload(stream)
+	if err != nil {
+		stream.CancelRead(0)
+		reply.err = err
+	} else if err := json.Unmarshal(payload, &reply.response); err != nil {
+		reply.err = fmt.Errorf("bad rpc reply: %w", err)
+	}
+
+	s.mu.Lock()
+	done, ok := s.calls[token]
+	delete(s.calls, token)
+	s.mu.Unlock()
+	if ok {
+		done <- reply
+	}
+}
+
+func (s *ChuteSession) capabilities(conn quic.Connection) Capabilities {
+	s.mu.Lock()
+	methods := []string{rpcCapabilities}
+	for method := range s.rpcHandlers {
+		if method != rpcCapabilities {
+			methods = append(methods, method)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(methods)
+	return Capabilities{
+		Version:  version,
+		E2E:      connUsesE2E(conn),
+		Channels: connUsesChannels(conn),
+		Methods:  methods,
+	}
+}
+
+// addCall works like addWaiter for calls, whose replies carry a payload.
+func (s *ChuteSession) addCall() (string, chan rpcReply) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls == nil {
+		s.calls = make(map[string]chan rpcReply)
+	}
+	s.nextWaiter++
+	token := strconv.FormatUint(s.nextWaiter, 10)
+	done := make(chan rpcReply, 1)
+	s.calls[token] = done
+	return token, done
+}
+
+func (s *ChuteSession) removeCall(token string) {
+	s.mu.Lock()
+	delete(s.calls, token)
+	s.mu.Unlock()
+}
+
+// Helpers
+func writeControlPayload(ctx context.Context, conn quic.Connection, frame string, payload []byte) error {
+	stream, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	if err := writeLine(stream, frame); err != nil {
+		stream.CancelWrite(0)
+		return err
+	}
+	if _, err := stream.Write(payload); err != nil {
+		stream.CancelWrite(0)
+		return err
+	}
+	return stream.Close()
+}
+
+func readRPCPayload(r io.Reader) ([]byte, error) {
+	payload, err := io.ReadAll(io.LimitReader(r, rpcPayloadLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > rpcPayloadLimit {
+		return nil, errors.New("rpc payload too large")
+	}
+	if len(payload) == 0 {
+		return nil, nil
+	}
+	return payload, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const sealChunk = 64 << 10
+
+var errSealedTruncated = errors.New("sealed data is truncated")
+
+// Sealed streams
+//
+// Data is split into chunks of up to sealChunk bytes, each sealed with
+// AES-256-GCM under a nonce that counts chunks. Every chunk is framed as
+// a flag byte and a 4-byte ciphertext length; the flag marks the last
+// chunk and is authenticated, so reordering, dropping or cutting off
+// chunks fails instead of yielding a shorter plaintext.
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	counter uint64
+	buf     []byte
+	closed  bool
+}
+
+func newSealWriter(w io.Writer, key []byte) (*sealWriter, error) {
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, buf: make([]byte, 0, sealChunk)}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed sealed stream")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == cap(s.buf) && len(p) > 0 {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Flush seals what has been written so far as a chunk of its own.
+func (s *sealWriter) Flush() error {
+	if s.closed || len(s.buf) == 0 {
+		return nil
+	}
+	return s.flush(false)
+}
+
+// Close seals the final chunk. It does not close the underlying writer.
+func (s *sealWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(final bool) error {
+	flag := []byte{0}
+	if final {
+		flag[0] = 1
+	}
+	sealed := s.aead.Seal(nil, sealNonce(s.counter), s.buf, flag)
+	s.counter++
+	s.buf = s.buf[:0]
+
+	frame := make([]byte, 5, 5+len(sealed))
+	frame[0] = flag[0]
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(sealed)))
+	_, err := s.w.Write(append(frame, sealed...))
+	return err
+}
+
+type openReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	counter uint64
+	plain   []byte
+	done    bool
+}
+
+func newOpenReader(r io.Reader, key []byte) (*openReader, error) {
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: r, aead: aead}, nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	var frame [5]byte
+	if _, err := io.ReadFull(o.r, frame[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errSealedTruncated
+		}
+		return err
+	}
+	size := binary.BigEndian.Uint32(frame[1:])
+	if frame[0] > 1 || size > sealChunk+uint32(o.aead.Overhead()) {
+		return errors.New("bad sealed chunk header")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errSealedTruncated
+		}
+		return err
+	}
+	plain, err := o.aead.Open(sealed[:0], sealNonce(o.counter), sealed, frame[:1])
+	if err != nil {
+		return errors.New("sealed data failed authentication")
+	}
+	o.counter++
+	o.plain = plain
+	o.done = frame[0] == 1
+	return nil
+}
+
+// Helpers
+func newSealAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	serviceName        = "chute"
+	serviceDisplayName = "Chute"
+	serviceDescription = "Chute peer-to-peer client, kept running for file drops and incoming connections."
+	serviceLogFile     = "service.log"
+)
+
+// Service
+//
+// "service install" registers the headless backend with the platform's
+// service manager, so it runs without anyone logged into a terminal:
+// a Windows service that starts at boot, or a macOS LaunchAgent that
+// starts at login and is restarted if it exits. The installed command
+// is this binary with the flags given to install, followed by "service
+// run", which is daemon mode plus the service manager's stop requests.
+// Each profile installs as its own service.
+
+// runServiceCommand handles "service install" and "service uninstall"
+// and exits.
+func runServiceCommand(action, profile string) {
+	name := serviceName
+	if profile != "" && profile != "default" {
+		name += "-" + profile
+	}
+	var err error
+	switch action {
+	case "install":
+		var exe string
+		if exe, err = os.Executable(); err == nil {
+			if exe, err = filepath.EvalSymlinks(exe); err == nil {
+				args := serviceFlags()
+				if profile != "" && !flagGiven("profile") {
+					args = append(args, "-profile="+profile)
+				}
+				err = installService(name, exe, append(args, "service", "run"))
+			}
+		}
+	case "uninstall":
+		err = uninstallService(name)
+	default:
+		err = fmt.Errorf("unknown service command %q (want install, uninstall or run)", action)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s failed: %v\n", action, err)
+		os.Exit(1)
+	}
+	fmt.Printf("service %s: %sed\n", name, action)
+}
+
+// serviceFlags returns the flags given on the command line, for the
+// installed service to run with.
+func serviceFlags() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+	})
+	return args
+}
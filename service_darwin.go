@@ -0,0 +1,100 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// installService writes a LaunchAgent that starts at login and is kept
+// alive, then loads it.
+func installService(name, exe string, args []string) error {
+	path, err := launchAgentPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s is already installed", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, launchAgentPlist(launchAgentLabel(name), append([]string{exe}, args...)), 0o644); err != nil {
+		return err
+	}
+	if err := launchctl("load", "-w", path); err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	path, err := launchAgentPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s is not installed", name)
+	}
+	if err := launchctl("unload", "-w", path); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// startServiceControl has nothing to answer: launchd stops the agent
+// with SIGTERM, which shuts down like any daemon.
+func startServiceControl() (stop <-chan struct{}, done func(), err error) {
+	return nil, func() {}, nil
+}
+
+// Helpers
+func launchAgentLabel(name string) string {
+	return "com.xenthera." + name
+}
+
+func launchAgentPath(name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", launchAgentLabel(name)+".plist"), nil
+}
+
+func launchAgentPlist(label string, args []string) []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString("<plist version=\"1.0\">\n<dict>\n")
+	b.WriteString("\t<key>Label</key>\n\t<string>")
+	_ = xml.EscapeText(&b, []byte(label))
+	b.WriteString("</string>\n\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range args {
+		b.WriteString("\t\t<string>")
+		_ = xml.EscapeText(&b, []byte(arg))
+		b.WriteString("</string>\n")
+	}
+	b.WriteString("\t</array>\n")
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<true/>\n")
+	b.WriteString("\t<key>ProcessType</key>\n\t<string>Background</string>\n")
+	b.WriteString("</dict>\n</plist>\n")
+	return b.Bytes()
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !windows && !darwin
+
+package main
+
+import "errors"
+
+var errServiceUnsupported = errors.New("services are supported on Windows and macOS; elsewhere run chute daemon from your init system, e.g. a systemd user unit")
+
+func installService(name, exe string, args []string) error {
+	return errServiceUnsupported
+}
+
+func uninstallService(name string) error {
+	return errServiceUnsupported
+}
+
+func startServiceControl() (stop <-chan struct{}, done func(), err error) {
+	return nil, func() {}, nil
+}
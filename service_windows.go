@@ -0,0 +1,129 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceStopTimeout = 10 * time.Second
+
+// installService creates a service that starts at boot and starts it.
+// Services run as LocalSystem, so the service is pointed at the
+// installing user's config dir to keep the same identity and settings.
+func installService(name, exe string, args []string) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("%s is already installed", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err := setServiceEnv(name, "CHUTE_CONFIG_DIR="+dir); err != nil {
+		_ = s.Delete()
+		return err
+	}
+	return s.Start()
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("%s is not installed: %w", name, err)
+	}
+	defer s.Close()
+	if status, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(serviceStopTimeout)
+		for status.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(300 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	return s.Delete()
+}
+
+func setServiceEnv(name string, env ...string) error {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+name, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	return key.SetStringsValue("Environment", env)
+}
+
+// startServiceControl answers the service manager when the process was
+// started by it. stop is closed when the service is asked to stop; done
+// must be called once the daemon has shut down. Run from a console, stop
+// is nil and done does nothing.
+func startServiceControl() (stop <-chan struct{}, done func(), err error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return nil, func() {}, err
+	}
+	h := &serviceHandler{stop: make(chan struct{}), done: make(chan struct{})}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		if err := svc.Run(serviceName, h); err != nil {
+			log.Printf("service run failed: %v", err)
+		}
+	}()
+	return h.stop, func() {
+		close(h.done)
+		<-exited
+	}, nil
+}
+
+type serviceHandler struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (h *serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-h.done:
+			status <- svc.Status{State: svc.StopPending}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(h.stop)
+				<-h.done
+				return false, 0
+			}
+		}
+	}
+}
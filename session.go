@@ -1,20 +1,26 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"math/big"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	quic "github.com/quic-go/quic-go"
 )
@@ -22,44 +28,145 @@ import (
 const (
 	nextProto     = "chute-quic"
 	identityLimit = 64
+
+	controlGoodbye = "goodbye"
+	controlTyping  = "typing"
+	controlRead    = "read"
+	controlVersion = "version"
+	goodbyeTimeout = 1 * time.Second
+
+	// A typing frame keeps the indicator lit for typingWindow; senders
+	// repeat it at most every typingInterval while the user types.
+	typingWindow   = 5 * time.Second
+	typingInterval = 2 * time.Second
+
+	messageAck = "ack"
+	ackTimeout = 5 * time.Second
+)
+
+// Errors returned by sends and connects, for callers that need to tell
+// them apart.
+var (
+	ErrNoSession = errors.New("no active session")
+	ErrBusy      = errors.New("peer is busy")
+	ErrPeerGone  = errors.New("peer disconnected")
+)
+
+// Tunable via flags; see main.
+var (
 	sessionIdle   = 5 * time.Minute
 	keepAlive     = 20 * time.Second
 	handshakeIdle = 10 * time.Second
+
+	// messageLimit caps how much of a stream is buffered in memory as a
+	// message; anything longer goes to the large message handler.
+	messageLimit int64 = 4 << 20
 )
 
+// ChuteSession owns one QUIC connection to a peer. All state is guarded
+// by mu; use the accessor methods from outside.
 type ChuteSession struct {
-	LocalID     string
-	PeerID      string
-	Connected   bool
-	ReceiveChan chan []byte
-	Mutex       sync.Mutex
+	localID     string
+	peerID      string
+	connected   bool
+	handshaking bool
+	receiveChan chan []byte
+	mu          sync.Mutex
+
+	messageHandler func(peerID string, payload []byte)
+	largeHandler   func(peerID string, r io.Reader) error
+	fileHandler    func(peerID string, offer FileOffer, r io.Reader) error
 
 	transport  *quic.Transport
 	listener   *quic.Listener
 	conn       quic.Connection
 	acceptOnce sync.Once
-	onClose    func()
+	onClose    []func()
 	closeOnce  sync.Once
+
+	// ownsTransport is set when the session created its transport, and
+	// closes it once the session is over.
+	ownsTransport bool
+	released      bool
+	releaseOnce   sync.Once
+
+	identity        ed25519.PrivateKey
+	peerFingerprint string
+	verifyPeer      func(peerID, fingerprint string) error
+
+	peerVersion string
+	peerE2E     bool
+
+	peerRTT          time.Duration
+	peerUnresponsive bool
+	livenessHandler  func(unresponsive bool)
+
+	lastActivity time.Time
+	idleWarned   bool
+	transfers    int
+	idleHandler  func(remaining time.Duration)
+
+	peerTypingAt time.Time
+	sentTypingAt time.Time
+
+	// receivedSeq counts messages queued for the user on this connection;
+	// acks and read receipts refer to messages by this number. shownSeq
+	// counts how many of them the user has been shown.
+	receivedSeq    uint64
+	shownSeq       uint64
+	receiptHandler func(seq uint64)
+
+	// waiters wake callers blocked on a reply frame such as pong.
+	waiters    map[string]chan string
+	calls      map[string]chan rpcReply
+	nextWaiter uint64
+
+	rpcHandlers map[string]RPCHandler
+
+	streamHandler   func(io.Reader)
+	channelHandlers map[string]func(peerID string, ch *Channel)
 }
 
-func NewChuteSession(conn net.PacketConn, localID string) *ChuteSession {
-	transport := &quic.Transport{Conn: conn}
+// NewChuteSession creates a session whose TLS certificates are signed by
+// identity, so peers see a stable fingerprint. A nil identity falls back
+// to a throwaway key.
+func NewChuteSession(conn net.PacketConn, localID string, identity ed25519.PrivateKey) *ChuteSession {
+	s := newTransportSession(&quic.Transport{Conn: conn}, localID, identity)
+	s.ownsTransport = true
+	return s
+}
+
+// newTransportSession creates a session on a transport it shares with
+// others, such as the direct endpoint's. Closing the session leaves the
+// transport open.
+func newTransportSession(transport *quic.Transport, localID string, identity ed25519.PrivateKey) *ChuteSession {
+	if identity == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		identity = key
+	}
 	return &ChuteSession{
-		LocalID:     localID,
-		ReceiveChan: make(chan []byte, 16),
+		localID:     localID,
+		receiveChan: make(chan []byte, 16),
 		transport:   transport,
+		identity:    identity,
 	}
 }
 
-func (s *ChuteSession) Start() {
+// Start listens for the peer's incoming QUIC connection until ctx is done.
+func (s *ChuteSession) Start(ctx context.Context) {
 	s.acceptOnce.Do(func() {
-		listener, err := s.transport.Listen(serverTLSConfig(), quicConfig())
+		listener, err := s.transport.Listen(serverTLSConfig(s.identity), quicConfig())
 		if err != nil {
 			log.Printf("quic listen failed: %v", err)
 			return
 		}
+		s.mu.Lock()
 		s.listener = listener
-		go s.acceptLoop()
+		s.mu.Unlock()
+		supervise(ctx, fmt.Sprintf("session accept %s", listener.Addr()), s.acceptLoop)
 	})
 }
 
@@ -72,253 +179,865 @@ func (s *ChuteSession) ConnectWithContext(ctx context.Context, peer PeerEndpoint
 }
 
 func (s *ChuteSession) connectWithContext(ctx context.Context, peer PeerEndpoint, id string) error {
-	s.Mutex.Lock()
-	if s.Connected {
-		s.Mutex.Unlock()
-		log.Printf("session busy peer_id=%s", s.PeerID)
-		return errors.New("busy")
+	s.mu.Lock()
+	if s.connected || s.handshaking {
+		s.mu.Unlock()
+		log.Printf("session busy peer_id=%s", s.peerID)
+		return ErrBusy
 	}
-	s.Mutex.Unlock()
+	s.mu.Unlock()
 
 	remoteAddr := &net.UDPAddr{
 		IP:   net.ParseIP(peer.IP),
 		Port: peer.Port,
 	}
-	conn, err := s.transport.Dial(ctx, remoteAddr, clientTLSConfig(), quicConfig())
+	conn, err := s.transport.Dial(ctx, remoteAddr, clientTLSConfig(s.identity), quicConfig())
 	if err != nil {
 		return err
 	}
 
-	if err := s.handshakeDial(conn); err != nil {
+	keys, err := s.handshakeDial(ctx, conn)
+	if err != nil {
 		_ = conn.CloseWithError(0, "handshake failed")
 		return err
 	}
 
-	s.Mutex.Lock()
-	s.PeerID = id
-	s.Connected = true
+	fingerprint := connFingerprint(conn)
+	if err := s.verify(id, fingerprint); err != nil {
+		_ = conn.CloseWithError(0, "peer verification failed")
+		return err
+	}
+	conn = sealConn(conn, keys)
+	s.mu.Lock()
+	s.peerID = id
+	s.connected = true
 	s.conn = conn
-	s.Mutex.Unlock()
+	s.peerE2E = keys != nil
+	s.peerFingerprint = fingerprint
+	s.receivedSeq = 0
+	s.shownSeq = 0
+	s.peerUnresponsive = false
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
 
-	log.Printf("session started peer_id=%s remote=%s", s.PeerID, conn.RemoteAddr().String())
+	log.Printf("session started peer_id=%s remote=%s fingerprint=%s e2e=%t", id, conn.RemoteAddr().String(), fingerprint, keys != nil)
 	go s.monitorConnection(conn)
 	go s.readLoop(conn)
+	go s.controlLoop(conn)
+	go s.sendVersion(conn)
+	go s.heartbeat(conn)
+	go s.watchIdle(conn)
 	return nil
 }
 
+// Close tells the peer goodbye before closing the connection, so it can
+// report the disconnect right away instead of waiting for a timeout.
 func (s *ChuteSession) Close() error {
-	s.Mutex.Lock()
-	if !s.Connected {
-		s.Mutex.Unlock()
+	defer s.release()
+	conn, _ := s.detach(nil)
+	if conn == nil {
 		return nil
 	}
-	conn := s.conn
-	s.conn = nil
-	s.Connected = false
-	s.PeerID = ""
-	s.Mutex.Unlock()
 
-	if conn != nil {
-		_ = conn.CloseWithError(0, "session closed")
-	}
+	s.sendGoodbye(conn)
+	_ = conn.CloseWithError(0, "session closed")
 	log.Printf("session closed")
 	s.runOnClose()
 	return nil
 }
 
-func (s *ChuteSession) acceptLoop() {
+// release closes the listener, ending the accept loop, and the transport
+// if the session owns it. A session is not reused once closed. It runs
+// after the close handlers: closing a transport waits for its socket to
+// stop reading, and ICE sockets only stop once the agent is closed.
+func (s *ChuteSession) release() {
+	s.releaseOnce.Do(func() {
+		s.mu.Lock()
+		listener := s.listener
+		s.released = true
+		s.mu.Unlock()
+		if listener != nil {
+			_ = listener.Close()
+		}
+		if s.ownsTransport {
+			_ = s.transport.Close()
+		}
+	})
+}
+
+// detach clears the active connection and returns it with its peer id.
+// When only is non-nil, nothing happens unless it is the active connection.
+func (s *ChuteSession) detach(only quic.Connection) (quic.Connection, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.connected || (only != nil && s.conn != only) {
+		return nil, ""
+	}
+	conn := s.conn
+	peerID := s.peerID
+	s.conn = nil
+	s.connected = false
+	s.peerID = ""
+	s.peerFingerprint = ""
+	return conn, peerID
+}
+
+func (s *ChuteSession) acceptLoop(ctx context.Context) error {
 	for {
-		conn, err := s.listener.Accept(context.Background())
+		conn, err := s.listener.Accept(ctx)
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) || errors.Is(err, context.Canceled) {
-				return
+			if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+				return nil
 			}
-			log.Printf("quic accept failed: %v", err)
-			continue
+			// The listener also fails when the connection under the
+			// transport goes away; that ends the session as well.
+			s.mu.Lock()
+			released := s.released
+			s.mu.Unlock()
+			if released {
+				return nil
+			}
+			return fmt.Errorf("quic accept: %w", err)
 		}
-		go s.handleIncoming(conn)
+		go s.handleIncoming(ctx, conn)
 	}
 }
 
-func (s *ChuteSession) handleIncoming(conn quic.Connection) {
-	s.Mutex.Lock()
-	if s.Connected {
-		s.Mutex.Unlock()
+// Adopt runs the accept side of the handshake on conn, which arrived on
+// a listener the session does not own. It reports whether the session
+// is now connected.
+func (s *ChuteSession) Adopt(ctx context.Context, conn quic.Connection) bool {
+	return s.handleIncoming(ctx, conn)
+}
+
+// handleIncoming reports whether conn became the session's connection.
+// While the peer is identified and verified the session is handshaking,
+// which turns other connections away, and it only counts as connected
+// once that passed.
+func (s *ChuteSession) handleIncoming(ctx context.Context, conn quic.Connection) bool {
+	s.mu.Lock()
+	if s.connected || s.handshaking {
+		s.mu.Unlock()
 		_ = conn.CloseWithError(0, "busy")
-		return
+		return false
 	}
-	s.Connected = true
-	s.conn = conn
-	s.Mutex.Unlock()
+	s.handshaking = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.handshaking = false
+		s.mu.Unlock()
+	}()
 
-	peerID, err := s.handshakeAccept(conn)
+	peerID, keys, err := s.handshakeAccept(ctx, conn)
 	if err != nil {
 		_ = conn.CloseWithError(0, "handshake failed")
-		s.Mutex.Lock()
-		s.Connected = false
-		s.conn = nil
-		s.Mutex.Unlock()
-		return
+		return false
 	}
 
-	s.Mutex.Lock()
-	s.PeerID = peerID
-	s.Mutex.Unlock()
+	fingerprint := connFingerprint(conn)
+	if err := s.verify(peerID, fingerprint); err != nil {
+		log.Printf("session rejected peer_id=%s remote=%s err=%v", peerID, conn.RemoteAddr().String(), err)
+		_ = conn.CloseWithError(0, "peer verification failed")
+		return false
+	}
+	conn = sealConn(conn, keys)
+	s.mu.Lock()
+	if s.released {
+		s.mu.Unlock()
+		_ = conn.CloseWithError(0, "session closed")
+		return false
+	}
+	s.peerID = peerID
+	s.connected = true
+	s.conn = conn
+	s.peerE2E = keys != nil
+	s.peerFingerprint = fingerprint
+	s.receivedSeq = 0
+	s.shownSeq = 0
+	s.peerUnresponsive = false
+	s.lastActivity = time.Now()
+	s.mu.Unlock()
 
-	log.Printf("session accepted peer_id=%s remote=%s", s.PeerID, conn.RemoteAddr().String())
+	log.Printf("session accepted peer_id=%s remote=%s fingerprint=%s e2e=%t", peerID, conn.RemoteAddr().String(), fingerprint, keys != nil)
 	go s.monitorConnection(conn)
 	go s.readLoop(conn)
+	go s.controlLoop(conn)
+	go s.sendVersion(conn)
+	go s.heartbeat(conn)
+	go s.watchIdle(conn)
+	return true
+}
+
+// SendContext sends msg, giving up when ctx is done.
+func (s *ChuteSession) SendContext(ctx context.Context, msg []byte) error {
+	_, err := s.Deliver(ctx, msg)
+	return err
 }
 
-func (s *ChuteSession) Send(msg []byte) error {
-	s.Mutex.Lock()
-	if !s.Connected || s.conn == nil {
-		s.Mutex.Unlock()
-		return errors.New("no active session")
+// Deliver sends msg and waits briefly for the peer to acknowledge it.
+// Peers that predate acks just close the stream, which reports Written.
+func (s *ChuteSession) Deliver(ctx context.Context, msg []byte) (DeliveryState, error) {
+	state, _, err := s.deliver(ctx, msg)
+	return state, err
+}
+
+// deliver also returns the peer's sequence number for the message, or 0
+// when it was not acknowledged.
+func (s *ChuteSession) deliver(ctx context.Context, msg []byte) (DeliveryState, uint64, error) {
+	s.mu.Lock()
+	if !s.connected || s.conn == nil {
+		s.mu.Unlock()
+		return DeliveryFailed, 0, ErrNoSession
 	}
 	conn := s.conn
-	peerID := s.PeerID
-	s.Mutex.Unlock()
+	peerID := s.peerID
+	s.mu.Unlock()
+	s.touch()
 
-	stream, err := conn.OpenStreamSync(context.Background())
+	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
-		return err
+		return DeliveryFailed, 0, sendError(conn, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetWriteDeadline(deadline)
+	}
+	if connUsesChannels(conn) {
+		if err := writeLine(stream, channelChat); err != nil {
+			_ = stream.Close()
+			return DeliveryFailed, 0, sendError(conn, err)
+		}
 	}
 	if _, err := stream.Write(msg); err != nil {
 		_ = stream.Close()
 		log.Printf("quic send failed peer_id=%s err=%v", peerID, err)
-		return err
+		return DeliveryFailed, 0, sendError(conn, err)
 	}
 	if err := stream.Close(); err != nil {
 		log.Printf("quic send close failed peer_id=%s err=%v", peerID, err)
 	}
-	log.Printf("quic sent peer_id=%s bytes=%d", peerID, len(msg))
-	return nil
+
+	deadline := time.Now().Add(ackTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = stream.SetReadDeadline(deadline)
+	state := DeliveryWritten
+	var seq uint64
+	if line, err := readLine(stream); err == nil {
+		name, arg, _ := strings.Cut(line, " ")
+		if name == messageAck {
+			state = DeliveryDelivered
+			seq, _ = strconv.ParseUint(arg, 10, 64)
+		}
+	}
+	log.Printf("quic sent peer_id=%s bytes=%d delivery=%s", peerID, len(msg), state)
+	return state, seq, nil
+}
+
+// OpenStream opens a raw stream to the peer. Closing it ends the write
+// direction only; the peer closes its side once it has read everything.
+func (s *ChuteSession) OpenStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	s.mu.Lock()
+	if !s.connected || s.conn == nil {
+		s.mu.Unlock()
+		return nil, ErrNoSession
+	}
+	conn := s.conn
+	s.mu.Unlock()
+	s.touch()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !connUsesChannels(conn) {
+		s.holdIdleOpen(stream)
+		return stream, nil
+	}
+	if err := writeLine(stream, channelStream); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	s.holdIdleOpen(stream)
+	return stream, nil
 }
 
 func (s *ChuteSession) IsConnectedTo(targetID string) bool {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	return s.Connected && s.PeerID == targetID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected && s.peerID == targetID
 }
 
 func (s *ChuteSession) IsConnected() bool {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	return s.Connected
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
 }
 
 func (s *ChuteSession) CurrentPeerID() string {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-	return s.PeerID
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerID
+}
+
+func (s *ChuteSession) LocalID() string {
+	return s.localID
+}
+
+// Messages delivers received payloads when no message handler is set.
+func (s *ChuteSession) Messages() <-chan []byte {
+	return s.receiveChan
+}
+
+// sendError reports a failure on a connection that has since closed as
+// ErrPeerGone, keeping the underlying cause in the message.
+func sendError(conn quic.Connection, err error) error {
+	if conn.Context().Err() != nil {
+		return fmt.Errorf("%w: %v", ErrPeerGone, err)
+	}
+	return err
+}
+
+// SetLargeMessageHandler registers fn to consume messages longer than
+// messageLimit as a stream. Without one, such messages are refused.
+func (s *ChuteSession) SetLargeMessageHandler(fn func(peerID string, r io.Reader) error) {
+	s.mu.Lock()
+	s.largeHandler = fn
+	s.mu.Unlock()
+}
+
+// receiveLarge passes an oversized message, starting with the part already
+// buffered, to the large message handler.
+func (s *ChuteSession) receiveLarge(stream quic.Stream, head []byte) {
+	s.mu.Lock()
+	handler := s.largeHandler
+	peerID := s.peerID
+	s.mu.Unlock()
+
+	if handler == nil {
+		stream.CancelRead(0)
+		_ = stream.Close()
+		log.Printf("quic message refused peer_id=%s limit=%d", peerID, messageLimit)
+		return
+	}
+	log.Printf("quic large message peer_id=%s", peerID)
+	if err := handler(peerID, io.MultiReader(bytes.NewReader(head), stream)); err != nil {
+		stream.CancelRead(0)
+		log.Printf("quic large message failed peer_id=%s err=%v", peerID, err)
+	}
+	_ = stream.Close()
+}
+
+// SetMessageHandler hands each received message to fn instead of the
+// Messages channel. fn runs on the read loop, so it should not block.
+func (s *ChuteSession) SetMessageHandler(fn func(peerID string, payload []byte)) {
+	s.mu.Lock()
+	s.messageHandler = fn
+	s.mu.Unlock()
+}
+
+// PeerFingerprint identifies the key behind the peer's TLS certificate.
+// It matches the identity fingerprint the peer prints at startup.
+func (s *ChuteSession) PeerFingerprint() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerFingerprint
+}
+
+func (s *ChuteSession) LocalFingerprint() string {
+	return identityFingerprint(s.identity.Public().(ed25519.PublicKey))
 }
 
 func (s *ChuteSession) Listener() *quic.Listener {
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.listener
 }
 
 func (s *ChuteSession) readLoop(conn quic.Connection) {
+	// On channel sessions each stream's name is read on its own
+	// goroutine, so a peer stalling on one name holds up nothing else.
+	// Chat and plain streams come back here through named and are still
+	// handled one at a time.
+	var named chan quic.Stream
+	if connUsesChannels(conn) {
+		named = make(chan quic.Stream)
+		go func() {
+			for {
+				select {
+				case stream := <-named:
+					s.handleStream(conn, stream)
+				case <-conn.Context().Done():
+					return
+				}
+			}
+		}()
+	}
 	for {
 		stream, err := conn.AcceptStream(context.Background())
 		if err != nil {
 			s.handleDisconnect(err)
 			return
 		}
-
-		payload, err := io.ReadAll(stream)
-		_ = stream.Close()
-		if err != nil {
-			log.Printf("quic stream read failed: %v", err)
+		s.touch()
+		if named != nil {
+			go s.routeChannel(conn, stream, named)
 			continue
 		}
+		s.handleStream(conn, stream)
+	}
+}
 
-		s.Mutex.Lock()
-		receiveChan := s.ReceiveChan
-		peerID := s.PeerID
-		s.Mutex.Unlock()
+// handleStream delivers a chat message, or hands a plain stream to the
+// stream handler.
+func (s *ChuteSession) handleStream(conn quic.Connection, stream quic.Stream) {
+	s.mu.Lock()
+	handler := s.streamHandler
+	s.mu.Unlock()
+	if handler != nil {
+		release := s.beginTransfer()
+		handler(stream)
+		release()
+		_ = stream.Close()
+		return
+	}
 
-		log.Printf("quic received peer_id=%s bytes=%d", peerID, len(payload))
-		if receiveChan != nil {
-			select {
-			case receiveChan <- append([]byte(nil), payload...):
-			default:
-			}
+	payload, err := io.ReadAll(io.LimitReader(stream, messageLimit+1))
+	if err != nil {
+		_ = stream.Close()
+		log.Printf("quic stream read failed: %v", err)
+		return
+	}
+	if int64(len(payload)) > messageLimit {
+		s.receiveLarge(stream, payload)
+		return
+	}
+
+	s.mu.Lock()
+	receiveChan := s.receiveChan
+	peerID := s.peerID
+	messageHandler := s.messageHandler
+	s.mu.Unlock()
+
+	log.Printf("quic received peer_id=%s bytes=%d", peerID, len(payload))
+	queued := false
+	if messageHandler != nil {
+		messageHandler(peerID, payload)
+		queued = true
+	} else if receiveChan != nil {
+		// Block rather than drop when the consumer falls behind. Streams
+		// are handled one at a time and stay open until then, so QUIC's
+		// stream limit stalls the sender until there is room again.
+		select {
+		case receiveChan <- payload:
+			queued = true
+		case <-conn.Context().Done():
 		}
 	}
+	// Only ack what the user will actually see.
+	if queued {
+		s.mu.Lock()
+		s.receivedSeq++
+		seq := s.receivedSeq
+		s.mu.Unlock()
+		_ = writeLine(stream, fmt.Sprintf("%s %d", messageAck, seq))
+	}
+	_ = stream.Close()
 }
 
-func (s *ChuteSession) handshakeDial(conn quic.Connection) error {
-	stream, err := conn.OpenStreamSync(context.Background())
+// handshakeDial sends our id and, when the end-to-end layer was
+// negotiated, our key exchange hello right after it; the peer answers
+// with its own hello after accepting. keys is nil without the layer.
+func (s *ChuteSession) handshakeDial(ctx context.Context, conn quic.Connection) (*e2eKeys, error) {
+	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := writeLine(stream, s.LocalID); err != nil {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	} else {
+		_ = stream.SetDeadline(time.Now().Add(handshakeIdle))
+	}
+	if err := writeLine(stream, s.localID); err != nil {
 		_ = stream.Close()
-		return err
+		return nil, err
+	}
+	var exchange *e2eExchange
+	if connUsesE2E(conn) {
+		if exchange, err = newE2EExchange(true); err != nil {
+			_ = stream.Close()
+			return nil, err
+		}
+		if _, err := stream.Write(exchange.hello(s.identity)); err != nil {
+			_ = stream.Close()
+			return nil, err
+		}
 	}
 
 	response, err := readLine(stream)
-	_ = stream.Close()
 	if err != nil {
-		return err
+		_ = stream.Close()
+		return nil, err
 	}
 	if response == "busy" {
-		return errors.New("busy")
+		_ = stream.Close()
+		return nil, ErrBusy
 	}
 	if response != "accept" {
-		return errors.New("handshake failed")
+		_ = stream.Close()
+		return nil, errors.New("handshake failed")
 	}
-	return nil
+	if exchange == nil {
+		_ = stream.Close()
+		return nil, nil
+	}
+	hello, err := readE2EHello(stream)
+	_ = stream.Close()
+	if err != nil {
+		return nil, err
+	}
+	return exchange.finish(hello, connIdentity(conn))
 }
 
-func (s *ChuteSession) handshakeAccept(conn quic.Connection) (string, error) {
-	stream, err := conn.AcceptStream(context.Background())
+func (s *ChuteSession) handshakeAccept(ctx context.Context, conn quic.Connection) (string, *e2eKeys, error) {
+	ctx, cancel := context.WithTimeout(ctx, handshakeIdle)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	defer stream.Close()
+	// The accept context only bounds AcceptStream; a peer that opens the
+	// stream and then stalls must not pin this goroutine.
+	_ = stream.SetDeadline(time.Now().Add(handshakeIdle))
 
 	peerID, err := readLine(stream)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	if peerID == "" {
-		if err := writeLine(stream, "busy"); err != nil {
-			return "", err
+	if err := validateClientID(peerID); err != nil {
+		_ = writeLine(stream, "reject")
+		return "", nil, fmt.Errorf("bad identity: %w", err)
+	}
+	var exchange *e2eExchange
+	var keys *e2eKeys
+	if connUsesE2E(conn) {
+		hello, err := readE2EHello(stream)
+		if err == nil {
+			exchange, err = newE2EExchange(false)
+		}
+		if err == nil {
+			keys, err = exchange.finish(hello, connIdentity(conn))
+		}
+		if err != nil {
+			_ = writeLine(stream, "reject")
+			return "", nil, err
 		}
-		return "", errors.New("missing identity")
 	}
 
 	if err := writeLine(stream, "accept"); err != nil {
-		return "", err
+		return "", nil, err
+	}
+	if exchange != nil {
+		if _, err := stream.Write(exchange.hello(s.identity)); err != nil {
+			return "", nil, err
+		}
+	}
+	return peerID, keys, nil
+}
+
+// Control frames
+func (s *ChuteSession) controlLoop(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptUniStream(conn.Context())
+		if err != nil {
+			return
+		}
+		_ = stream.SetReadDeadline(time.Now().Add(handshakeIdle))
+		frame, err := readLine(stream)
+		if err != nil {
+			stream.CancelRead(0)
+			log.Printf("control frame read failed: %v", err)
+			continue
+		}
+		// Heartbeats are not use of the session.
+		name, token, _ := strings.Cut(frame, " ")
+		if name != controlPing && name != controlPong {
+			s.touch()
+		}
+		// Bench, file and RPC payloads follow their frame on the same stream;
+		// handle them off the loop so other frames are not held up.
+		switch name {
+		case controlBench:
+			go s.drainBench(conn, stream, token)
+			continue
+		case controlFile:
+			go s.receiveFile(conn, stream, token)
+			continue
+		case controlRPC:
+			go s.serveRPC(conn, stream, token)
+			continue
+		case controlRPCReply:
+			go s.readRPCReply(stream, token)
+			continue
+		}
+		s.handleControl(conn, frame)
+	}
+}
+
+func (s *ChuteSession) handleControl(conn quic.Connection, frame string) {
+	name, arg, _ := strings.Cut(frame, " ")
+	switch name {
+	case controlGoodbye:
+		closed, peerID := s.detach(conn)
+		if closed == nil {
+			return
+		}
+		_ = closed.CloseWithError(0, "goodbye")
+		log.Printf("peer disconnected peer_id=%s", peerID)
+		s.runOnClose()
+	case controlVersion:
+		s.mu.Lock()
+		s.peerVersion = arg
+		peerID := s.peerID
+		s.mu.Unlock()
+		if arg != version {
+			log.Printf("peer version differs peer_id=%s local=%s peer=%s", peerID, version, arg)
+		}
+	case controlTyping:
+		s.mu.Lock()
+		s.peerTypingAt = time.Now()
+		s.mu.Unlock()
+	case controlPing:
+		go s.replyPong(conn, arg)
+	case controlPong, controlBenchDone, controlFileDone, controlFileFailed, controlFileRefused:
+		s.wakeWaiter(arg, name)
+	case controlRead:
+		seq, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			log.Printf("bad read receipt %q", frame)
+			return
+		}
+		s.mu.Lock()
+		fn := s.receiptHandler
+		s.mu.Unlock()
+		if fn != nil {
+			fn(seq)
+		}
+	default:
+		log.Printf("unknown control frame %q", frame)
+	}
+}
+
+func (s *ChuteSession) sendGoodbye(conn quic.Connection) {
+	ctx, cancel := context.WithTimeout(context.Background(), goodbyeTimeout)
+	defer cancel()
+
+	if err := writeControl(ctx, conn, controlGoodbye); err != nil {
+		return
+	}
+
+	// The peer closes the connection as soon as it reads the frame; wait
+	// for that so our own close doesn't discard the frame in flight.
+	select {
+	case <-conn.Context().Done():
+	case <-ctx.Done():
+	}
+}
+
+// SendTyping tells the peer the user is typing. Calls closer together
+// than typingInterval are dropped so callers can fire it per keystroke.
+func (s *ChuteSession) SendTyping(ctx context.Context) error {
+	s.mu.Lock()
+	conn := s.conn
+	if !s.connected || conn == nil {
+		s.mu.Unlock()
+		return ErrNoSession
+	}
+	if time.Since(s.sentTypingAt) < typingInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sentTypingAt = time.Now()
+	s.mu.Unlock()
+
+	return writeControl(ctx, conn, controlTyping)
+}
+
+// PeerTyping reports whether a typing frame arrived within typingWindow.
+func (s *ChuteSession) PeerTyping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected && time.Since(s.peerTypingAt) < typingWindow
+}
+
+// markShown records that the next queued message has been shown.
+func (s *ChuteSession) markShown() {
+	s.mu.Lock()
+	if s.shownSeq < s.receivedSeq {
+		s.shownSeq++
+	}
+	s.mu.Unlock()
+}
+
+// SendReadReceipt tells the peer that the messages marked shown on this
+// connection have been read. Messages still queued are not covered.
+func (s *ChuteSession) SendReadReceipt(ctx context.Context) error {
+	s.mu.Lock()
+	conn := s.conn
+	seq := s.shownSeq
+	s.mu.Unlock()
+	if conn == nil {
+		return ErrNoSession
+	}
+	if seq == 0 {
+		return nil
 	}
-	return peerID, nil
+	return writeControl(ctx, conn, fmt.Sprintf("%s %d", controlRead, seq))
+}
+
+// SetReceiptHandler registers fn to receive the peer's read receipts. seq
+// covers every message the peer acknowledged with a number up to seq.
+func (s *ChuteSession) SetReceiptHandler(fn func(seq uint64)) {
+	s.mu.Lock()
+	s.receiptHandler = fn
+	s.mu.Unlock()
 }
 
-func writeLine(stream quic.Stream, value string) error {
+// Waiters
+// addWaiter returns a token to put in a request frame and a channel that
+// receives the name of the reply frame carrying that token.
+func (s *ChuteSession) addWaiter() (string, chan string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waiters == nil {
+		s.waiters = make(map[string]chan string)
+	}
+	s.nextWaiter++
+	token := strconv.FormatUint(s.nextWaiter, 10)
+	done := make(chan string, 1)
+	s.waiters[token] = done
+	return token, done
+}
+
+func (s *ChuteSession) removeWaiter(token string) {
+	s.mu.Lock()
+	delete(s.waiters, token)
+	s.mu.Unlock()
+}
+
+func (s *ChuteSession) wakeWaiter(token, reply string) {
+	s.mu.Lock()
+	done, ok := s.waiters[token]
+	delete(s.waiters, token)
+	s.mu.Unlock()
+	if ok {
+		done <- reply
+	}
+}
+
+// sendVersion announces our build so mismatches show up in both logs.
+// Peers that predate it log an unknown frame and carry on.
+func (s *ChuteSession) sendVersion(conn quic.Connection) {
+	ctx, cancel := context.WithTimeout(conn.Context(), handshakeIdle)
+	defer cancel()
+	if err := writeControl(ctx, conn, controlVersion+" "+version); err != nil {
+		log.Printf("version announce failed err=%v", err)
+	}
+}
+
+// PeerE2E reports whether the session's streams are sealed end to end.
+func (s *ChuteSession) PeerE2E() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerE2E
+}
+
+// PeerVersion is the build the peer announced, or "" if it has not.
+func (s *ChuteSession) PeerVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerVersion
+}
+
+func writeControl(ctx context.Context, conn quic.Connection, frame string) error {
+	stream, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	if err := writeLine(stream, frame); err != nil {
+		_ = stream.Close()
+		return err
+	}
+	return stream.Close()
+}
+
+var (
+	errLineTooLong      = errors.New("line too long")
+	errLineUnterminated = errors.New("line not terminated")
+	errLineInvalid      = errors.New("line contains invalid characters")
+)
+
+func writeLine(stream io.Writer, value string) error {
 	if len(value) > identityLimit {
-		return errors.New("identity too long")
+		return errLineTooLong
+	}
+	if !validLine(value) {
+		return errLineInvalid
 	}
 	_, err := stream.Write([]byte(value + "\n"))
 	return err
 }
 
-func readLine(stream quic.Stream) (string, error) {
-	limited := &io.LimitedReader{R: stream, N: identityLimit + 2}
-	reader := bufio.NewReader(limited)
-	line, err := reader.ReadString('\n')
-	if err != nil && !errors.Is(err, io.EOF) {
-		return "", err
+// readLine reads one newline-terminated line a byte at a time, so nothing
+// after the newline is consumed and a stream that follows its frame with
+// a payload can still be read from the start of the payload.
+func readLine(stream io.Reader) (string, error) {
+	buf := make([]byte, 0, identityLimit+1)
+	one := make([]byte, 1)
+	for {
+		n, err := stream.Read(one)
+		if n == 1 {
+			if one[0] == '\n' {
+				break
+			}
+			if len(buf) == identityLimit+1 {
+				return "", errLineTooLong
+			}
+			buf = append(buf, one[0])
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return "", errLineUnterminated
+		}
+		if err != nil {
+			return "", err
+		}
 	}
-	line = strings.TrimSpace(line)
+	line := strings.TrimSuffix(string(buf), "\r")
 	if len(line) > identityLimit {
-		return "", errors.New("identity too long")
+		return "", errLineTooLong
 	}
-	return line, nil
+	if !validLine(line) {
+		return "", errLineInvalid
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// validLine accepts printable UTF-8 only.
+func validLine(line string) bool {
+	if !utf8.ValidString(line) {
+		return false
+	}
+	for _, r := range line {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
 }
 
 func (s *ChuteSession) monitorConnection(conn quic.Connection) {
@@ -327,16 +1046,18 @@ func (s *ChuteSession) monitorConnection(conn quic.Connection) {
 }
 
 func (s *ChuteSession) handleDisconnect(err error) {
-	s.Mutex.Lock()
-	if !s.Connected {
-		s.Mutex.Unlock()
+	s.mu.Lock()
+	if !s.connected {
+		s.mu.Unlock()
 		return
 	}
 	s.conn = nil
-	s.Connected = false
-	s.PeerID = ""
-	s.Mutex.Unlock()
+	s.connected = false
+	s.peerID = ""
+	s.peerFingerprint = ""
+	s.mu.Unlock()
 
+	defer s.release()
 	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, io.EOF) {
 		log.Printf("session disconnected")
 		s.runOnClose()
@@ -347,60 +1068,105 @@ func (s *ChuteSession) handleDisconnect(err error) {
 }
 
 func quicConfig() *quic.Config {
-	return &quic.Config{
+	config := &quic.Config{
 		MaxIdleTimeout:       sessionIdle,
 		KeepAlivePeriod:      keepAlive,
 		HandshakeIdleTimeout: handshakeIdle,
 	}
+	currentProfile().apply(config)
+	config.Tracer = connectionTracer
+	return config
 }
 
-func serverTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err)
+// Both sides present a certificate for their identity key. Certificates
+// are self-signed, so trust comes from comparing fingerprints rather than
+// chain verification.
+func serverTLSConfig(identity ed25519.PrivateKey) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{identityCertificate(identity)},
+		ClientAuth:   tls.RequireAnyClientCert,
+		NextProtos:   []string{channelProto, e2eProto, nextProto},
 	}
+}
 
+func clientTLSConfig(identity ed25519.PrivateKey) *tls.Config {
+	return &tls.Config{
+		Certificates:       []tls.Certificate{identityCertificate(identity)},
+		InsecureSkipVerify: true,
+		NextProtos:         []string{channelProto, e2eProto, nextProto},
+	}
+}
+
+func identityCertificate(identity ed25519.PrivateKey) tls.Certificate {
 	template := x509.Certificate{
 		SerialNumber: big.NewInt(1),
 		NotBefore:    time.Now().Add(-time.Hour),
 		NotAfter:     time.Now().Add(24 * time.Hour),
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, identity.Public(), identity)
 	if err != nil {
 		panic(err)
 	}
 
-	cert := tls.Certificate{
+	return tls.Certificate{
 		Certificate: [][]byte{certDER},
-		PrivateKey:  key,
+		PrivateKey:  identity,
 	}
+}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{nextProto},
+func connFingerprint(conn quic.Connection) string {
+	certs := conn.ConnectionState().TLS.PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	if pub, ok := certs[0].PublicKey.(ed25519.PublicKey); ok {
+		return identityFingerprint(pub)
 	}
+	sum := sha256.Sum256(certs[0].RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:16])
 }
 
-func clientTLSConfig() *tls.Config {
-	return &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{nextProto},
-	}
+// OnClose registers fn to run once when the session ends, whichever side
+// closes it. Handlers run in registration order.
+func (s *ChuteSession) OnClose(fn func()) {
+	s.mu.Lock()
+	s.onClose = append(s.onClose, fn)
+	s.mu.Unlock()
+}
+
+// SetStreamHandler hands every incoming stream to fn instead of buffering
+// it into Messages. It must be set before the session starts.
+func (s *ChuteSession) SetStreamHandler(fn func(io.Reader)) {
+	s.mu.Lock()
+	s.streamHandler = fn
+	s.mu.Unlock()
+}
+
+// SetPeerVerifier installs a check run after the identity handshake. A
+// non-nil error closes the connection before any data is exchanged.
+func (s *ChuteSession) SetPeerVerifier(fn func(peerID, fingerprint string) error) {
+	s.mu.Lock()
+	s.verifyPeer = fn
+	s.mu.Unlock()
 }
 
-func (s *ChuteSession) SetOnClose(fn func()) {
-	s.Mutex.Lock()
-	s.onClose = fn
-	s.Mutex.Unlock()
+func (s *ChuteSession) verify(peerID, fingerprint string) error {
+	s.mu.Lock()
+	fn := s.verifyPeer
+	s.mu.Unlock()
+	if fn == nil {
+		return nil
+	}
+	return fn(peerID, fingerprint)
 }
 
 func (s *ChuteSession) runOnClose() {
 	s.closeOnce.Do(func() {
-		s.Mutex.Lock()
-		fn := s.onClose
-		s.Mutex.Unlock()
-		if fn != nil {
+		s.mu.Lock()
+		handlers := append([]func(){}, s.onClose...)
+		s.mu.Unlock()
+		for _, fn := range handlers {
 			fn()
 		}
 	})
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+// pipeStream is a quic.Stream over two in-memory pipes. Close shuts both
+// directions, so a writer still blocked on unread input is released.
+type pipeStream struct {
+	quic.Stream
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func (s *pipeStream) Read(p []byte) (int, error)  { return s.r.Read(p) }
+func (s *pipeStream) Write(p []byte) (int, error) { return s.w.Write(p) }
+func (s *pipeStream) SetDeadline(time.Time) error { return nil }
+
+func (s *pipeStream) Close() error {
+	_ = s.r.Close()
+	return s.w.Close()
+}
+
+// pipeConn is a quic.Connection whose only stream is stream, negotiated
+// with proto and presenting peerKey as the peer's certificate key.
+type pipeConn struct {
+	quic.Connection
+	stream  quic.Stream
+	proto   string
+	peerKey ed25519.PublicKey
+}
+
+func (c *pipeConn) AcceptStream(context.Context) (quic.Stream, error) {
+	return c.stream, nil
+}
+
+func (c *pipeConn) ConnectionState() quic.ConnectionState {
+	state := quic.ConnectionState{TLS: tls.ConnectionState{NegotiatedProtocol: c.proto}}
+	if c.peerKey != nil {
+		state.TLS.PeerCertificates = []*x509.Certificate{{PublicKey: c.peerKey}}
+	}
+	return state
+}
+
+// fuzzPeerKey is the dialer identity the handshake fuzz target presents.
+var fuzzPeerKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+func FuzzReadLine(f *testing.F) {
+	f.Add([]byte("alice\n"))
+	f.Add([]byte("alice\r\n"))
+	f.Add([]byte("rpc 7 files.list\n{\"path\":\"/\"}"))
+	f.Add([]byte("file 3\n\x00\x10{}"))
+	f.Add([]byte(strings.Repeat("a", identityLimit) + "\n"))
+	f.Add([]byte(strings.Repeat("a", 4*identityLimit) + "\n"))
+	f.Add([]byte("alice"))
+	f.Add([]byte("\x00\xff\xfe\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		line, err := readLine(r)
+
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			if err == nil {
+				t.Fatalf("unterminated input %q read as %q", data, line)
+			}
+			return
+		}
+		raw := strings.TrimSuffix(string(data[:end]), "\r")
+		if len(raw) > identityLimit || !validLine(raw) {
+			if err == nil {
+				t.Fatalf("bad line %q read as %q", raw, line)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("valid line %q: %v", raw, err)
+		}
+		if line != strings.TrimSpace(raw) {
+			t.Fatalf("read %q, want %q", line, strings.TrimSpace(raw))
+		}
+		// Nothing past the newline may be consumed.
+		rest, _ := io.ReadAll(r)
+		if !bytes.Equal(rest, data[end+1:]) {
+			t.Fatalf("consumed past the newline: left %q, want %q", rest, data[end+1:])
+		}
+	})
+}
+
+func FuzzHandshakeAccept(f *testing.F) {
+	exchange, err := newE2EExchange(true)
+	if err != nil {
+		f.Fatal(err)
+	}
+	hello := exchange.hello(fuzzPeerKey)
+
+	f.Add([]byte("alice\n"), false)
+	f.Add(append([]byte("alice\n"), hello...), true)
+	f.Add(append([]byte("alice\n"), hello[:10]...), true)
+	f.Add([]byte("alice"), false)
+	f.Add([]byte("bad/id\n"), false)
+	f.Add([]byte(strings.Repeat("a", 4*identityLimit)+"\n"), false)
+	f.Add([]byte("\x00\x01\x02\n"), true)
+	f.Fuzz(func(t *testing.T, data []byte, e2e bool) {
+		s := newTransportSession(nil, "local", nil)
+		conn := &pipeConn{proto: nextProto}
+		if e2e {
+			conn.proto = e2eProto
+			conn.peerKey = fuzzPeerKey.Public().(ed25519.PublicKey)
+		}
+
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		conn.stream = &pipeStream{r: inR, w: outW}
+		go func() {
+			_, _ = inW.Write(data)
+			_ = inW.Close()
+		}()
+		go func() { _, _ = io.Copy(io.Discard, outR) }()
+
+		type result struct {
+			peerID string
+			keys   *e2eKeys
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			peerID, keys, err := s.handshakeAccept(context.Background(), conn)
+			done <- result{peerID, keys, err}
+		}()
+		var res result
+		select {
+		case res = <-done:
+		case <-time.After(handshakeIdle):
+			t.Fatalf("handshake on %q did not return", data)
+		}
+
+		if bytes.IndexByte(data, '\n') < 0 && res.err == nil {
+			t.Fatalf("unterminated input %q accepted", data)
+		}
+		if res.err != nil {
+			return
+		}
+		if err := validateClientID(res.peerID); err != nil {
+			t.Fatalf("accepted bad id %q: %v", res.peerID, err)
+		}
+		if e2e != (res.keys != nil) {
+			t.Fatalf("e2e=%t but keys=%v", e2e, res.keys)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const settingsFile = "settings.json"
+
+// Settings are the user preferences persisted in the config dir. Flags
+// given on the command line and CHUTE_STUN_SERVER take precedence; empty
+// fields use the built-in defaults.
+type Settings struct {
+	Server           string   `json:"server,omitempty"`
+	STUNServers      []string `json:"stun_servers,omitempty"`
+	DownloadDir      string   `json:"download_dir,omitempty"`
+	AutoAcceptFrom   []string `json:"auto_accept_from,omitempty"`
+	Performance      string   `json:"performance,omitempty"`
+	EncryptDownloads bool     `json:"encrypt_downloads,omitempty"`
+	Proxy            string   `json:"proxy,omitempty"`
+	LANOnly          bool     `json:"lan_only,omitempty"`
+	IdlePolicy       string   `json:"idle_policy,omitempty"`
+	Verbose          []string `json:"verbose,omitempty"`
+	Directory        bool     `json:"directory,omitempty"`
+
+	// LegacyProfile is Performance as saved before -profile came to name
+	// identities. loadSettings moves it over.
+	LegacyProfile string `json:"profile,omitempty"`
+	// LegacyShareDir is the single shared folder from before named
+	// shares. migrateShareDir turns it into a share.
+	LegacyShareDir string `json:"share_dir,omitempty"`
+}
+
+// Storage
+func loadSettings(dir string) (Settings, error) {
+	var settings Settings
+	path := filepath.Join(dir, settingsFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if settings.Performance == "" {
+		settings.Performance = settings.LegacyProfile
+	}
+	settings.LegacyProfile = ""
+	return settings, nil
+}
+
+func saveSettings(dir string, settings Settings) error {
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, settingsFile), append(data, '\n'), 0o600)
+}
+
+// Editing
+
+// settingKeys lists the names accepted by set, in display order.
+var settingKeys = []string{"server", "stun", "download-dir", "auto-accept", "performance", "encrypt-downloads", "proxy", "lan", "idle-policy", "verbose", "directory"}
+
+// set updates one setting from its text form. List settings take a
+// comma-separated value; an empty value clears the setting.
+func (s *Settings) set(key, value string) error {
+	switch key {
+	case "server":
+		s.Server = value
+	case "stun":
+		s.STUNServers = splitServers(value)
+	case "download-dir":
+		s.DownloadDir = value
+	case "auto-accept":
+		ids := splitServers(value)
+		for _, id := range ids {
+			if err := validateClientID(id); err != nil {
+				return fmt.Errorf("auto-accept %q: %w", id, err)
+			}
+		}
+		s.AutoAcceptFrom = ids
+	case "performance":
+		if value != "" {
+			if err := validateProfile(value); err != nil {
+				return err
+			}
+		}
+		s.Performance = value
+	case "encrypt-downloads":
+		on := false
+		if value != "" {
+			var err error
+			if on, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("encrypt-downloads: want true or false")
+			}
+		}
+		s.EncryptDownloads = on
+	case "proxy":
+		if value != "" {
+			if _, err := parseProxyURL(value); err != nil {
+				return err
+			}
+		}
+		s.Proxy = value
+	case "lan":
+		on := false
+		if value != "" {
+			var err error
+			if on, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("lan: want true or false")
+			}
+		}
+		s.LANOnly = on
+	case "idle-policy":
+		if value != "" {
+			if err := validateIdlePolicy(value); err != nil {
+				return err
+			}
+		}
+		s.IdlePolicy = value
+	case "verbose":
+		names := splitServers(value)
+		for _, name := range names {
+			if name != "all" && !isLogSubsystem(name) {
+				return fmt.Errorf("unknown log subsystem %q (want all or one of %s)", name, strings.Join(logSubsystems, ", "))
+			}
+		}
+		s.Verbose = names
+	case "directory":
+		on := false
+		if value != "" {
+			var err error
+			if on, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("directory: want true or false")
+			}
+		}
+		s.Directory = on
+	case "profile":
+		return errors.New("the profile setting is now called performance")
+	case "share-dir":
+		return errors.New("share-dir was replaced by named shares, see share add")
+	default:
+		return fmt.Errorf("unknown setting %q (want one of %s)", key, strings.Join(settingKeys, ", "))
+	}
+	return nil
+}
+
+func (s Settings) get(key string) string {
+	switch key {
+	case "server":
+		return s.Server
+	case "stun":
+		return strings.Join(s.STUNServers, ",")
+	case "download-dir":
+		return s.DownloadDir
+	case "auto-accept":
+		return strings.Join(s.AutoAcceptFrom, ",")
+	case "performance":
+		return s.Performance
+	case "encrypt-downloads":
+		return strconv.FormatBool(s.EncryptDownloads)
+	case "proxy":
+		return s.Proxy
+	case "lan":
+		return strconv.FormatBool(s.LANOnly)
+	case "idle-policy":
+		return s.IdlePolicy
+	case "verbose":
+		return strings.Join(s.Verbose, ",")
+	case "directory":
+		return strconv.FormatBool(s.Directory)
+	}
+	return ""
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	sharesFile = "shares.json"
+
+	// legacyShareName is the share an old share-dir setting becomes.
+	legacyShareName = "shared"
+)
+
+// Share is a folder exposed read-only to the peers granted access.
+type Share struct {
+	Name   string       `json:"name"`
+	Path   string       `json:"path"`
+	Grants []ShareGrant `json:"grants,omitempty"`
+}
+
+// ShareGrant gives one peer identity access to a share. The id is kept
+// for display; access is checked against the fingerprint.
+type ShareGrant struct {
+	PeerID      string `json:"peer_id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (s Share) grants(fingerprint string) bool {
+	for _, g := range s.Grants {
+		if g.Fingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+var errNoShare = errors.New("no such share")
+
+// Shared folders
+//
+// Each share maps a name to a local folder and lists the identities that
+// may browse it and pull from it; a share nobody was granted is exposed to
+// nobody. Grants name the fingerprint pinned for the peer at the time, so
+// a peer id that comes back with another key loses access, like per-peer
+// settings. Peers address files as "<share>/<path>" and see only the
+// shares granted to them. Shares are read-only: there is no call that
+// writes to them. Every browse and pull is checked against the grants
+// and logged with the outcome.
+type shareStore struct {
+	path string
+
+	mu     sync.Mutex
+	shares map[string]Share
+}
+
+// Storage
+func loadShareStore(dir string) (*shareStore, error) {
+	store := &shareStore{
+		path:   filepath.Join(dir, sharesFile),
+		shares: make(map[string]Share),
+	}
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.shares); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", store.path, err)
+	}
+	return store, nil
+}
+
+func (s *shareStore) saveLocked() error {
+	data, err := json.MarshalIndent(s.shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0o600)
+}
+
+// list returns every share sorted by name.
+func (s *shareStore) list() []Share {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shares := make([]Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Name < shares[j].Name })
+	return shares
+}
+
+func (s *shareStore) get(name string) (Share, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share, ok := s.shares[name]
+	return share, ok
+}
+
+// change applies fn to the share name and saves the store, keeping the
+// old state if saving fails.
+func (s *shareStore) change(name string, fn func(share *Share, exists bool) error) (Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, had := s.shares[name]
+	share := previous
+	share.Grants = append([]ShareGrant(nil), previous.Grants...)
+	if err := fn(&share, had); err != nil {
+		return previous, err
+	}
+	s.shares[name] = share
+	if err := s.saveLocked(); err != nil {
+		if had {
+			s.shares[name] = previous
+		} else {
+			delete(s.shares, name)
+		}
+		return previous, err
+	}
+	return share, nil
+}
+
+func (s *shareStore) remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.shares[name]
+	if !ok {
+		return errNoShare
+	}
+	delete(s.shares, name)
+	if err := s.saveLocked(); err != nil {
+		s.shares[name] = previous
+		return err
+	}
+	return nil
+}
+
+// migrateShareDir turns the share-dir setting from before named shares
+// into the share legacyShareName, granted to every pinned peer whose old
+// per-peer pull setting was on, so upgrading keeps what was shared and
+// with whom.
+func migrateShareDir(dir, shareDir string, shares *shareStore, pins *pinStore) error {
+	abs, err := filepath.Abs(shareDir)
+	if err != nil {
+		return err
+	}
+	// allow_pull is no longer part of PeerSettings, so it is read from
+	// the file directly.
+	var legacy map[string]struct {
+		AllowPull *bool `json:"allow_pull"`
+	}
+	data, err := os.ReadFile(filepath.Join(dir, peerSettingsFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return err
+		}
+	}
+	ids := make(map[string]string)
+	for id, fingerprint := range pins.list() {
+		ids[fingerprint] = id
+	}
+	var grants []ShareGrant
+	for fingerprint, settings := range legacy {
+		id, pinned := ids[fingerprint]
+		if pinned && settings.AllowPull != nil && *settings.AllowPull {
+			grants = append(grants, ShareGrant{PeerID: id, Fingerprint: fingerprint})
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].PeerID < grants[j].PeerID })
+
+	_, err = shares.change(legacyShareName, func(share *Share, exists bool) error {
+		if exists {
+			return fmt.Errorf("share %q already exists", legacyShareName)
+		}
+		share.Name = legacyShareName
+		share.Path = abs
+		share.Grants = grants
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("share-dir migrated name=%s path=%q grants=%d", legacyShareName, abs, len(grants))
+	return nil
+}
+
+// Client
+
+// Shares lists the shared folders and who may access them.
+func (c *Client) Shares() []Share {
+	if c.shares == nil {
+		return nil
+	}
+	return c.shares.list()
+}
+
+// AddShare shares the folder at path as name, or moves an existing share
+// to path and keeps its grants.
+func (c *Client) AddShare(name, path string) (Share, error) {
+	if c.shares == nil {
+		return Share{}, errors.New("shares are not available")
+	}
+	if err := validateShareName(name); err != nil {
+		return Share{}, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return Share{}, err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return Share{}, err
+	}
+	if !info.IsDir() {
+		return Share{}, fmt.Errorf("%s is not a directory", abs)
+	}
+	share, err := c.shares.change(name, func(share *Share, _ bool) error {
+		share.Name = name
+		share.Path = abs
+		return nil
+	})
+	if err != nil {
+		return share, err
+	}
+	log.Printf("share added name=%s path=%q", name, abs)
+	return share, nil
+}
+
+// RemoveShare stops sharing name.
+func (c *Client) RemoveShare(name string) error {
+	if c.shares == nil {
+		return errNoShare
+	}
+	if err := c.shares.remove(name); err != nil {
+		return err
+	}
+	log.Printf("share removed name=%s", name)
+	return nil
+}
+
+// GrantShare lets peerID browse and pull from name. The peer has to be
+// pinned, since access follows its fingerprint.
+func (c *Client) GrantShare(name, peerID string) (Share, error) {
+	if c.shares == nil {
+		return Share{}, errNoShare
+	}
+	fingerprint, err := c.pinnedFingerprint(peerID)
+	if err != nil {
+		return Share{}, err
+	}
+	share, err := c.shares.change(name, func(share *Share, exists bool) error {
+		if !exists {
+			return errNoShare
+		}
+		kept := share.Grants[:0]
+		for _, g := range share.Grants {
+			if g.PeerID != peerID {
+				kept = append(kept, g)
+			}
+		}
+		share.Grants = append(kept, ShareGrant{PeerID: peerID, Fingerprint: fingerprint})
+		return nil
+	})
+	if err != nil {
+		return share, err
+	}
+	log.Printf("share granted name=%s peer_id=%s", name, peerID)
+	return share, nil
+}
+
+// RevokeShare takes away peerID's access to name.
+func (c *Client) RevokeShare(name, peerID string) (Share, error) {
+	if c.shares == nil {
+		return Share{}, errNoShare
+	}
+	share, err := c.shares.change(name, func(share *Share, exists bool) error {
+		if !exists {
+			return errNoShare
+		}
+		kept := share.Grants[:0]
+		for _, g := range share.Grants {
+			if g.PeerID != peerID {
+				kept = append(kept, g)
+			}
+		}
+		if len(kept) == len(share.Grants) {
+			return fmt.Errorf("%s has no access to %s", peerID, name)
+		}
+		share.Grants = kept
+		return nil
+	})
+	if err != nil {
+		return share, err
+	}
+	log.Printf("share revoked name=%s peer_id=%s", name, peerID)
+	return share, nil
+}
+
+// SetShareStore enables shared folders.
+func (c *Client) SetShareStore(store *shareStore) {
+	c.shares = store
+}
+
+// sharesFor lists the shares peerID has been granted.
+func (c *Client) sharesFor(peerID string) []Share {
+	if c.shares == nil {
+		return nil
+	}
+	fingerprint, err := c.pinnedFingerprint(peerID)
+	if err != nil {
+		return nil
+	}
+	var granted []Share
+	for _, share := range c.shares.list() {
+		if share.grants(fingerprint) {
+			granted = append(granted, share)
+		}
+	}
+	return granted
+}
+
+// Helpers
+func validateShareName(name string) error {
+	if name == "" || len(name) > identityLimit || strings.ContainsAny(name, `/\ `) || name == "." || name == ".." || !validLine(name) {
+		return fmt.Errorf("invalid share name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// shareClient is a client with alice and bob pinned and root shared as
+// "docs" to alice only.
+func shareClient(t *testing.T, root string) *Client {
+	t.Helper()
+	dir := t.TempDir()
+	pins, err := loadPinStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, fingerprint := range map[string]string{"alice": "fp-a", "bob": "fp-b"} {
+		if err := pins.verify(id, fingerprint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peerSettings, err := loadPeerSettingsStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := loadShareStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient("me", "")
+	c.SetPinStore(pins)
+	c.SetPeerSettingsStore(peerSettings)
+	c.SetShareStore(shares)
+	if _, err := c.AddShare("docs", root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GrantShare("docs", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func pullPath(p string) json.RawMessage {
+	data, _ := json.Marshal(pullParams{Path: p})
+	return data
+}
+
+func TestResolvePullGrants(t *testing.T) {
+	root, _ := sharedTree(t)
+	c := shareClient(t, root)
+	tests := []struct {
+		peerID string
+		path   string
+		want   string
+	}{
+		{"alice", "docs/a.txt", filepath.Join(root, "a.txt")},
+		{"alice", "/docs/sub/../a.txt", filepath.Join(root, "a.txt")},
+		{"alice", "docs", root},
+		{"bob", "docs/a.txt", ""},
+		{"bob", "docs", ""},
+		{"carol", "docs/a.txt", ""},
+		{"alice", "other/a.txt", ""},
+		{"alice", "docs/../docs/../outside/secret", ""},
+		{"alice", "docs/link-out/secret", ""},
+		{"alice", "docs/.env", ""},
+		{"alice", "docs/sub/.git/config", ""},
+	}
+	for _, tt := range tests {
+		_, got, err := c.resolvePull(tt.peerID, "pull", pullPath(tt.path))
+		if tt.want == "" {
+			if !errors.Is(err, errSharedNotFound) {
+				t.Errorf("%s %q: resolved %q, %v; want errSharedNotFound", tt.peerID, tt.path, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s %q: resolved %q, %v; want %q", tt.peerID, tt.path, got, err, tt.want)
+		}
+	}
+
+	// The root lists only the shares granted to the caller.
+	for peerID, want := range map[string]int{"alice": 1, "bob": 0, "carol": 0} {
+		if got := len(c.sharesFor(peerID)); got != want {
+			t.Errorf("%s sees %d shares, want %d", peerID, got, want)
+		}
+	}
+}
+
+func TestShareGrantFollowsIdentity(t *testing.T) {
+	root, _ := sharedTree(t)
+	c := shareClient(t, root)
+	allowed := func() bool {
+		_, _, err := c.resolvePull("alice", "list", pullPath("docs"))
+		return err == nil
+	}
+	if !allowed() {
+		t.Fatal("alice denied before any change")
+	}
+
+	// alice coming back with another key does not inherit the grant.
+	if _, err := c.pins.forget("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.pins.verify("alice", "fp-new"); err != nil {
+		t.Fatal(err)
+	}
+	if allowed() {
+		t.Fatal("grant followed the id to a new key")
+	}
+	if _, err := c.GrantShare("docs", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !allowed() {
+		t.Fatal("alice denied after a new grant")
+	}
+
+	if _, err := c.RevokeShare("docs", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if allowed() {
+		t.Fatal("alice allowed after revoke")
+	}
+	if _, err := c.RevokeShare("docs", "alice"); err == nil {
+		t.Fatal("revoked alice twice")
+	}
+	if _, err := c.GrantShare("missing", "alice"); !errors.Is(err, errNoShare) {
+		t.Fatalf("grant on a missing share: %v", err)
+	}
+	if _, err := c.GrantShare("docs", "carol"); err == nil {
+		t.Fatal("granted an unpinned peer")
+	}
+}
+
+func TestValidateShareName(t *testing.T) {
+	for _, name := range []string{"docs", "photos-2024", "a.b", "日本"} {
+		if err := validateShareName(name); err != nil {
+			t.Errorf("validateShareName(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "a/b", `a\b`, "a b", "a\nb"} {
+		if err := validateShareName(name); err == nil {
+			t.Errorf("validateShareName(%q) accepted", name)
+		}
+	}
+}
+
+func TestMigrateShareDir(t *testing.T) {
+	root, _ := sharedTree(t)
+	dir := t.TempDir()
+	pins, err := loadPinStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, fingerprint := range map[string]string{"alice": "fp-a", "bob": "fp-b"} {
+		if err := pins.verify(id, fingerprint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy := `{"fp-a": {"allow_pull": true}, "fp-b": {"allow_pull": false}, "fp-gone": {"allow_pull": true}}`
+	if err := os.WriteFile(filepath.Join(dir, peerSettingsFile), []byte(legacy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	shares, err := loadShareStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateShareDir(dir, root, shares, pins); err != nil {
+		t.Fatal(err)
+	}
+	share, ok := shares.get(legacyShareName)
+	if !ok || share.Path != root {
+		t.Fatalf("migrated share = %+v, ok=%t", share, ok)
+	}
+	if len(share.Grants) != 1 || share.Grants[0] != (ShareGrant{PeerID: "alice", Fingerprint: "fp-a"}) {
+		t.Fatalf("migrated grants = %+v, want alice only", share.Grants)
+	}
+	if err := migrateShareDir(dir, root, shares, pins); err == nil {
+		t.Fatal("migrated over an existing share")
+	}
+}
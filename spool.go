@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	spoolFile  = "inbox.jsonl"
+	spoolLimit = 1000
+)
+
+// ReceivedMessage is one message kept in the receive spool. Seq increases
+// by one per message and survives restarts, so readers can resume from
+// the last Seq they saw.
+type ReceivedMessage struct {
+	Seq    uint64    `json:"seq"`
+	PeerID string    `json:"peer_id"`
+	Time   time.Time `json:"time"`
+	Text   string    `json:"text"`
+}
+
+// messageSpool keeps the most recent spoolLimit messages in memory and
+// appends every message to inbox.jsonl. The file is rewritten down to
+// the in-memory window once it grows to twice that, so readers that fall
+// further behind than spoolLimit see a gap in Seq rather than an
+// unbounded file.
+type messageSpool struct {
+	path string
+
+	mu       sync.Mutex
+	messages []ReceivedMessage
+	lines    int
+	notify   chan struct{}
+}
+
+// Storage
+
+// loadMessageSpool reads inbox.jsonl. Lines that do not parse are skipped
+// with a log line, and the spool is returned even with an error, holding
+// whatever was read before it.
+func loadMessageSpool(dir string) (*messageSpool, error) {
+	spool := &messageSpool{
+		path:   filepath.Join(dir, spoolFile),
+		notify: make(chan struct{}),
+	}
+	file, err := os.Open(spool.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return spool, nil
+	}
+	if err != nil {
+		return spool, err
+	}
+	defer file.Close()
+
+	// Lines are read without a length cap: escaping can make a stored
+	// message several times longer than messageLimit.
+	r := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var msg ReceivedMessage
+			if jsonErr := json.Unmarshal(line, &msg); jsonErr != nil {
+				// A torn last line from a crash lands here too.
+				log.Printf("inbox line %d skipped: %v", n, jsonErr)
+			} else {
+				spool.lines++
+				spool.messages = append(spool.messages, msg)
+				if len(spool.messages) > spoolLimit {
+					spool.messages = spool.messages[1:]
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return spool, nil
+		}
+		if err != nil {
+			return spool, err
+		}
+	}
+}
+
+func (s *messageSpool) appendLocked(msg ReceivedMessage) error {
+	if s.lines >= 2*spoolLimit {
+		return s.rewriteLocked()
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	s.lines++
+	return nil
+}
+
+// rewriteLocked replaces the file with the in-memory window.
+func (s *messageSpool) rewriteLocked() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for _, msg := range s.messages {
+		if err := enc.Encode(msg); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.lines = len(s.messages)
+	return nil
+}
+
+// Spooling
+
+// add stores a message and wakes any waiting readers. The message is kept
+// in memory even if writing it to disk fails.
+func (s *messageSpool) add(peerID string, payload []byte) (ReceivedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := ReceivedMessage{
+		Seq:    s.lastSeqLocked() + 1,
+		PeerID: peerID,
+		Time:   time.Now().UTC(),
+		Text:   string(payload),
+	}
+	s.messages = append(s.messages, msg)
+	if len(s.messages) > spoolLimit {
+		s.messages = s.messages[1:]
+	}
+	err := s.appendLocked(msg)
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return msg, err
+}
+
+// after returns up to limit messages with Seq greater than seq, oldest
+// first, and a channel that is closed when the next message arrives.
+func (s *messageSpool) after(seq uint64, limit int) ([]ReceivedMessage, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []ReceivedMessage
+	for _, msg := range s.messages {
+		if msg.Seq <= seq {
+			continue
+		}
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		out = append(out, msg)
+	}
+	return out, s.notify
+}
+
+func (s *messageSpool) lastSeq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSeqLocked()
+}
+
+func (s *messageSpool) lastSeqLocked() uint64 {
+	if len(s.messages) == 0 {
+		return 0
+	}
+	return s.messages[len(s.messages)-1].Seq
+}
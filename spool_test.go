@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadMessageSpoolSkipsBadLines(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := loadMessageSpool(dir)
+	if err != nil {
+		t.Fatalf("load empty: %v", err)
+	}
+	// Control characters escape to six bytes each, far past messageLimit.
+	long := strings.Repeat("\x01", int(messageLimit))
+	if _, err := spool.add("alice", []byte(long)); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, spoolFile), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString("not json\n")
+	_ = file.Close()
+	if _, err := spool.add("bob", []byte("hi")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	loaded, err := loadMessageSpool(dir)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	got, _ := loaded.after(0, 0)
+	if len(got) != 2 || got[0].Text != long || got[1].Text != "hi" || got[1].Seq != 2 {
+		t.Fatalf("loaded %d messages, want the long one and %q", len(got), "hi")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingSuccess  = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunAttrMapped      = 0x0001
+	stunAttrXorMapped   = 0x0020
+	stunHeaderSize      = 20
+	stunProbeTimeout    = 3 * time.Second
+	stunProbeBufferSize = 1500
+)
+
+// STUNResult is the outcome of probing one STUN server.
+type STUNResult struct {
+	Server string
+	Mapped string
+	RTT    time.Duration
+	Err    error
+}
+
+// Probing
+func probeSTUNServers(ctx context.Context, servers []string) []STUNResult {
+	results := make([]STUNResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			mapped, rtt, err := probeSTUN(ctx, server)
+			results[i] = STUNResult{Server: server, Mapped: mapped, RTT: rtt, Err: err}
+		}(i, server)
+	}
+	wg.Wait()
+	return results
+}
+
+// probeSTUN sends one RFC 5389 binding request and returns the public
+// address the server saw.
+func probeSTUN(ctx context.Context, server string) (string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, stunProbeTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp4", server)
+	if err != nil {
+		return "", 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var txID [12]byte
+	if _, err := rand.Read(txID[:]); err != nil {
+		return "", 0, err
+	}
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:8], stunMagicCookie)
+	copy(request[8:20], txID[:])
+
+	start := time.Now()
+	if _, err := conn.Write(request); err != nil {
+		return "", 0, err
+	}
+	buf := make([]byte, stunProbeBufferSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return "", 0, err
+		}
+		mapped, err := parseSTUNResponse(buf[:n], txID)
+		if err != nil {
+			continue
+		}
+		return mapped, time.Since(start), nil
+	}
+}
+
+func parseSTUNResponse(msg []byte, txID [12]byte) (string, error) {
+	if len(msg) < stunHeaderSize {
+		return "", errors.New("short stun message")
+	}
+	if binary.BigEndian.Uint16(msg[0:2]) != stunBindingSuccess {
+		return "", errors.New("not a binding success")
+	}
+	if binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie || !bytes.Equal(msg[8:20], txID[:]) {
+		return "", errors.New("transaction mismatch")
+	}
+
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	attrs := msg[stunHeaderSize:]
+	if length < len(attrs) {
+		attrs = attrs[:length]
+	}
+	var fallback string
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunAttrXorMapped:
+			if addr, ok := decodeSTUNAddress(value, true); ok {
+				return addr, nil
+			}
+		case stunAttrMapped:
+			if addr, ok := decodeSTUNAddress(value, false); ok {
+				fallback = addr
+			}
+		}
+		// Attributes are padded to a multiple of four bytes.
+		next := 4 + (attrLen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if fallback != "" {
+		return fallback, nil
+	}
+	return "", errors.New("no mapped address")
+}
+
+func decodeSTUNAddress(value []byte, xored bool) (string, bool) {
+	// Only IPv4 (family 0x01) is gathered, matching the ICE agent config.
+	if len(value) < 8 || value[1] != 0x01 {
+		return "", false
+	}
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := net.IP(append([]byte(nil), value[4:8]...))
+	if xored {
+		port ^= stunMagicCookie >> 16
+		var cookie [4]byte
+		binary.BigEndian.PutUint32(cookie[:], stunMagicCookie)
+		for i := range ip {
+			ip[i] ^= cookie[i]
+		}
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprintf("%d", port)), true
+}
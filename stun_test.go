@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+var stunTestTxID = [12]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+// stunAttr encodes one attribute, padded to four bytes.
+func stunAttr(attrType uint16, value []byte) []byte {
+	attr := binary.BigEndian.AppendUint16(nil, attrType)
+	attr = binary.BigEndian.AppendUint16(attr, uint16(len(value)))
+	attr = append(attr, value...)
+	for len(attr)%4 != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+// stunAddr is an address attribute value, XORed with the magic cookie
+// when xored is set.
+func stunAddr(family byte, ip string, port uint16, xored bool) []byte {
+	addr := net.ParseIP(ip).To4()
+	if family != 0x01 {
+		addr = net.ParseIP(ip).To16()
+	}
+	addr = append([]byte(nil), addr...)
+	if xored {
+		port ^= stunMagicCookie >> 16
+		cookie := binary.BigEndian.AppendUint32(nil, stunMagicCookie)
+		for i := range 4 {
+			addr[i] ^= cookie[i]
+		}
+	}
+	value := []byte{0, family}
+	value = binary.BigEndian.AppendUint16(value, port)
+	return append(value, addr...)
+}
+
+func stunMessage(msgType uint16, txID [12]byte, attrs ...[]byte) []byte {
+	var body []byte
+	for _, attr := range attrs {
+		body = append(body, attr...)
+	}
+	msg := binary.BigEndian.AppendUint16(nil, msgType)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(body)))
+	msg = binary.BigEndian.AppendUint32(msg, stunMagicCookie)
+	msg = append(msg, txID[:]...)
+	return append(msg, body...)
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	xorMapped := stunAttr(stunAttrXorMapped, stunAddr(0x01, "203.0.113.5", 54321, true))
+	mapped := stunAttr(stunAttrMapped, stunAddr(0x01, "198.51.100.7", 3478, false))
+	ipv6 := stunAttr(stunAttrXorMapped, stunAddr(0x02, "2001:db8::1", 1000, true))
+	software := stunAttr(0x8022, []byte("odd"))
+
+	// The header claims less than is there: the rest is ignored.
+	cut := stunMessage(stunBindingSuccess, stunTestTxID, mapped, xorMapped)
+	binary.BigEndian.PutUint16(cut[2:4], uint16(len(mapped)))
+
+	// An attribute running past the end stops the parse.
+	overlong := stunAttr(stunAttrXorMapped, stunAddr(0x01, "203.0.113.5", 54321, true))
+	binary.BigEndian.PutUint16(overlong[2:4], 200)
+
+	otherTx := stunTestTxID
+	otherTx[0] ^= 1
+	badCookie := stunMessage(stunBindingSuccess, stunTestTxID, xorMapped)
+	badCookie[4] ^= 1
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want string
+	}{
+		{"xor mapped", stunMessage(stunBindingSuccess, stunTestTxID, xorMapped), "203.0.113.5:54321"},
+		{"mapped only", stunMessage(stunBindingSuccess, stunTestTxID, mapped), "198.51.100.7:3478"},
+		{"xor preferred", stunMessage(stunBindingSuccess, stunTestTxID, mapped, xorMapped), "203.0.113.5:54321"},
+		{"padded attribute first", stunMessage(stunBindingSuccess, stunTestTxID, software, xorMapped), "203.0.113.5:54321"},
+		{"ipv6 skipped", stunMessage(stunBindingSuccess, stunTestTxID, ipv6, mapped), "198.51.100.7:3478"},
+		{"length cut", cut, "198.51.100.7:3478"},
+		{"ipv6 only", stunMessage(stunBindingSuccess, stunTestTxID, ipv6), ""},
+		{"no attributes", stunMessage(stunBindingSuccess, stunTestTxID), ""},
+		{"overlong attribute", stunMessage(stunBindingSuccess, stunTestTxID, overlong), ""},
+		{"short value", stunMessage(stunBindingSuccess, stunTestTxID, stunAttr(stunAttrXorMapped, []byte{0, 1, 0})), ""},
+		{"other transaction", stunMessage(stunBindingSuccess, otherTx, xorMapped), ""},
+		{"bad cookie", badCookie, ""},
+		{"not a success", stunMessage(0x0111, stunTestTxID, xorMapped), ""},
+		{"short header", stunMessage(stunBindingSuccess, stunTestTxID)[:stunHeaderSize-1], ""},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := parseSTUNResponse(tt.msg, stunTestTxID)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: parsed %q", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
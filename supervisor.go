@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	loopRestartBackoff = time.Second
+	loopMaxBackoff     = time.Minute
+	// loopHealthyRun is how long a loop must run before a failure counts
+	// as new rather than as another in a row.
+	loopHealthyRun = time.Minute
+	// loopStopTimeout bounds how long shutdown waits for loops to return.
+	loopStopTimeout = 5 * time.Second
+)
+
+// LoopHealth describes one supervised loop for status.
+type LoopHealth struct {
+	Name        string    `json:"name"`
+	Running     bool      `json:"running"`
+	Restarts    int       `json:"restarts"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+}
+
+// loops tracks every supervised loop of the process.
+var loops = &supervisor{loops: make(map[string]*LoopHealth)}
+
+// Supervision
+//
+// Long-running loops run under supervise. A loop that returns nil, or
+// whose context is done, has finished. One that panics or returns an
+// error is restarted after a backoff that grows while it keeps failing,
+// so a persistent error no longer spins the CPU or silently stops the
+// loop. Loops are listed in status while they run, and shutdown waits
+// for them to return.
+type supervisor struct {
+	mu    sync.Mutex
+	loops map[string]*LoopHealth
+	wg    sync.WaitGroup
+}
+
+// supervise starts fn in its own goroutine and keeps it running until it
+// finishes, restarting it after failures. Names must be unique among
+// running loops.
+func supervise(ctx context.Context, name string, fn func(context.Context) error) {
+	loops.start(name)
+	go func() {
+		defer loops.stop(name)
+		superviseLoop(ctx, name, fn)
+	}()
+}
+
+func superviseLoop(ctx context.Context, name string, fn func(context.Context) error) {
+	attempt := 0
+	for {
+		started := time.Now()
+		err := runRecovered(ctx, name, fn)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > loopHealthyRun {
+			attempt = 0
+		}
+		attempt++
+		delay := retryDelay(attempt, loopRestartBackoff, loopMaxBackoff)
+		log.Printf("loop failed, restarting name=%s attempt=%d delay=%s err=%v", name, attempt, delay.Round(time.Millisecond), err)
+		loops.failed(name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		loops.restarted(name)
+	}
+}
+
+// runRecovered turns a panic in fn into an error.
+func runRecovered(ctx context.Context, name string, fn func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("loop panicked name=%s panic=%v\n%s", name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return fn(ctx)
+}
+
+func (s *supervisor) start(name string) {
+	s.wg.Add(1)
+	s.mu.Lock()
+	s.loops[name] = &LoopHealth{Name: name, Running: true}
+	s.mu.Unlock()
+}
+
+func (s *supervisor) stop(name string) {
+	s.mu.Lock()
+	delete(s.loops, name)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// wait blocks until every loop has returned or timeout passes, and
+// reports whether they all returned.
+func (s *supervisor) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *supervisor) failed(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.loops[name]; h != nil {
+		h.Running = false
+		h.LastError = err.Error()
+		h.LastFailure = time.Now()
+	}
+}
+
+func (s *supervisor) restarted(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h := s.loops[name]; h != nil {
+		h.Running = true
+		h.Restarts++
+	}
+}
+
+// health lists the supervised loops by name.
+func (s *supervisor) health() []LoopHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]LoopHealth, 0, len(s.loops))
+	for _, h := range s.loops {
+		list = append(list, *h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
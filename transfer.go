@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	quic "github.com/quic-go/quic-go"
+)
+
+const (
+	controlFile        = "file"
+	controlFileDone    = "file-done"
+	controlFileFailed  = "file-failed"
+	controlFileRefused = "file-refused"
+
+	fileHeaderLimit  = 4096
+	fileOfferTimeout = 2 * time.Minute
+
+	copyBufferSize = 256 << 10
+)
+
+// FileOffer describes a file a peer wants to send. SHA256 is the digest
+// of the plaintext; peers that predate it leave it out.
+type FileOffer struct {
+	Name       string          `json:"name"`
+	Size       int64           `json:"size"`
+	Protection *FileProtection `json:"protection,omitempty"`
+	SHA256     []byte          `json:"sha256,omitempty"`
+}
+
+// wireSize is how many bytes follow the offer on the stream: Size, or the
+// sealed length for a protected file.
+func (o FileOffer) wireSize() int64 {
+	if o.Protection != nil {
+		return sealedSize(o.Size)
+	}
+	return o.Size
+}
+
+// FileOfferInfo is a FileOffer waiting for the user, with its sender.
+type FileOfferInfo struct {
+	PeerID string
+	FileOffer
+}
+
+type pendingFile struct {
+	peerID string
+	offer  FileOffer
+	// decision receives the data key once accepted; nil for a file
+	// without a passphrase.
+	decision chan []byte
+}
+
+var (
+	errFileRefused  = errors.New("peer refused the file")
+	errFileOversize = errors.New("peer sent more than the offered size")
+	errFileCorrupt  = errors.New("file does not match the offered SHA-256")
+)
+
+// copyBuffers holds the chunk buffers file data is streamed through, so a
+// transfer never holds more than one chunk and repeated transfers do not
+// allocate a fresh one each time.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// sizeLimitReader fails with errFileOversize as soon as r yields more
+// than n bytes, handing out only the first n so nothing past the limit
+// is written anywhere.
+type sizeLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n = int(l.n)
+		l.n = 0
+		return n, errFileOversize
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
+// copyChunked copies src to dst through a pooled buffer.
+func copyChunked(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// File transfer
+//
+// A file travels on its own unidirectional stream: a "file <token>" frame,
+// a length-prefixed JSON FileOffer, then exactly Size bytes, sealed when
+// the offer carries a FileProtection. The receiver
+// reads nothing past the offer until the user accepts, so QUIC flow
+// control holds the sender back in the meantime. Refusing cancels the
+// stream and answers file-refused. Once the data is stored the receiver
+// answers with file-done, or file-failed if writing it out went wrong or
+// the data does not match the SHA-256 in the offer, in which case the
+// file is removed rather than kept as complete.
+func (s *ChuteSession) SendFile(ctx context.Context, offer FileOffer, r io.Reader) error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return ErrNoSession
+	}
+	defer s.beginTransfer()()
+
+	header, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	if len(header) > fileHeaderLimit {
+		return errors.New("file name too long")
+	}
+
+	token, done := s.addWaiter()
+	defer s.removeWaiter(token)
+
+	stream, err := conn.OpenUniStreamSync(ctx)
+	if err != nil {
+		return sendError(conn, err)
+	}
+	if err := writeLine(stream, controlFile+" "+token); err != nil {
+		stream.CancelWrite(0)
+		return err
+	}
+	prefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(prefix, uint16(len(header)))
+	if _, err := stream.Write(append(prefix, header...)); err != nil {
+		stream.CancelWrite(0)
+		return sendError(conn, err)
+	}
+	debugf("transfer", "offer sent token=%s name=%q size=%d", token, offer.Name, offer.Size)
+
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := copyChunked(stream, io.LimitReader(r, offer.wireSize()))
+		copyErr <- err
+	}()
+	select {
+	case err := <-copyErr:
+		if err != nil {
+			stream.CancelWrite(0)
+			if conn.Context().Err() != nil {
+				return sendError(conn, err)
+			}
+			return fmt.Errorf("%w: %v", errFileRefused, err)
+		}
+	case <-ctx.Done():
+		stream.CancelWrite(0)
+		return ctx.Err()
+	}
+	if err := stream.Close(); err != nil {
+		return err
+	}
+	debugf("transfer", "data sent token=%s, waiting for reply", token)
+
+	select {
+	case reply := <-done:
+		debugf("transfer", "reply received token=%s reply=%s", token, reply)
+		switch reply {
+		case controlFileDone:
+			return nil
+		case controlFileRefused:
+			return errFileRefused
+		default:
+			return errors.New("peer failed to store the file")
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.Context().Done():
+		return ErrPeerGone
+	}
+}
+
+// SetFileHandler registers fn to decide on and store incoming files. fn
+// receives offer.wireSize() bytes, and one more if the peer sent too
+// many, so it can tell without the stream running on past the offer.
+// Returning errFileRefused before reading refuses the file. Without a
+// handler every file is refused.
+func (s *ChuteSession) SetFileHandler(fn func(peerID string, offer FileOffer, r io.Reader) error) {
+	s.mu.Lock()
+	s.fileHandler = fn
+	s.mu.Unlock()
+}
+
+func (s *ChuteSession) receiveFile(conn quic.Connection, stream quic.ReceiveStream, token string) {
+	defer s.beginTransfer()()
+	offer, err := readFileOffer(stream)
+	if err != nil {
+		stream.CancelRead(0)
+		log.Printf("file offer read failed err=%v", err)
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+	debugf("transfer", "offer received token=%s name=%q size=%d", token, offer.Name, offer.Size)
+
+	s.mu.Lock()
+	handler := s.fileHandler
+	peerID := s.peerID
+	s.mu.Unlock()
+
+	reply := controlFileDone
+	err = errFileRefused
+	if handler != nil {
+		err = handler(peerID, offer, io.LimitReader(stream, offer.wireSize()+1))
+	}
+	switch {
+	case errors.Is(err, errFileRefused):
+		stream.CancelRead(0)
+		log.Printf("file refused peer_id=%s name=%q", peerID, offer.Name)
+		reply = controlFileRefused
+	case err != nil:
+		stream.CancelRead(0)
+		log.Printf("file receive failed peer_id=%s name=%q err=%v", peerID, offer.Name, err)
+		reply = controlFileFailed
+	}
+	debugf("transfer", "replying token=%s reply=%s", token, reply)
+	ctx, cancel := context.WithTimeout(conn.Context(), goodbyeTimeout)
+	defer cancel()
+	_ = writeControl(ctx, conn, reply+" "+token)
+}
+
+func readFileOffer(r io.Reader) (FileOffer, error) {
+	var offer FileOffer
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return offer, err
+	}
+	size := binary.BigEndian.Uint16(prefix)
+	if size == 0 || size > fileHeaderLimit {
+		return offer, errors.New("bad file header size")
+	}
+	header := make([]byte, size)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return offer, err
+	}
+	if err := json.Unmarshal(header, &offer); err != nil {
+		return offer, err
+	}
+	// The sealed length of a protected file must not overflow either.
+	if offer.Size < 0 || offer.wireSize() < offer.Size {
+		return offer, errors.New("bad file size")
+	}
+	if p := offer.Protection; p != nil && (len(p.Salt) != passphraseSaltSize || len(p.Verifier) == 0) {
+		return offer, errors.New("bad file protection")
+	}
+	if offer.SHA256 != nil && len(offer.SHA256) != sha256.Size {
+		return offer, errors.New("bad file digest")
+	}
+	if _, err := sanitizeFileName(offer.Name); err != nil {
+		return offer, err
+	}
+	return offer, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+// offerFrame is an offer header as SendFile writes it.
+func offerFrame(header string) []byte {
+	prefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(prefix, uint16(len(header)))
+	return append(prefix, header...)
+}
+
+func FuzzReadFileOffer(f *testing.F) {
+	f.Add(offerFrame(`{"name":"photo.jpg","size":1024}`))
+	f.Add(offerFrame(`{"name":"notes.txt","size":0}`))
+	f.Add(offerFrame(`{"name":"../../etc/passwd","size":1}`))
+	f.Add(offerFrame(`{"name":"a.bin","size":16,"protection":{"salt":"AAAAAAAAAAAAAAAAAAAAAA==","verifier":"AA=="}}`))
+	f.Add(offerFrame(`{"name":"a.bin","size":9223372036854775807,"protection":{"salt":"AAAAAAAAAAAAAAAAAAAAAA==","verifier":"AA=="}}`))
+	f.Add(offerFrame(`{"name":"a.bin","size":-1}`))
+	f.Add(offerFrame(`{"name":"a.bin","size":1,"sha256":"AAAA"}`))
+	f.Add(offerFrame(`{"name":"\u0000\u0001","size":1}`))
+	f.Add(offerFrame(`{"name":"x","size":1`))
+	f.Add(offerFrame(`{"name":"x","size":1}`)[:10])
+	f.Add([]byte{0xff, 0xff, '{'})
+	f.Add(offerFrame(`{"name":"` + strings.Repeat("a", fileHeaderLimit) + `","size":1}`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		offer, err := readFileOffer(r)
+		if len(data) < 2 {
+			if err == nil {
+				t.Fatalf("offer read from %q", data)
+			}
+			return
+		}
+		size := int(binary.BigEndian.Uint16(data))
+		if size == 0 || size > fileHeaderLimit || len(data) < 2+size {
+			if err == nil {
+				t.Fatalf("offer with header size %d read from %d bytes", size, len(data))
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		// The data that follows the header must be left on the stream.
+		if r.Len() != len(data)-2-size {
+			t.Fatalf("consumed %d bytes, header is %d", len(data)-r.Len(), 2+size)
+		}
+		if offer.Size < 0 || offer.wireSize() < offer.Size {
+			t.Fatalf("accepted size %d", offer.Size)
+		}
+		if offer.SHA256 != nil && len(offer.SHA256) != sha256.Size {
+			t.Fatalf("accepted a %d byte digest", len(offer.SHA256))
+		}
+		name, err := sanitizeFileName(offer.Name)
+		if err != nil {
+			t.Fatalf("accepted name %q: %v", offer.Name, err)
+		}
+		if strings.ContainsAny(name, `/\`) || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+			t.Fatalf("name %q stored as %q", offer.Name, name)
+		}
+	})
+}
+
+func TestSaveIncomingVerifiesDigest(t *testing.T) {
+	dir := t.TempDir()
+	c := NewClient("me", "")
+	c.SetDownloadDir(dir)
+	data := []byte("file contents")
+	sum := sha256.Sum256(data)
+	other := sha256.Sum256([]byte("something else"))
+
+	tests := []struct {
+		name string
+		sum  []byte
+		want error
+	}{
+		{"match.txt", sum[:], nil},
+		{"unsigned.txt", nil, nil},
+		{"mismatch.txt", other[:], errFileCorrupt},
+	}
+	for _, tt := range tests {
+		err := c.saveIncoming("alice", tt.name, int64(len(data)), tt.sum, bytes.NewReader(data))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+		_, statErr := os.Stat(filepath.Join(dir, tt.name))
+		if kept := statErr == nil; kept != (tt.want == nil) {
+			t.Errorf("%s: file kept=%t after err=%v", tt.name, kept, err)
+		}
+	}
+}
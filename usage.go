@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+const usageFile = "usage.json"
+
+// PeerUsage is the traffic exchanged with one peer, counted at the UDP
+// packet level so it includes QUIC overhead and retransmissions.
+type PeerUsage struct {
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+}
+
+// usageStore keeps per-peer totals across restarts. Live sessions are
+// counted by their countingConn and folded in when they close.
+type usageStore struct {
+	path string
+
+	mu     sync.Mutex
+	totals map[string]PeerUsage
+	active map[string][]*countingConn
+}
+
+// Storage
+func loadUsageStore(dir string) (*usageStore, error) {
+	store := &usageStore{
+		path:   filepath.Join(dir, usageFile),
+		totals: make(map[string]PeerUsage),
+		active: make(map[string][]*countingConn),
+	}
+	data, err := os.ReadFile(store.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.totals); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", store.path, err)
+	}
+	return store, nil
+}
+
+func (u *usageStore) saveLocked() error {
+	data, err := json.MarshalIndent(u.totals, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(u.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(u.path, data, 0o600)
+}
+
+// Tracking
+
+// track starts counting conn's traffic toward peerID. The returned
+// function stops tracking and persists the final totals.
+func (u *usageStore) track(peerID string, conn *countingConn) func() error {
+	u.mu.Lock()
+	u.active[peerID] = append(u.active[peerID], conn)
+	u.mu.Unlock()
+
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			conns := u.active[peerID]
+			for i, c := range conns {
+				if c == conn {
+					u.active[peerID] = append(conns[:i], conns[i+1:]...)
+					break
+				}
+			}
+			if len(u.active[peerID]) == 0 {
+				delete(u.active, peerID)
+			}
+			t := u.totals[peerID]
+			t.Sent += conn.sent.Load()
+			t.Received += conn.received.Load()
+			u.totals[peerID] = t
+			err = u.saveLocked()
+		})
+		return err
+	}
+}
+
+// usage returns totals per peer, including live sessions.
+func (u *usageStore) usage() map[string]PeerUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	out := make(map[string]PeerUsage, len(u.totals)+len(u.active))
+	for id, t := range u.totals {
+		out[id] = t
+	}
+	for id, conns := range u.active {
+		t := out[id]
+		for _, c := range conns {
+			t.Sent += c.sent.Load()
+			t.Received += c.received.Load()
+		}
+		out[id] = t
+	}
+	return out
+}
+
+// reset zeroes the counters for peerID, or for everyone when it is "".
+// Live sessions restart their count from now.
+func (u *usageStore) reset(peerID string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, conns := range u.active {
+		if peerID != "" && id != peerID {
+			continue
+		}
+		for _, c := range conns {
+			c.sent.Store(0)
+			c.received.Store(0)
+		}
+	}
+	if peerID == "" {
+		u.totals = make(map[string]PeerUsage)
+	} else {
+		delete(u.totals, peerID)
+	}
+	return u.saveLocked()
+}
+
+// Counting conn
+type countingConn struct {
+	net.PacketConn
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+func newCountingConn(conn net.PacketConn) *countingConn {
+	return &countingConn{PacketConn: conn}
+}
+
+func (c *countingConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.received.Add(uint64(n))
+	return n, addr, err
+}
+
+func (c *countingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, addr)
+	c.sent.Add(uint64(n))
+	return n, err
+}